@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -37,14 +38,19 @@ const (
 )
 
 
+// Map is a grid of tiles shared by every player on it. The players on a map
+// and their positions are guarded by mu, so a map may be used from several
+// connections at once.
 type Map struct {
 	id           uuid.UUID
 	name         string
 	width        int
 	height       int
 	tiles        [][]Tile
-	player       *Player.Player
 	adjacentMaps map[uuid.UUID]*Map
+
+	mu      sync.RWMutex
+	players map[uuid.UUID]*Player.Player
 }
 
 func init() {
@@ -60,6 +66,7 @@ func NewMap(name string, width, height int) *Map {
         height:       height,
         tiles:        make([][]Tile, width),
         adjacentMaps: make(map[uuid.UUID]*Map),
+        players:      make(map[uuid.UUID]*Player.Player),
     }
 
     // Generate Perlin noise values for each tile
@@ -67,14 +74,14 @@ func NewMap(name string, width, height int) *Map {
 	beta := 2.
 	n := 3
 	seed := rand.Int63()
-	noise := perlin.NewPerlin(alpha, beta, n, seed)
+	noise := perlin.NewPerlin(alpha, beta, int32(n), seed)
 
 
     for i := 0; i < width; i++ {
         m.tiles[i] = make([]Tile, height)
         for j := 0; j < height; j++ {
             // Calculate the terrain type based on the noise value
-            terrainValue := noise.At(i, j)
+            terrainValue := noise.Noise2D(float64(i)/10, float64(j)/10)
             terrainType := getTerrainType(terrainValue)
 
             // Add obstacles based on the terrain type
@@ -143,9 +150,6 @@ func (m *Map) GenerateMaze() {
     // Keep track of the current path
     path := []Tile{{x: startX, y: startY}}
 
-    // Keep track of the last visited tile that has unvisited neighbors
-    var lastTile *Tile
-
     for len(path) > 0 {
         // Get the current tile
         currentTile := path[len(path)-1]
@@ -166,13 +170,9 @@ func (m *Map) GenerateMaze() {
 
             // Add the next tile to the path
             path = append(path, nextTile)
-
-            // Remember the current tile for backtracking
-            lastTile = &currentTile
         } else {
             // Backtrack to the last tile that has unvisited neighbors
             path = path[:len(path)-1]
-            lastTile = nil
         }
     }
 }
@@ -249,20 +249,45 @@ func (m *Map) SetPlayer(player *Player.Player, x, y int) error {
 		return fmt.Errorf("coordinates (%d, %d) are out of bounds", x, y) 
 	}
 
-	if m.player != nil {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.players[player.GetID()]; ok {
 		return errors.New("player already exists on map")
 	}
 
-	m.player = player
+	m.players[player.GetID()] = player
 	player.SetLocation(x, y, m.id)
 
 	return nil
 }
 
+// RemovePlayer takes player off the map. The player keeps its last location.
 func (m *Map) RemovePlayer(player *Player.Player) {
-	if m.player == player {
-		m.player = nil
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.players, player.GetID())
+}
+
+func (m *Map) HasPlayer(player *Player.Player) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, ok := m.players[player.GetID()]
+	return ok
+}
+
+// GetPlayers returns a snapshot of the players on the map.
+func (m *Map) GetPlayers() []*Player.Player {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	players := make([]*Player.Player, 0, len(m.players))
+	for _, player := range m.players {
+		players = append(players, player)
 	}
+	return players
 }
 
 func (m *Map) AddAdjacentMap(adjacentMap *Map) {
@@ -314,16 +339,25 @@ func (m *Map) GetWalkableAdjacentTiles(x, y int) []Tile {
     return walkableTiles
 }
 
-func (m *Map) MovePlayer(dx, dy int) error {
+// MovePlayer moves a player on the map by dx, dy tiles. Only the destination
+// tile has to be walkable.
+func (m *Map) MovePlayer(player *Player.Player, dx, dy int) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    if _, ok := m.players[player.GetID()]; !ok {
+        return errors.New("player is not on this map")
+    }
+
     // Get the player's current location
-    x, y := m.player.GetLocation()
+    x, y, _ := player.GetLocation()
 
     // Calculate the new location
     newX, newY := x+dx, y+dy
 
     // Check if the new location is within bounds
     if newX < 0 || newX >= m.width || newY < 0 || newY >= m.height {
-        return fmt.Errorf("coordinates (%d, %d) are out of bounds", x, y) 
+        return fmt.Errorf("coordinates (%d, %d) are out of bounds", newX, newY) 
     }
 
     // Get the tile at the new location
@@ -335,7 +369,7 @@ func (m *Map) MovePlayer(dx, dy int) error {
     }
 
     // Update the player's location
-    m.player.SetLocation(newX, newY, m.id)
+    player.SetLocation(newX, newY, m.id)
 
     return nil
 }
@@ -364,8 +398,17 @@ func (m *Map) GetAdjacentMaps() []*Map {
     return maps
 }
 
-func (m *Map) GetPlayerLocation() (int, int) {
-    return m.player.GetLocation()
+func (m *Map) GetPlayerLocation(player *Player.Player) (int, int) {
+    x, y, _ := player.GetLocation()
+    return x, y
+}
+
+func (t Tile) GetX() int {
+    return t.x
+}
+
+func (t Tile) GetY() int {
+    return t.y
 }
 
 func (t Tile) String() string {
@@ -5,7 +5,6 @@ import (
 
 	"github.com/Bioblaze/mud/Player"
 	"github.com/Bioblaze/mud/Map"
-	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -19,37 +18,38 @@ func TestNewMap(t *testing.T) {
 
 func TestSetPlayer(t *testing.T) {
 	m := Map.NewMap("Test Map", 10, 10)
-	player := Player.NewPlayer(uuid.New(), "testplayer")
+	player := Player.NewPlayer("testplayer", 10, 10, 10, 10)
 
 	err := m.SetPlayer(player, 5, 5)
 	assert.NoError(t, err)
-	x, y := m.GetPlayerLocation()
+	x, y := m.GetPlayerLocation(player)
 	assert.Equal(t, 5, x)
 	assert.Equal(t, 5, y)
 }
 
 func TestRemovePlayer(t *testing.T) {
 	m := Map.NewMap("Test Map", 10, 10)
-	player := Player.NewPlayer(uuid.New(), "testplayer")
+	player := Player.NewPlayer("testplayer", 10, 10, 10, 10)
 
 	err := m.SetPlayer(player, 5, 5)
 	assert.NoError(t, err)
 
 	m.RemovePlayer(player)
-	assert.Nil(t, m.Player)
+	assert.False(t, m.HasPlayer(player))
+	assert.Empty(t, m.GetPlayers())
 }
 
 func TestMovePlayer(t *testing.T) {
 	m := Map.NewMap("Test Map", 10, 10)
-	player := Player.NewPlayer(uuid.New(), "testplayer")
+	player := Player.NewPlayer("testplayer", 10, 10, 10, 10)
 
 	err := m.SetPlayer(player, 5, 5)
 	assert.NoError(t, err)
 
-	err = m.MovePlayer(1, 0)
+	err = m.MovePlayer(player, 1, 0)
 	assert.NoError(t, err)
 
-	x, y := m.GetPlayerLocation()
+	x, y := m.GetPlayerLocation(player)
 	assert.Equal(t, 6, x)
 	assert.Equal(t, 5, y)
 }
@@ -4,6 +4,7 @@ import (
     "fmt"
     "math"
     "math/rand"
+    "sync"
     "time"
     "github.com/google/uuid"
 )
@@ -15,9 +16,10 @@ type Player struct {
     hp            int
     maxHP         int
     armorRating   float64
+    locationMu    sync.RWMutex // guards x, y and mapId, which other connections read
     x             int
     y             int
-    mapId         int
+    mapId         uuid.UUID
     level         int
     exp           int
     expCurve      float64
@@ -37,7 +39,7 @@ func NewPlayer(name string, maxHP, regenRate, strength, constitution int) *Playe
         armorRating:   0.0,
         x:             0,
         y:             0,
-        mapId:         0,
+        mapId:         uuid.Nil,
         level:         1,
         exp:           0,
         expCurve:      1.2,
@@ -63,7 +65,10 @@ func (p *Player) SetName(name string) {
     p.name = name
 }
 
-func (p *Player) SetLocation(x, y, mapId int) {
+func (p *Player) SetLocation(x, y int, mapId uuid.UUID) {
+    p.locationMu.Lock()
+    defer p.locationMu.Unlock()
+
     p.x = x
     p.y = y
     p.mapId = mapId
@@ -82,10 +87,14 @@ func (p *Player) AddExp(exp int) {
 }
 
 func (p *Player) String() string {
-    return fmt.Sprintf("Player %s (%s): Level %d, Exp %d, Location (%d,%d) on Map %d", p.id.String(), p.name, p.level, p.exp, p.x, p.y, p.mapId)
+    x, y, mapId := p.GetLocation()
+    return fmt.Sprintf("Player %s (%s): Level %d, Exp %d, Location (%d,%d) on Map %s", p.id.String(), p.name, p.level, p.exp, x, y, mapId.String())
 }
 
 func (p *Player) Move(direction string, distance int) {
+    p.locationMu.Lock()
+    defer p.locationMu.Unlock()
+
     switch direction {
     case "North":
         p.y += distance
@@ -102,7 +111,14 @@ func (p *Player) GetID() uuid.UUID {
     return p.id
 }
 
-func (p *Player) GetLocation() (int, int, int) {
+func (p *Player) GetName() string {
+    return p.name
+}
+
+func (p *Player) GetLocation() (int, int, uuid.UUID) {
+    p.locationMu.RLock()
+    defer p.locationMu.RUnlock()
+
     return p.x, p.y, p.mapId
 }
 
@@ -122,7 +138,10 @@ func (p *Player) SetExpModifier(modifier float64) {
     p.expModifier = modifier
 }
 
-func (p *Player) SetMapId(mapId int) {
+func (p *Player) SetMapId(mapId uuid.UUID) {
+    p.locationMu.Lock()
+    defer p.locationMu.Unlock()
+
     p.mapId = mapId
 }
 
@@ -135,8 +154,9 @@ func (p *Player) GetExpModifier() float64 {
 }
 
 func (p *Player) GetDistanceTo(x, y int) float64 {
-    deltaX := float64(p.x - x)
-    deltaY := float64(p.y - y)
+    px, py, _ := p.GetLocation()
+    deltaX := float64(px - x)
+    deltaY := float64(py - y)
     return math.Sqrt(deltaX*deltaX + deltaY*deltaY)
 }
 
@@ -186,6 +186,11 @@ void UTcpClientObject::OnPacketReceived(const FString& EventName, const FString&
     {
         OnPrivateChatMessage(EventBody);
     }
+    else if (EventName == TEXT("PING"))
+    {
+        // Echo the server's nonce so it can measure the round trip
+        SendEvent(TEXT("PONG"), EventBody);
+    }
     else if (EventName == TEXT("SPAWN_OBJECT"))
     {
         // Handle SPAWN_OBJECT event
@@ -312,8 +317,9 @@ void UTcpClientObject::ReceivePackets()
     {
         PacketBuffer += PacketData;
 
+        // Drain every complete frame; a partial frame stays buffered until the rest arrives
         FString EventName, EventBody;
-        if (TcpSocket->ParsePacket(PacketBuffer, EventName, EventBody))
+        while (TcpSocket->ParsePacket(PacketBuffer, EventName, EventBody))
         {
             OnPacketReceived(EventName, EventBody);
         }
@@ -9,6 +9,62 @@ DECLARE_DYNAMIC_MULTICAST_DELEGATE(FOnConnectedToServer);
 DECLARE_DYNAMIC_MULTICAST_DELEGATE_TwoParams(FOnChatMessageReceived, const FString&, SenderName, const FString&, Message);
 DECLARE_DYNAMIC_MULTICAST_DELEGATE_TwoParams(FOnPrivateChatMessageReceived, const FString&, SenderName, const FString&, Message);
 
+/**
+ * Wire format (must match framing.go on the server)
+ *
+ * Every packet is a frame made of a 4-byte big-endian unsigned length followed
+ * by that many bytes of UTF-8 JSON:
+ *
+ *     [u32 length][{"event_name":"MOVE","event_body":"0,1.000000,2.000000"}]
+ *
+ * The server rejects frames larger than MAX_FRAME_SIZE (64 KiB by default).
+ * When the server runs with FRAME_MODE=newline, each packet is instead a single
+ * line of JSON terminated by '\n'.
+ *
+ * FTcpSocket::ParsePacket must consume exactly one complete frame from the
+ * front of the buffer and return false, leaving the buffer untouched, when the
+ * frame has not fully arrived yet. A single receive may carry several frames
+ * or only part of one.
+ *
+ * A packet may also carry an "id" string and/or an increasing "seq" number:
+ *
+ *     {"id":"move-17","seq":17,"event_name":"MOVE","event_body":"0,1.000000,2.000000"}
+ *
+ * The server answers such packets with an ACK once handled, or a NACK carrying
+ * an error code, echoing the id and seq. Resending a packet with the same id
+ * is safe: the server remembers recent ids per connection and replays the
+ * original ACK/NACK instead of handling it twice.
+ *
+ * After login the server sends a SESSION event with a resume_token, and
+ * numbers every packet it sends with "seq". If the connection drops, the
+ * player stays in the world for grace_period_ms. Reconnecting with
+ *
+ *     RESUME <resume_token> <last seq received>
+ *
+ * in place of the login token reattaches to the session: the events missed
+ * since that seq are sent again, followed by a SESSION event with a new token.
+ *
+ * Instead of the bare token or RESUME command, newer clients open with a HELLO
+ * naming the protocol version, their build and the features they support:
+ *
+ *     {"protocol_version":1,"client_build":"1.2.0","features":["resume"],"token":"<jwt>"}
+ *
+ * ("resume_token" and "last_seq" replace "token" to resume). The server's first
+ * packet is then a HELLO event listing the features it agreed to, or an ERROR
+ * with code UNSUPPORTED_VERSION before it closes the connection. Clients that
+ * send a HELLO are only sent a resume token if they asked for "resume".
+ *
+ * With "binary" agreed, every frame after the HELLO reply, in both directions,
+ * is [uvarint name length][event_name][uvarint seq][uvarint id length][id]
+ * followed by the JSON event_body to the end of the frame. The server only
+ * agrees to "binary" with length-prefixed frames.
+ *
+ * With "compression" agreed, either side may deflate (raw DEFLATE, RFC 1951)
+ * a frame's payload and set the top bit of its u32 length; the server does so
+ * for payloads of COMPRESSION_THRESHOLD bytes or more. Compressed frames must
+ * inflate to at most MAX_DECOMPRESSED_SIZE (1 MiB by default) or the server
+ * drops the connection.
+ */
 UCLASS()
 class MYPROJECT_API UTcpClientObject : public UObject
 {
@@ -72,6 +128,8 @@ private:
     FTimerHandle ReconnectTimerHandle;
     FTimerHandle HeartbeatTimerHandle;
     FTimerHandle RetrySendTimerHandle;
+    // Bytes received but not yet consumed by ParsePacket
+    FString PacketBuffer;
 
     void StopHeartbeatTimer();
     void StartHeartbeatTimer();
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	AckEvent  = "ACK"
+	NackEvent = "NACK"
+
+	// DefaultDedupWindow is how many recent request IDs a session remembers
+	// to recognise retries
+	DefaultDedupWindow = 128
+)
+
+// AckNotice is the body of the ACK and NACK events sent in reply to a packet
+// carrying an ID or sequence number. A NACK also carries the error code and
+// message; the client may retry a NACKed packet with the same ID.
+type AckNotice struct {
+	ID      string    `json:"id,omitempty"`
+	Seq     uint64    `json:"seq,omitempty"`
+	Code    ErrorCode `json:"code,omitempty"`
+	Message string    `json:"message,omitempty"`
+}
+
+// requestKey identifies a packet for acknowledgement and de-duplication. It
+// is empty for packets that carry neither an ID nor a sequence number; those
+// are never acknowledged.
+func (p *Packet) requestKey() string {
+	if p.ID != "" {
+		return "id:" + p.ID
+	}
+	if p.Seq != 0 {
+		return "seq:" + strconv.FormatUint(p.Seq, 10)
+	}
+	return ""
+}
+
+// dedupWindow remembers the last few requests of a session and the reply
+// sent for each, so a retried packet is answered again instead of being
+// handled twice. It is shared by the read and dispatch goroutines.
+type dedupWindow struct {
+	mu      sync.Mutex
+	size    int
+	order   []string
+	entries map[string]*dedupEntry
+}
+
+type dedupEntry struct {
+	reply *Packet // nil while the original is still queued or running
+}
+
+func newDedupWindow(size int) *dedupWindow {
+	return &dedupWindow{
+		size:    size,
+		entries: make(map[string]*dedupEntry),
+	}
+}
+
+// begin records key as in flight. If key was already seen it returns false
+// along with the reply sent for it, which is nil while the original has not
+// finished.
+func (w *dedupWindow) begin(key string) (*Packet, bool) {
+	if w.size <= 0 {
+		return nil, true
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if entry, ok := w.entries[key]; ok {
+		return entry.reply, false
+	}
+
+	if len(w.order) >= w.size {
+		delete(w.entries, w.order[0])
+		w.order = w.order[1:]
+	}
+	w.order = append(w.order, key)
+	w.entries[key] = &dedupEntry{}
+	return nil, true
+}
+
+// finish stores the reply for key so later retries get the same answer.
+func (w *dedupWindow) finish(key string, reply *Packet) {
+	if w.size <= 0 {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if entry, ok := w.entries[key]; ok {
+		entry.reply = reply
+	}
+}
+
+// abandon forgets key if it is still in flight, for a packet that will
+// never be handled, so a retry of it is handled instead of ignored.
+func (w *dedupWindow) abandon(key string) {
+	if w.size <= 0 || key == "" {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if entry, ok := w.entries[key]; !ok || entry.reply != nil {
+		return
+	}
+	delete(w.entries, key)
+	for i, queued := range w.order {
+		if queued == key {
+			w.order = append(w.order[:i], w.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// acknowledge sends ACK, or NACK when err is not nil, for a packet carrying a
+// request key and returns the reply so it can be replayed to retries.
+func (s *Session) acknowledge(packet *Packet, err error) *Packet {
+	if packet.requestKey() == "" {
+		return nil
+	}
+
+	notice := AckNotice{ID: packet.ID, Seq: packet.Seq}
+	eventName := AckEvent
+	if err != nil {
+		errorNotice := newErrorNotice(err, packet)
+		notice.Code = errorNotice.Code
+		notice.Message = errorNotice.Message
+		eventName = NackEvent
+	}
+
+	body, marshalErr := json.Marshal(notice)
+	if marshalErr != nil {
+		logrus.Error("Error encoding ", eventName, " for session ", s.id.String(), ": ", marshalErr)
+		return nil
+	}
+
+	reply := &Packet{EventName: eventName, EventBody: body}
+	s.SendPacket(reply)
+	return reply
+}
+
+// checkDuplicate reports whether packet is a retry of a request the session
+// has already accepted. A retry of a finished request gets the original
+// reply again; a retry of one still being handled is ignored, as its reply
+// is on the way.
+func (s *Session) checkDuplicate(packet *Packet) bool {
+	key := packet.requestKey()
+	if key == "" {
+		return false
+	}
+
+	reply, fresh := s.dedup.begin(key)
+	if fresh {
+		return false
+	}
+
+	logrus.Debug("Duplicate request ", key, " on session ", s.id.String())
+	if reply != nil {
+		s.SendPacket(reply)
+	}
+	return true
+}
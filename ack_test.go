@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPacketRequestKey(t *testing.T) {
+	assert.Equal(t, "", (&Packet{}).requestKey())
+	assert.Equal(t, "id:a", (&Packet{ID: "a", Seq: 3}).requestKey())
+	assert.Equal(t, "seq:3", (&Packet{Seq: 3}).requestKey())
+}
+
+func TestDedupWindow(t *testing.T) {
+	w := newDedupWindow(2)
+
+	_, fresh := w.begin("a")
+	assert.True(t, fresh)
+
+	reply, fresh := w.begin("a")
+	assert.False(t, fresh)
+	assert.Nil(t, reply, "the original is still in flight")
+
+	ack := &Packet{EventName: AckEvent}
+	w.finish("a", ack)
+	reply, fresh = w.begin("a")
+	assert.False(t, fresh)
+	assert.Equal(t, ack, reply)
+
+	// The oldest key falls out of the window
+	w.begin("b")
+	w.begin("c")
+	_, fresh = w.begin("a")
+	assert.True(t, fresh)
+}
+
+func TestDedupWindowDisabled(t *testing.T) {
+	w := newDedupWindow(0)
+	w.begin("a")
+	_, fresh := w.begin("a")
+	assert.True(t, fresh)
+}
+
+func TestHandleConnectionAcksAndDeduplicates(t *testing.T) {
+	srv, addr := startTestServer(t)
+	calls := make(chan struct{}, 4)
+	srv.RegisterEventHandler("testMove", func(session *Session, eventBody json.RawMessage) error {
+		calls <- struct{}{}
+		return nil
+	})
+	srv.RegisterEventHandler("testFail", func(session *Session, eventBody json.RawMessage) error {
+		return &InvalidStateError{msg: "not now"}
+	})
+
+	client, decoder := joinTestClient(t, srv, addr, "alice")
+	client.SetDeadline(time.Now().Add(time.Second))
+	readAck := func() (string, AckNotice) {
+		t.Helper()
+		reply, err := decoder.Decode()
+		if !assert.NoError(t, err) {
+			return "", AckNotice{}
+		}
+		var notice AckNotice
+		json.Unmarshal(reply.EventBody, &notice)
+		return reply.EventName, notice
+	}
+
+	move := &Packet{ID: "m1", Seq: 1, EventName: "testMove", EventBody: json.RawMessage(`{}`)}
+	sendPacket(client, move)
+	event, notice := readAck()
+	assert.Equal(t, AckEvent, event)
+	assert.Equal(t, AckNotice{ID: "m1", Seq: 1}, notice)
+
+	// A retry gets the same ACK without running the handler again
+	sendPacket(client, move)
+	event, notice = readAck()
+	assert.Equal(t, AckEvent, event)
+	assert.Equal(t, "m1", notice.ID)
+	assert.Len(t, calls, 1)
+
+	sendPacket(client, &Packet{Seq: 2, EventName: "testFail", EventBody: json.RawMessage(`{}`)})
+	reply, err := decoder.Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, ErrorEvent, reply.EventName)
+	event, notice = readAck()
+	assert.Equal(t, NackEvent, event)
+	assert.Equal(t, AckNotice{Seq: 2, Code: ErrCodeInvalidState, Message: "not now"}, notice)
+
+	// Packets without an ID or sequence number are not acknowledged
+	sendPacket(client, &Packet{EventName: "testMove", EventBody: json.RawMessage(`{}`)})
+	assert.Eventually(t, func() bool { return len(calls) == 2 }, time.Second, 10*time.Millisecond)
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = decoder.Decode()
+	assert.Error(t, err)
+}
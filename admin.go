@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// AdminRole is the token role admin events and commands require
+	AdminRole = "admin"
+
+	KickEvent     = "KICK"
+	AnnounceEvent = "ANNOUNCE"
+)
+
+// KickBody asks to disconnect a player. A kicked session cannot be resumed.
+type KickBody struct {
+	Player string `json:"player" validate:"required"`
+	Reason string `json:"reason,omitempty" validate:"maxlen=200"`
+}
+
+// AnnounceBody asks to send a message to every player.
+type AnnounceBody struct {
+	Message string `json:"message" validate:"required,maxlen=500"`
+}
+
+// Announcement is the body of ANNOUNCE sent to clients.
+type Announcement struct {
+	From    string `json:"from"`
+	Message string `json:"message"`
+}
+
+func (s *Server) registerAdminHandlers() error {
+	admin := RequireRole(AdminRole)
+	if err := s.RegisterTypedHandler(KickEvent, s.handleKick, admin); err != nil {
+		return err
+	}
+	return s.RegisterTypedHandler(AnnounceEvent, s.handleAnnounce, admin)
+}
+
+func (s *Server) handleKick(session *Session, body *KickBody) error {
+	target, ok := s.sessions.GetByName(body.Player)
+	if !ok {
+		return &NotFoundError{msg: fmt.Sprintf("Player %s is not online", body.Player)}
+	}
+
+	reason := body.Reason
+	if reason == "" {
+		reason = "kicked by an admin"
+	}
+	logrus.Info("Session ", target.id.String(), " of ", body.Player, " kicked by account ",
+		session.GetClaims().GetAccountID(), ": ", reason)
+
+	// Without a resume token the session is released rather than held, and
+	// one already held is released now
+	token := target.getResumeToken()
+	target.setResumeToken("")
+	target.Send(KickedEvent, map[string]string{"reason": reason})
+	target.Close()
+	if token != "" {
+		if parked, ok := s.unpark(token); ok {
+			s.release(parked)
+		}
+	}
+	return nil
+}
+
+func (s *Server) handleAnnounce(session *Session, body *AnnounceBody) error {
+	from := session.GetClaims().GetCharacterName()
+	if player := session.GetPlayer(); player != nil {
+		from = player.GetName()
+	}
+	return s.sessions.Broadcast(AnnounceEvent, Announcement{From: from, Message: body.Message})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Bioblaze/mud/Player"
+)
+
+const (
+	KickedEvent = "KICKED"
+
+	DefaultPlayerMaxHP        = 10
+	DefaultPlayerRegenRate    = 10
+	DefaultPlayerStrength     = 10
+	DefaultPlayerConstitution = 10
+)
+
+// JwtClaims are the claims the server expects in a login token. AccountID
+// and CharacterName fall back to the standard "sub" claim so plain tokens
+// keep working.
+type JwtClaims struct {
+	AccountID     string   `json:"account_id,omitempty"`
+	CharacterName string   `json:"character_name,omitempty"`
+	Roles         []string `json:"roles,omitempty"`
+	jwt.StandardClaims
+}
+
+func (c *JwtClaims) GetAccountID() string {
+	if c.AccountID != "" {
+		return c.AccountID
+	}
+	return c.Subject
+}
+
+func (c *JwtClaims) GetCharacterName() string {
+	if c.CharacterName != "" {
+		return c.CharacterName
+	}
+	return c.GetAccountID()
+}
+
+func (c *JwtClaims) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if strings.EqualFold(r, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoginPolicy decides what happens when an account that already has a live
+// session logs in again.
+type LoginPolicy int
+
+const (
+	// LoginReject refuses the new connection
+	LoginReject LoginPolicy = iota
+	// LoginKickOld disconnects the existing session in favour of the new one
+	LoginKickOld
+)
+
+func (p LoginPolicy) String() string {
+	switch p {
+	case LoginReject:
+		return "reject"
+	case LoginKickOld:
+		return "kick"
+	default:
+		return "unknown"
+	}
+}
+
+func (p LoginPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *LoginPolicy) UnmarshalText(text []byte) error {
+	policy, err := ParseLoginPolicy(string(text))
+	if err != nil {
+		return err
+	}
+	*p = policy
+	return nil
+}
+
+func ParseLoginPolicy(value string) (LoginPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "reject":
+		return LoginReject, nil
+	case "kick", "kick-old":
+		return LoginKickOld, nil
+	default:
+		return LoginReject, fmt.Errorf("unknown login policy: %s", value)
+	}
+}
+
+var ErrAlreadyLoggedIn = errors.New("account is already logged in")
+
+// PlayerStore loads the Player of an account's character, creating it on
+// first login, and persists it when the player leaves.
+type PlayerStore interface {
+	LoadOrCreate(accountID, characterName string) (*Player.Player, error)
+	Save(accountID string, player *Player.Player) error
+}
+
+// MemoryPlayerStore keeps players for the lifetime of the process.
+type MemoryPlayerStore struct {
+	mu      sync.Mutex
+	players map[string]*Player.Player
+}
+
+func NewMemoryPlayerStore() *MemoryPlayerStore {
+	return &MemoryPlayerStore{players: make(map[string]*Player.Player)}
+}
+
+func (s *MemoryPlayerStore) LoadOrCreate(accountID, characterName string) (*Player.Player, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := accountID + "/" + nameKey(characterName)
+	if player, ok := s.players[key]; ok {
+		return player, nil
+	}
+
+	player := Player.NewPlayer(characterName, DefaultPlayerMaxHP, DefaultPlayerRegenRate, DefaultPlayerStrength, DefaultPlayerConstitution)
+	s.players[key] = player
+	return player, nil
+}
+
+func (s *MemoryPlayerStore) Save(accountID string, player *Player.Player) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.players[accountID+"/"+nameKey(player.GetName())] = player
+	return nil
+}
+
+// login binds the Player described by the session's claims to the session,
+// enforcing the configured LoginPolicy against other sessions of the same
+// account.
+func (s *Server) login(session *Session) error {
+	claims := session.GetClaims()
+	if claims == nil {
+		return errors.New("session has no claims")
+	}
+
+	accountID := claims.GetAccountID()
+	if accountID == "" {
+		return errors.New("token has no account ID")
+	}
+
+	// A fresh login replaces any session of the account held for resuming
+	s.releaseParked(accountID)
+
+	player, err := s.players.LoadOrCreate(accountID, claims.GetCharacterName())
+	if err != nil {
+		return err
+	}
+
+	kicked, err := s.sessions.Login(session, player, s.config.LoginPolicy)
+	if err != nil {
+		return err
+	}
+
+	if kicked != nil {
+		logrus.Info("Account ", accountID, " logged in again, kicking session ", kicked.id.String())
+		kicked.Send(KickedEvent, map[string]string{"reason": "logged in from another connection"})
+		kicked.Close()
+	}
+
+	logrus.Info("Player ", player.GetName(), " logged in on session ", session.id.String())
+	return nil
+}
+
+// savePlayer persists the Player bound to session, if any.
+func (s *Server) savePlayer(session *Session) error {
+	player := session.GetPlayer()
+	if player == nil {
+		return nil
+	}
+	return s.players.Save(session.GetClaims().GetAccountID(), player)
+}
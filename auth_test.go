@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Bioblaze/mud/Player"
+)
+
+func newTestClaims(accountID, characterName string, roles ...string) *JwtClaims {
+	return &JwtClaims{AccountID: accountID, CharacterName: characterName, Roles: roles}
+}
+
+func TestJwtClaimsFallbacks(t *testing.T) {
+	claims := &JwtClaims{StandardClaims: jwt.StandardClaims{Subject: "1234"}}
+	assert.Equal(t, "1234", claims.GetAccountID())
+	assert.Equal(t, "1234", claims.GetCharacterName())
+
+	claims = newTestClaims("acc", "Alice", "admin")
+	assert.Equal(t, "acc", claims.GetAccountID())
+	assert.Equal(t, "Alice", claims.GetCharacterName())
+	assert.True(t, claims.HasRole("ADMIN"))
+	assert.False(t, claims.HasRole("builder"))
+}
+
+func TestMemoryPlayerStore(t *testing.T) {
+	store := NewMemoryPlayerStore()
+
+	first, err := store.LoadOrCreate("acc", "Alice")
+	assert.NoError(t, err)
+	assert.Equal(t, "Alice", first.GetName())
+
+	again, err := store.LoadOrCreate("acc", "alice")
+	assert.NoError(t, err)
+	assert.Equal(t, first.GetID(), again.GetID())
+
+	other, err := store.LoadOrCreate("acc", "Bob")
+	assert.NoError(t, err)
+	assert.NotEqual(t, first.GetID(), other.GetID())
+
+	saved := Player.NewPlayer("Carol", 20, 2, 10, 5)
+	assert.NoError(t, store.Save("acc", saved))
+	loaded, err := store.LoadOrCreate("acc", "carol")
+	assert.NoError(t, err)
+	assert.Equal(t, saved.GetID(), loaded.GetID())
+}
+
+func TestServerLoginBindsPlayer(t *testing.T) {
+	srv := newTestServer(t)
+
+	session, _ := newTestSession(t)
+	session.claims = newTestClaims("acc", "Alice")
+	srv.sessions.Add(session)
+
+	assert.NoError(t, srv.login(session))
+	assert.NotNil(t, session.GetPlayer())
+	assert.Equal(t, "Alice", session.GetPlayer().GetName())
+
+	found, ok := srv.sessions.GetByAccount("acc")
+	assert.True(t, ok)
+	assert.Equal(t, session, found)
+}
+
+func TestServerLoginRejectsDuplicate(t *testing.T) {
+	srv := newTestServer(t)
+
+	first, _ := newTestSession(t)
+	first.claims = newTestClaims("acc", "Alice")
+	second, _ := newTestSession(t)
+	second.claims = newTestClaims("acc", "Alice")
+	srv.sessions.Add(first)
+	srv.sessions.Add(second)
+
+	assert.NoError(t, srv.login(first))
+	assert.Equal(t, ErrAlreadyLoggedIn, srv.login(second))
+	assert.Nil(t, second.GetPlayer())
+}
+
+func TestRejectedLoginIsNotGreeted(t *testing.T) {
+	srv, addr := startTestServer(t)
+	joinTestClient(t, srv, addr, "alice")
+
+	// The second login is refused before any HELLO reply, and says why
+	_, decoder := dialHello(t, addr, HelloRequest{ProtocolVersion: ProtocolVersion, Token: testToken(t, "alice")})
+	packet, err := decoder.Decode()
+	if assert.NoError(t, err) {
+		assert.Equal(t, ErrorEvent, packet.EventName)
+
+		var notice ErrorNotice
+		assert.NoError(t, json.Unmarshal(packet.EventBody, &notice))
+		assert.Equal(t, ErrCodeUnauthorized, notice.Code)
+		assert.Contains(t, notice.Message, ErrAlreadyLoggedIn.Error())
+	}
+	_, err = decoder.Decode()
+	assert.Equal(t, io.EOF, err)
+	assert.Eventually(t, func() bool { return srv.GetSessions().Count() == 1 }, time.Second, 10*time.Millisecond)
+}
+
+func TestServerLoginKicksOld(t *testing.T) {
+	srv := newTestServer(t, func(config *Config) { config.LoginPolicy = LoginKickOld })
+
+	first, firstIn := newTestSession(t)
+	first.claims = newTestClaims("acc", "Alice")
+	second, _ := newTestSession(t)
+	second.claims = newTestClaims("acc", "Alice")
+	srv.sessions.Add(first)
+	srv.sessions.Add(second)
+
+	assert.NoError(t, srv.login(first))
+	assert.NoError(t, srv.login(second))
+
+	packet, err := firstIn.Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, KickedEvent, packet.EventName)
+	<-first.Done()
+
+	found, ok := srv.sessions.GetByName("Alice")
+	assert.True(t, ok)
+	assert.Equal(t, second, found)
+	assert.Equal(t, first.GetPlayer().GetID(), second.GetPlayer().GetID())
+	assert.Equal(t, 1, srv.sessions.Count())
+}
+
+func TestServerLoginRequiresAccount(t *testing.T) {
+	srv := newTestServer(t)
+
+	session, _ := newTestSession(t)
+	session.claims = &JwtClaims{}
+	assert.Error(t, srv.login(session))
+}
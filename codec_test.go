@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var benchmarkMove = &Packet{
+	ID:        "move-17",
+	Seq:       17,
+	EventName: MoveEvent,
+	EventBody: json.RawMessage(`{"controller_id":3,"x":12,"y":-4}`),
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	packets := []*Packet{
+		benchmarkMove,
+		{EventName: ChatEvent, EventBody: json.RawMessage(`"bob,hello"`)},
+		{EventName: "ÉVÉNEMENT", EventBody: json.RawMessage(`null`)},
+	}
+
+	for _, codec := range []Codec{JSONCodec{}, BinaryCodec{}} {
+		for _, packet := range packets {
+			data, err := codec.Marshal(packet)
+			if !assert.NoError(t, err, codec.Name()) {
+				continue
+			}
+
+			var decoded Packet
+			assert.NoError(t, codec.Unmarshal(data, &decoded), codec.Name())
+			assert.Equal(t, *packet, decoded, codec.Name())
+		}
+	}
+}
+
+func TestBinaryCodecIsSmaller(t *testing.T) {
+	jsonData, _ := JSONCodec{}.Marshal(benchmarkMove)
+	binaryData, _ := BinaryCodec{}.Marshal(benchmarkMove)
+	assert.Less(t, len(binaryData), len(jsonData))
+}
+
+func TestBinaryCodecMalformed(t *testing.T) {
+	valid, _ := BinaryCodec{}.Marshal(benchmarkMove)
+
+	for name, data := range map[string][]byte{
+		"empty":            {},
+		"name overruns":    {0x7f, 'M'},
+		"truncated varint": {0x80},
+		"missing seq":      {0x01, 'M'},
+		"id overruns":      {0x01, 'M', 0x00, 0x09, 'x'},
+		"body is not JSON": append(append([]byte{}, valid[:len(valid)-1]...), '{'),
+		"varint too long":  bytes.Repeat([]byte{0xff}, 11),
+	} {
+		var packet Packet
+		err := BinaryCodec{}.Unmarshal(data, &packet)
+		assert.True(t, errors.Is(err, ErrMalformedBinary), name)
+	}
+
+	// A packet with no body decodes, and is rejected as any other would be
+	var packet Packet
+	data, _ := BinaryCodec{}.Marshal(&Packet{EventName: PingEvent})
+	assert.NoError(t, BinaryCodec{}.Unmarshal(data, &packet))
+	assert.Nil(t, packet.EventBody)
+}
+
+func TestBinarySession(t *testing.T) {
+	srv, addr := startTestServer(t)
+
+	conn, decoder := dialHello(t, addr, HelloRequest{
+		ProtocolVersion: ProtocolVersion,
+		Features:        []string{FeatureBinary},
+		Token:           testToken(t, "alice"),
+	})
+
+	// The HELLO reply is JSON; what follows is binary
+	packet, err := decoder.Decode()
+	if assert.NoError(t, err) {
+		assert.Equal(t, HelloEvent, packet.EventName)
+		assert.JSONEq(t, `["binary"]`, string(mustField(t, packet.EventBody, "features")))
+	}
+	decoder.SetCodec(BinaryCodec{})
+	_, err = readEvent(decoder, SpawnPlayerEvent)
+	assert.NoError(t, err)
+
+	session, _ := srv.GetSessions().GetByAccount("alice")
+	assert.Equal(t, "binary", session.Codec().Name())
+
+	encoder := NewPacketEncoder(conn, LengthPrefixed, DefaultMaxFrameSize)
+	encoder.SetCodec(BinaryCodec{})
+	encoder.Encode(&Packet{ID: "p1", EventName: PingEvent, EventBody: json.RawMessage(`{"nonce":9}`)})
+
+	reply, err := readEvent(decoder, PongEvent)
+	if assert.NoError(t, err) {
+		assert.JSONEq(t, `{"nonce":9}`, string(reply.EventBody))
+	}
+	reply, err = readEvent(decoder, AckEvent)
+	if assert.NoError(t, err) {
+		assert.JSONEq(t, `"p1"`, string(mustField(t, reply.EventBody, "id")))
+	}
+
+	// Garbage in the binary codec is reported like malformed JSON
+	NewFrameWriter(conn, LengthPrefixed, 0).WriteFrame([]byte{0x7f})
+	reply, err = readEvent(decoder, ErrorEvent)
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(reply.EventBody), "bad binary packet")
+	}
+}
+
+func benchmarkMarshal(b *testing.B, codec Codec) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := codec.Marshal(benchmarkMove); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkUnmarshal(b *testing.B, codec Codec) {
+	data, err := codec.Marshal(benchmarkMove)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var packet Packet
+		if err := codec.Unmarshal(data, &packet); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkJSONCodecMarshal(b *testing.B)     { benchmarkMarshal(b, JSONCodec{}) }
+func BenchmarkBinaryCodecMarshal(b *testing.B)   { benchmarkMarshal(b, BinaryCodec{}) }
+func BenchmarkJSONCodecUnmarshal(b *testing.B)   { benchmarkUnmarshal(b, JSONCodec{}) }
+func BenchmarkBinaryCodecUnmarshal(b *testing.B) { benchmarkUnmarshal(b, BinaryCodec{}) }
+
+func TestBinaryNeedsLengthPrefixedFrames(t *testing.T) {
+	srv := newTestServer(t, func(config *Config) {
+		config.FrameMode = NewlineDelimited
+	})
+	assert.Empty(t, srv.negotiate(nil, &HelloRequest{ProtocolVersion: ProtocolVersion, Features: []string{FeatureBinary}}))
+}
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Text commands
+//
+// Players of text clients type commands such as "tell bob hi" rather than
+// build packets. A COMMAND packet carries the line typed: the server expands
+// the player's aliases, finds the command by name, alias or unique prefix of
+// its name, parses the arguments against the command's grammar and runs it.
+// Commands act by running the handlers of the JSON events, so they are
+// validated, rate limited and role checked exactly like the packets.
+
+const (
+	CommandEvent = "COMMAND"
+	TextEvent    = "TEXT"
+
+	// MaxAliases is how many aliases a player may define, each expanding to
+	// at most MaxAliasLength bytes
+	MaxAliases     = 32
+	MaxAliasLength = 200
+)
+
+// CommandBody is the body of COMMAND.
+type CommandBody struct {
+	Line string `json:"line" validate:"required,maxlen=500"`
+}
+
+// TextMessage is the body of TEXT: command output to show as it is.
+type TextMessage struct {
+	Text string `json:"text"`
+}
+
+// Command is a verb players can type. Usage is its argument grammar, a list
+// of parameters: <name> for a required word, [name] for an optional one, and
+// "..." after the name of the last one to take the rest of the line.
+type Command struct {
+	Name    string
+	Aliases []string // also accepted in place of Name, such as n for north
+	Usage   string
+	Summary string
+	Role    string // needed to see and run the command, "" for everyone
+	Run     func(ctx *CommandContext, args CommandArgs) error
+
+	params []commandParam
+}
+
+type commandParam struct {
+	name     string
+	optional bool
+	rest     bool
+}
+
+// CommandArgs are the arguments given to a command by parameter name.
+// Optional parameters that were left out are missing.
+type CommandArgs map[string]string
+
+// CommandContext is the session a command runs for.
+type CommandContext struct {
+	server  *Server
+	session *Session
+}
+
+// Do runs the handler of eventName as if the client had sent body. The
+// handler's own middleware, such as role checks and rate limits, applies;
+// the global middleware does not, as the command's call already went through
+// it.
+func (ctx *CommandContext) Do(eventName string, body interface{}) error {
+	handler, ok := ctx.server.events.lookupNested(eventName)
+	if !ok {
+		return fmt.Errorf("no handler for %s", eventName)
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return handler(ctx.session, data)
+}
+
+// Reply sends text to the client.
+func (ctx *CommandContext) Reply(text string) error {
+	return ctx.session.Send(TextEvent, TextMessage{Text: text})
+}
+
+// usage is the command line the command expects, e.g. "tell <player> <message...>".
+func (cmd *Command) usage() string {
+	if cmd.Usage == "" {
+		return cmd.Name
+	}
+	return cmd.Name + " " + cmd.Usage
+}
+
+func (cmd *Command) allowed(session *Session) bool {
+	return cmd.Role == "" || (session.GetClaims() != nil && session.GetClaims().HasRole(cmd.Role))
+}
+
+// parseUsage compiles a command's argument grammar.
+func parseUsage(usage string) ([]commandParam, error) {
+	var params []commandParam
+	for _, field := range strings.Fields(usage) {
+		var param commandParam
+		switch {
+		case strings.HasPrefix(field, "<") && strings.HasSuffix(field, ">"):
+		case strings.HasPrefix(field, "[") && strings.HasSuffix(field, "]"):
+			param.optional = true
+		default:
+			return nil, fmt.Errorf("parameter %q must be written <name> or [name]", field)
+		}
+
+		param.name = field[1 : len(field)-1]
+		if strings.HasSuffix(param.name, "...") {
+			param.rest = true
+			param.name = strings.TrimSuffix(param.name, "...")
+		}
+		if param.name == "" {
+			return nil, fmt.Errorf("parameter %q has no name", field)
+		}
+
+		if len(params) > 0 {
+			last := params[len(params)-1]
+			if last.rest {
+				return nil, fmt.Errorf("%s takes the rest of the line, so nothing may follow it", last.name)
+			}
+			if last.optional && !param.optional {
+				return nil, fmt.Errorf("required %s follows optional %s", param.name, last.name)
+			}
+		}
+		params = append(params, param)
+	}
+	return params, nil
+}
+
+// parseArgs matches the text after the verb against the command's grammar.
+func (cmd *Command) parseArgs(text string) (CommandArgs, error) {
+	args := CommandArgs{}
+	rest := strings.TrimSpace(text)
+	for _, param := range cmd.params {
+		var value string
+		if param.rest {
+			value, rest = rest, ""
+		} else {
+			value, rest = splitWord(rest)
+		}
+
+		if value == "" {
+			if !param.optional {
+				return nil, &PacketValidationError{msg: "Usage: " + cmd.usage()}
+			}
+			continue
+		}
+		args[param.name] = value
+	}
+
+	if rest != "" {
+		return nil, &PacketValidationError{msg: "Usage: " + cmd.usage()}
+	}
+	return args, nil
+}
+
+// splitWord splits the first word off s.
+func splitWord(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexAny(s, " \t"); i >= 0 {
+		return s[:i], strings.TrimSpace(s[i+1:])
+	}
+	return s, ""
+}
+
+// CommandSet holds the commands players can type.
+type CommandSet struct {
+	mu       sync.RWMutex
+	commands map[string]*Command // by name
+	aliases  map[string]*Command
+}
+
+func NewCommandSet() *CommandSet {
+	return &CommandSet{
+		commands: make(map[string]*Command),
+		aliases:  make(map[string]*Command),
+	}
+}
+
+// Register adds cmd, refusing a bad grammar or a name or alias that is
+// already taken.
+func (cs *CommandSet) Register(cmd Command) error {
+	if cmd.Name == "" || strings.ContainsAny(cmd.Name, " \t") {
+		return fmt.Errorf("command name %q must be a single word", cmd.Name)
+	}
+	if cmd.Run == nil {
+		return fmt.Errorf("%s: command has nothing to run", cmd.Name)
+	}
+	params, err := parseUsage(cmd.Usage)
+	if err != nil {
+		return fmt.Errorf("%s: %v", cmd.Name, err)
+	}
+	cmd.params = params
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cmd.Name = strings.ToLower(cmd.Name)
+	for _, name := range append([]string{cmd.Name}, cmd.Aliases...) {
+		name = strings.ToLower(name)
+		if cs.commands[name] != nil || cs.aliases[name] != nil {
+			return fmt.Errorf("%s: %s is already a command", cmd.Name, name)
+		}
+	}
+
+	cs.commands[cmd.Name] = &cmd
+	for _, alias := range cmd.Aliases {
+		cs.aliases[strings.ToLower(alias)] = &cmd
+	}
+	return nil
+}
+
+// Lookup finds the command verb stands for among those session may run: one
+// named or aliased verb, or else the only one whose name starts with verb.
+func (cs *CommandSet) Lookup(session *Session, verb string) (*Command, error) {
+	verb = strings.ToLower(verb)
+
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	for _, cmd := range []*Command{cs.commands[verb], cs.aliases[verb]} {
+		if cmd != nil && cmd.allowed(session) {
+			return cmd, nil
+		}
+	}
+
+	var matches []string
+	for name, cmd := range cs.commands {
+		if strings.HasPrefix(name, verb) && cmd.allowed(session) {
+			matches = append(matches, name)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, &NotFoundError{msg: fmt.Sprintf("Unknown command %s. Type help for a list of commands.", verb)}
+	case 1:
+		return cs.commands[matches[0]], nil
+	default:
+		sort.Strings(matches)
+		return nil, &PacketValidationError{msg: fmt.Sprintf("%s could be any of: %s", verb, strings.Join(matches, ", "))}
+	}
+}
+
+// Commands returns the commands session may run, sorted by name.
+func (cs *CommandSet) Commands(session *Session) []*Command {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	var commands []*Command
+	for _, cmd := range cs.commands {
+		if cmd.allowed(session) {
+			commands = append(commands, cmd)
+		}
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i].Name < commands[j].Name
+	})
+	return commands
+}
+
+// Help describes the commands session may run, or just the one named.
+func (cs *CommandSet) Help(session *Session, name string) (string, error) {
+	if name != "" {
+		cmd, err := cs.Lookup(session, name)
+		if err != nil {
+			return "", err
+		}
+		text := "Usage: " + cmd.usage() + "\n" + cmd.Summary + "\n"
+		if len(cmd.Aliases) > 0 {
+			text += "Also typed as: " + strings.Join(cmd.Aliases, ", ") + "\n"
+		}
+		return text, nil
+	}
+
+	commands := cs.Commands(session)
+	width := 0
+	for _, cmd := range commands {
+		if len(cmd.usage()) > width {
+			width = len(cmd.usage())
+		}
+	}
+
+	// Everyone's commands first, then those of each role
+	sections := map[string][]string{}
+	for _, cmd := range commands {
+		line := fmt.Sprintf("  %-*s  %s", width, cmd.usage(), cmd.Summary)
+		if len(cmd.Aliases) > 0 {
+			line += " (" + strings.Join(cmd.Aliases, ", ") + ")"
+		}
+		sections[cmd.Role] = append(sections[cmd.Role], line)
+	}
+	roles := make([]string, 0, len(sections))
+	for role := range sections {
+		if role != "" {
+			roles = append(roles, role)
+		}
+	}
+	sort.Strings(roles)
+
+	text := "Commands, which may be shortened to any unique prefix:\n" + strings.Join(sections[""], "\n") + "\n"
+	for _, role := range roles {
+		text += "\nCommands for the " + role + " role:\n" + strings.Join(sections[role], "\n") + "\n"
+	}
+	return text, nil
+}
+
+// AliasStore keeps the aliases each player defined, by player ID, for the
+// lifetime of the process as MemoryPlayerStore keeps the players.
+type AliasStore struct {
+	mu      sync.Mutex
+	aliases map[uuid.UUID]map[string]string
+}
+
+func NewAliasStore() *AliasStore {
+	return &AliasStore{aliases: make(map[uuid.UUID]map[string]string)}
+}
+
+// Get returns the aliases of a player.
+func (as *AliasStore) Get(playerID uuid.UUID) map[string]string {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	aliases := make(map[string]string, len(as.aliases[playerID]))
+	for name, expansion := range as.aliases[playerID] {
+		aliases[name] = expansion
+	}
+	return aliases
+}
+
+// Set defines or replaces an alias of a player.
+func (as *AliasStore) Set(playerID uuid.UUID, name, expansion string) error {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	aliases := as.aliases[playerID]
+	if aliases == nil {
+		aliases = make(map[string]string)
+		as.aliases[playerID] = aliases
+	}
+	if _, ok := aliases[name]; !ok && len(aliases) >= MaxAliases {
+		return fmt.Errorf("no more than %d aliases", MaxAliases)
+	}
+	aliases[name] = expansion
+	return nil
+}
+
+// Remove deletes an alias of a player, reporting whether it existed.
+func (as *AliasStore) Remove(playerID uuid.UUID, name string) bool {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	_, ok := as.aliases[playerID][name]
+	delete(as.aliases[playerID], name)
+	return ok
+}
+
+// Expand replaces the first word of line with what it is an alias for.
+// Expansions are not expanded again.
+func (as *AliasStore) Expand(playerID uuid.UUID, line string) string {
+	verb, rest := splitWord(line)
+
+	as.mu.Lock()
+	expansion, ok := as.aliases[playerID][strings.ToLower(verb)]
+	as.mu.Unlock()
+
+	if !ok {
+		return line
+	}
+	if rest == "" {
+		return expansion
+	}
+	return expansion + " " + rest
+}
+
+// handleCommand runs a line typed by the player.
+func (s *Server) handleCommand(session *Session, body *CommandBody) error {
+	line := body.Line
+	if player := session.GetPlayer(); player != nil {
+		line = s.aliases.Expand(player.GetID(), line)
+	}
+
+	verb, rest := splitWord(line)
+	if verb == "" {
+		return nil
+	}
+	cmd, err := s.commands.Lookup(session, verb)
+	if err != nil {
+		return err
+	}
+	args, err := cmd.parseArgs(rest)
+	if err != nil {
+		return err
+	}
+	return cmd.Run(&CommandContext{server: s, session: session}, args)
+}
+
+// registerCommands registers the built-in commands and the COMMAND event
+// that runs them.
+func (s *Server) registerCommands() error {
+	move := func(direction string) func(*CommandContext, CommandArgs) error {
+		return func(ctx *CommandContext, args CommandArgs) error {
+			if err := ctx.Do(MoveEvent, MoveBody{Direction: direction}); err != nil {
+				return err
+			}
+			return ctx.Do(LookEvent, QueryBody{})
+		}
+	}
+	query := func(eventName string) func(*CommandContext, CommandArgs) error {
+		return func(ctx *CommandContext, args CommandArgs) error {
+			return ctx.Do(eventName, QueryBody{})
+		}
+	}
+
+	commands := []Command{
+		{Name: "look", Summary: "Describe where you are", Run: query(LookEvent)},
+		{Name: "north", Aliases: []string{"n"}, Summary: "Move one step north", Run: move("North")},
+		{Name: "east", Aliases: []string{"e"}, Summary: "Move one step east", Run: move("East")},
+		{Name: "south", Aliases: []string{"s"}, Summary: "Move one step south", Run: move("South")},
+		{Name: "west", Aliases: []string{"w"}, Summary: "Move one step west", Run: move("West")},
+		{Name: "who", Summary: "List the players online", Run: query(WhoEvent)},
+		{Name: "score", Summary: "Show your character", Run: query(ScoreEvent)},
+		{
+			Name: "say", Usage: "<message...>", Summary: "Talk to everyone on the map",
+			Run: func(ctx *CommandContext, args CommandArgs) error {
+				return ctx.Do(ChatEvent, ChatBody{Message: args["message"]})
+			},
+		},
+		{
+			Name: "tell", Usage: "<player> <message...>", Summary: "Talk to one player",
+			Run: func(ctx *CommandContext, args CommandArgs) error {
+				return ctx.Do(PrivateChatEvent, PrivateChatBody{To: args["player"], Message: args["message"]})
+			},
+		},
+		{
+			Name: "help", Usage: "[command]", Summary: "List the commands, or explain one",
+			Run: func(ctx *CommandContext, args CommandArgs) error {
+				text, err := s.commands.Help(ctx.session, args["command"])
+				if err != nil {
+					return err
+				}
+				return ctx.Reply(text)
+			},
+		},
+		{Name: "alias", Usage: "[name] [command...]", Summary: "List your aliases, or make name stand for a command", Run: s.runAlias},
+		{
+			Name: "unalias", Usage: "<name>", Summary: "Remove an alias",
+			Run: func(ctx *CommandContext, args CommandArgs) error {
+				player := ctx.session.GetPlayer()
+				if player == nil {
+					return &InvalidStateError{msg: "Not logged in"}
+				}
+				if !s.aliases.Remove(player.GetID(), strings.ToLower(args["name"])) {
+					return &NotFoundError{msg: "No alias " + args["name"]}
+				}
+				return ctx.Reply("Removed alias " + args["name"] + ".")
+			},
+		},
+		{
+			Name: "kick", Usage: "<player> [reason...]", Summary: "Disconnect a player", Role: AdminRole,
+			Run: func(ctx *CommandContext, args CommandArgs) error {
+				if err := ctx.Do(KickEvent, KickBody{Player: args["player"], Reason: args["reason"]}); err != nil {
+					return err
+				}
+				return ctx.Reply("Kicked " + args["player"] + ".")
+			},
+		},
+		{
+			Name: "announce", Usage: "<message...>", Summary: "Send a message to every player", Role: AdminRole,
+			Run: func(ctx *CommandContext, args CommandArgs) error {
+				return ctx.Do(AnnounceEvent, AnnounceBody{Message: args["message"]})
+			},
+		},
+	}
+
+	for _, cmd := range commands {
+		if err := s.commands.Register(cmd); err != nil {
+			return err
+		}
+	}
+	return s.RegisterTypedHandler(CommandEvent, s.handleCommand)
+}
+
+// runAlias lists the player's aliases, shows one or defines one.
+func (s *Server) runAlias(ctx *CommandContext, args CommandArgs) error {
+	player := ctx.session.GetPlayer()
+	if player == nil {
+		return &InvalidStateError{msg: "Not logged in"}
+	}
+	aliases := s.aliases.Get(player.GetID())
+	name, expansion := strings.ToLower(args["name"]), args["command"]
+
+	switch {
+	case name == "":
+		if len(aliases) == 0 {
+			return ctx.Reply("You have no aliases.")
+		}
+		names := make([]string, 0, len(aliases))
+		for alias := range aliases {
+			names = append(names, alias)
+		}
+		sort.Strings(names)
+		text := "Your aliases:\n"
+		for _, alias := range names {
+			text += "  " + alias + " = " + aliases[alias] + "\n"
+		}
+		return ctx.Reply(text)
+	case expansion == "":
+		if current, ok := aliases[name]; ok {
+			return ctx.Reply(name + " = " + current)
+		}
+		return &NotFoundError{msg: "No alias " + name}
+	case name == "alias" || name == "unalias":
+		return &PacketValidationError{msg: "alias and unalias cannot be redefined"}
+	case len(expansion) > MaxAliasLength:
+		return &PacketValidationError{msg: fmt.Sprintf("Aliases may be at most %d characters long", MaxAliasLength)}
+	}
+
+	if err := s.aliases.Set(player.GetID(), name, expansion); err != nil {
+		return &PacketValidationError{msg: "Cannot add alias: " + err.Error()}
+	}
+	return ctx.Reply(name + " = " + expansion)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUsage(t *testing.T) {
+	params, err := parseUsage("<player> [reason...]")
+	assert.NoError(t, err)
+	assert.Equal(t, []commandParam{{name: "player"}, {name: "reason", optional: true, rest: true}}, params)
+
+	for _, usage := range []string{"player", "<>", "<message...> <to>", "[to] <message>"} {
+		_, err := parseUsage(usage)
+		assert.Error(t, err, usage)
+	}
+}
+
+func TestCommandArgs(t *testing.T) {
+	cmd := &Command{Name: "tell", Usage: "<player> <message...>"}
+	cmd.params, _ = parseUsage(cmd.Usage)
+
+	args, err := cmd.parseArgs("  bob  hello   there ")
+	assert.NoError(t, err)
+	assert.Equal(t, CommandArgs{"player": "bob", "message": "hello   there"}, args)
+
+	var invalid *PacketValidationError
+	_, err = cmd.parseArgs("bob")
+	assert.True(t, errors.As(err, &invalid))
+	assert.Equal(t, "Usage: tell <player> <message...>", err.Error())
+
+	cmd = &Command{Name: "help", Usage: "[command]"}
+	cmd.params, _ = parseUsage(cmd.Usage)
+	args, err = cmd.parseArgs("")
+	assert.NoError(t, err)
+	assert.Empty(t, args)
+	_, err = cmd.parseArgs("say tell")
+	assert.Error(t, err, "too many arguments")
+}
+
+func TestCommandLookup(t *testing.T) {
+	cs := NewCommandSet()
+	run := func(*CommandContext, CommandArgs) error { return nil }
+	for _, cmd := range []Command{
+		{Name: "north", Aliases: []string{"n"}, Run: run},
+		{Name: "look", Aliases: []string{"l"}, Run: run},
+		{Name: "say", Run: run},
+		{Name: "score", Run: run},
+		{Name: "shutdown", Role: "admin", Run: run},
+	} {
+		assert.NoError(t, cs.Register(cmd))
+	}
+	assert.Error(t, cs.Register(Command{Name: "nod", Aliases: []string{"N"}, Run: run}), "alias taken")
+	assert.Error(t, cs.Register(Command{Name: "dance", Usage: "<how", Run: run}), "bad grammar")
+	assert.Error(t, cs.Register(Command{Name: "dance"}), "nothing to run")
+
+	session, _ := newTestSession(t)
+	session.claims = newTestClaims("acc", "Alice", "player")
+	for verb, want := range map[string]string{"n": "north", "NORTH": "north", "nor": "north", "l": "look", "lo": "look", "sa": "say", "sc": "score"} {
+		cmd, err := cs.Lookup(session, verb)
+		if assert.NoError(t, err, verb) {
+			assert.Equal(t, want, cmd.Name, verb)
+		}
+	}
+
+	// A prefix of several commands is ambiguous, while commands the player
+	// lacks the role for do not exist at all
+	_, err := cs.Lookup(session, "s")
+	assert.EqualError(t, err, "s could be any of: say, score")
+	var notFound *NotFoundError
+	_, err = cs.Lookup(session, "shutdown")
+	assert.True(t, errors.As(err, &notFound))
+	assert.Len(t, cs.Commands(session), 4)
+
+	session.claims = newTestClaims("acc", "Alice", "admin")
+	_, err = cs.Lookup(session, "s")
+	assert.EqualError(t, err, "s could be any of: say, score, shutdown")
+	cmd, err := cs.Lookup(session, "sh")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "shutdown", cmd.Name)
+	}
+	assert.Len(t, cs.Commands(session), 5)
+}
+
+func TestCommandHelp(t *testing.T) {
+	cs := NewCommandSet()
+	run := func(*CommandContext, CommandArgs) error { return nil }
+	cs.Register(Command{Name: "tell", Usage: "<player> <message...>", Summary: "Talk to one player", Run: run})
+	cs.Register(Command{Name: "north", Aliases: []string{"n"}, Summary: "Move one step north", Run: run})
+	cs.Register(Command{Name: "kick", Usage: "<player>", Summary: "Disconnect a player", Role: "admin", Run: run})
+
+	session, _ := newTestSession(t)
+	session.claims = newTestClaims("acc", "Alice")
+	text, err := cs.Help(session, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "Commands, which may be shortened to any unique prefix:\n"+
+		"  north"+strings.Repeat(" ", 21)+"  Move one step north (n)\n"+
+		"  tell <player> <message...>  Talk to one player\n", text)
+
+	text, err = cs.Help(session, "n")
+	assert.NoError(t, err)
+	assert.Equal(t, "Usage: north\nMove one step north\nAlso typed as: n\n", text)
+
+	session.claims = newTestClaims("acc", "Alice", "admin")
+	text, _ = cs.Help(session, "")
+	assert.Contains(t, text, "\nCommands for the admin role:\n  kick <player>")
+}
+
+func TestAliasStore(t *testing.T) {
+	as := NewAliasStore()
+	alice, bob := uuid.New(), uuid.New()
+
+	assert.NoError(t, as.Set(alice, "gg", "say good game"))
+	assert.Equal(t, "say good game everyone", as.Expand(alice, "GG everyone"))
+	assert.Equal(t, "gg everyone", as.Expand(bob, "gg everyone"))
+	assert.Equal(t, "say good game", as.Expand(alice, "gg"))
+
+	// Expansions are not expanded again
+	assert.NoError(t, as.Set(alice, "say", "gg"))
+	assert.Equal(t, "gg hi", as.Expand(alice, "say hi"))
+
+	assert.True(t, as.Remove(alice, "say"))
+	assert.False(t, as.Remove(alice, "say"))
+	assert.Equal(t, map[string]string{"gg": "say good game"}, as.Get(alice))
+
+	for i := 0; i < MaxAliases; i++ {
+		assert.NoError(t, as.Set(bob, strings.Repeat("x", i+1), "look"))
+	}
+	assert.Error(t, as.Set(bob, "one", "too many"))
+	assert.NoError(t, as.Set(bob, "x", "replacing is fine"))
+}
+
+func TestCommandEvent(t *testing.T) {
+	srv, addr := startTestServer(t)
+	aliceConn, alice := joinTestClient(t, srv, addr, "alice")
+	_, bob := joinTestClient(t, srv, addr, "bob")
+
+	command := func(line string) {
+		body, _ := json.Marshal(CommandBody{Line: line})
+		sendPacket(aliceConn, &Packet{EventName: CommandEvent, EventBody: body})
+	}
+
+	command("help")
+	packet, err := readEvent(alice, TextEvent)
+	if assert.NoError(t, err) {
+		var text TextMessage
+		assert.NoError(t, json.Unmarshal(packet.EventBody, &text))
+		assert.Contains(t, text.Text, "tell <player> <message...>")
+		assert.NotContains(t, text.Text, "kick")
+	}
+
+	// Commands run the handlers of the events they stand for
+	command("alias hi tell bob")
+	readEvent(alice, TextEvent)
+	command("hi hello")
+	packet, err = readEvent(bob, PrivateChatEvent)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `"alice,hello"`, string(packet.EventBody))
+	}
+
+	command("l")
+	_, err = readEvent(alice, LookEvent)
+	assert.NoError(t, err)
+
+	// Only the commands are counted, not the events they ran
+	assert.Eventually(t, func() bool {
+		stats, _ := srv.eventMetrics.Get(CommandEvent)
+		return stats.Count == 4
+	}, time.Second, 10*time.Millisecond)
+	for _, eventName := range []string{PrivateChatEvent, LookEvent} {
+		_, counted := srv.eventMetrics.Get(eventName)
+		assert.False(t, counted, eventName)
+	}
+
+	// Admin commands are unknown to players
+	command("kick bob")
+	packet, err = readEvent(alice, ErrorEvent)
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(mustField(t, packet.EventBody, "message")), "Unknown command kick")
+	}
+}
+
+func TestAdminCommands(t *testing.T) {
+	srv, addr := startTestServer(t)
+	rootConn, root := joinTestClient(t, srv, addr, "root", AdminRole)
+	_, bob := joinTestClient(t, srv, addr, "bob")
+
+	command := func(line string) {
+		body, _ := json.Marshal(CommandBody{Line: line})
+		sendPacket(rootConn, &Packet{EventName: CommandEvent, EventBody: body})
+	}
+
+	command("announce back in five")
+	packet, err := readEvent(bob, AnnounceEvent)
+	if assert.NoError(t, err) {
+		assert.JSONEq(t, `{"from":"root","message":"back in five"}`, string(packet.EventBody))
+	}
+
+	command("kick bob spamming")
+	packet, err = readEvent(bob, KickedEvent)
+	if assert.NoError(t, err) {
+		assert.JSONEq(t, `{"reason":"spamming"}`, string(packet.EventBody))
+	}
+	_, err = readEvent(root, TextEvent)
+	assert.NoError(t, err)
+
+	// A kicked session is released, not held for resumption
+	assert.Eventually(t, func() bool {
+		_, ok := srv.GetSessions().GetByAccount("bob")
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+	srv.mu.Lock()
+	assert.Empty(t, srv.parked)
+	srv.mu.Unlock()
+
+	// A player whose session is held for resumption leaves the world at once
+	carolConn, carolDecoder := dialResumable(t, addr, "carol")
+	readSessionNotice(t, carolDecoder)
+	carol, _ := srv.GetSessions().GetByAccount("carol")
+	player := carol.GetPlayer()
+	carolConn.Close()
+	assert.Eventually(t, func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return len(srv.parked) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	command("kick carol")
+	_, err = readEvent(root, TextEvent)
+	assert.NoError(t, err)
+	srv.mu.Lock()
+	assert.Empty(t, srv.parked)
+	srv.mu.Unlock()
+	_, ok := srv.GetSessions().GetByAccount("carol")
+	assert.False(t, ok)
+	assert.False(t, srv.world.StartMap().HasPlayer(player))
+}
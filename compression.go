@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+)
+
+const (
+	DefaultCompressionThreshold = 1024
+	DefaultMaxDecompressedSize  = 1024 * 1024
+
+	// frameCompressed is set in the length header of a frame whose payload
+	// is deflated. Validate keeps MaxFrameSize below it.
+	frameCompressed = 1 << 31
+)
+
+var ErrDecompressedTooLarge = errors.New("frame inflates beyond maximum size")
+
+// CompressionStats count the frames deflated or inflated in one direction,
+// and their payload sizes before (RawBytes) and after (WireBytes)
+// compression.
+type CompressionStats struct {
+	Frames    uint64
+	RawBytes  uint64
+	WireBytes uint64
+}
+
+// Ratio is the compressed size as a fraction of the raw size, or 1 before
+// any frame was compressed.
+func (s CompressionStats) Ratio() float64 {
+	if s.RawBytes == 0 {
+		return 1
+	}
+	return float64(s.WireBytes) / float64(s.RawBytes)
+}
+
+// CompressionMetrics collects CompressionStats for every connection of a
+// server.
+type CompressionMetrics struct {
+	mu       sync.Mutex
+	sent     CompressionStats
+	received CompressionStats
+	skipped  uint64 // frames over the threshold that did not shrink
+}
+
+func NewCompressionMetrics() *CompressionMetrics {
+	return &CompressionMetrics{}
+}
+
+func (m *CompressionMetrics) recordSent(raw, wire int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sent.Frames++
+	m.sent.RawBytes += uint64(raw)
+	m.sent.WireBytes += uint64(wire)
+}
+
+func (m *CompressionMetrics) recordSkipped() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.skipped++
+}
+
+func (m *CompressionMetrics) recordReceived(raw, wire int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.received.Frames++
+	m.received.RawBytes += uint64(raw)
+	m.received.WireBytes += uint64(wire)
+}
+
+// Sent returns the stats of frames the server compressed.
+func (m *CompressionMetrics) Sent() CompressionStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.sent
+}
+
+// Received returns the stats of compressed frames the server inflated.
+func (m *CompressionMetrics) Received() CompressionStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.received
+}
+
+// Skipped counts frames that were worth compressing by size but were sent
+// as they were because deflate did not make them smaller.
+func (m *CompressionMetrics) Skipped() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.skipped
+}
+
+// deflater compresses frame payloads, reusing its buffers. It belongs to a
+// single FrameWriter.
+type deflater struct {
+	threshold int
+	metrics   *CompressionMetrics
+	buf       bytes.Buffer
+	w         *flate.Writer
+}
+
+func newDeflater(threshold int, metrics *CompressionMetrics) *deflater {
+	w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+	return &deflater{threshold: threshold, metrics: metrics, w: w}
+}
+
+// compress returns the deflated payload, or false when payload is below the
+// threshold or does not shrink.
+func (d *deflater) compress(payload []byte) ([]byte, bool) {
+	if len(payload) < d.threshold {
+		return nil, false
+	}
+
+	d.buf.Reset()
+	d.w.Reset(&d.buf)
+	if _, err := d.w.Write(payload); err != nil {
+		return nil, false
+	}
+	if err := d.w.Close(); err != nil {
+		return nil, false
+	}
+	if d.buf.Len() >= len(payload) {
+		d.metrics.recordSkipped()
+		return nil, false
+	}
+
+	d.metrics.recordSent(len(payload), d.buf.Len())
+	return d.buf.Bytes(), true
+}
+
+// inflater decompresses frame payloads, refusing any that would inflate
+// beyond maxSize. It belongs to a single FrameReader.
+type inflater struct {
+	maxSize int
+	metrics *CompressionMetrics
+	r       io.ReadCloser
+}
+
+func newInflater(maxSize int, metrics *CompressionMetrics) *inflater {
+	return &inflater{maxSize: maxSize, metrics: metrics, r: flate.NewReader(nil)}
+}
+
+func (i *inflater) decompress(frame []byte) ([]byte, error) {
+	if err := i.r.(flate.Resetter).Reset(bytes.NewReader(frame), nil); err != nil {
+		return nil, err
+	}
+
+	// Read one byte past the cap to tell a payload of exactly maxSize from
+	// a bigger one, without inflating the rest of a bomb
+	payload, err := io.ReadAll(io.LimitReader(i.r, int64(i.maxSize)+1))
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if len(payload) > i.maxSize {
+		return nil, ErrDecompressedTooLarge
+	}
+
+	i.metrics.recordReceived(len(payload), len(frame))
+	return payload, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrameCompression(t *testing.T) {
+	metrics := NewCompressionMetrics()
+	large := bytes.Repeat([]byte(`{"tile":"grass"},`), 200)
+
+	var buf bytes.Buffer
+	writer := NewFrameWriter(&buf, LengthPrefixed, 0)
+	writer.EnableCompression(1024, metrics)
+	assert.NoError(t, writer.WriteFrame([]byte(`{"a":1}`)))
+	assert.NoError(t, writer.WriteFrame(large))
+
+	// Only the large frame is flagged and shrunk
+	wire := buf.Bytes()
+	assert.Equal(t, uint32(7), binary.BigEndian.Uint32(wire))
+	header := binary.BigEndian.Uint32(wire[frameHeaderSize+7:])
+	assert.NotZero(t, header&frameCompressed)
+	assert.Less(t, int(header&^frameCompressed), len(large))
+
+	reader := NewFrameReader(&buf, LengthPrefixed, 0)
+	reader.EnableCompression(DefaultMaxDecompressedSize, metrics)
+	frame, err := reader.ReadFrame()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":1}`, string(frame))
+	frame, err = reader.ReadFrame()
+	assert.NoError(t, err)
+	assert.Equal(t, large, frame)
+
+	sent := metrics.Sent()
+	assert.Equal(t, uint64(1), sent.Frames)
+	assert.Equal(t, uint64(len(large)), sent.RawBytes)
+	assert.Less(t, sent.Ratio(), 0.1)
+	assert.Equal(t, sent, metrics.Received())
+}
+
+func TestFrameCompressionSkipsIncompressible(t *testing.T) {
+	metrics := NewCompressionMetrics()
+	noise := make([]byte, 2048)
+	rand.Read(noise)
+
+	var buf bytes.Buffer
+	writer := NewFrameWriter(&buf, LengthPrefixed, 0)
+	writer.EnableCompression(1024, metrics)
+	assert.NoError(t, writer.WriteFrame(noise))
+
+	assert.Equal(t, uint32(len(noise)), binary.BigEndian.Uint32(buf.Bytes()))
+	assert.Equal(t, uint64(1), metrics.Skipped())
+	assert.Zero(t, metrics.Sent().Frames)
+	assert.Equal(t, 1.0, metrics.Sent().Ratio())
+}
+
+// compressedFrame deflates payload into a flagged length-prefixed frame.
+func compressedFrame(payload []byte) []byte {
+	var deflated bytes.Buffer
+	w, _ := flate.NewWriter(&deflated, flate.BestCompression)
+	w.Write(payload)
+	w.Close()
+
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+deflated.Len())
+	binary.BigEndian.PutUint32(frame, uint32(deflated.Len())|frameCompressed)
+	return append(frame, deflated.Bytes()...)
+}
+
+func TestFrameDecompressionLimit(t *testing.T) {
+	// Two megabytes of zeros deflate to a couple of kilobytes
+	bomb := compressedFrame(make([]byte, 2*1024*1024))
+	assert.Less(t, len(bomb), DefaultMaxFrameSize)
+
+	reader := NewFrameReader(bytes.NewReader(bomb), LengthPrefixed, 0)
+	reader.EnableCompression(DefaultMaxDecompressedSize, nil)
+	_, err := reader.ReadFrame()
+	assert.Equal(t, ErrDecompressedTooLarge, err)
+
+	// Exactly at the cap is fine
+	reader = NewFrameReader(bytes.NewReader(compressedFrame(make([]byte, 4096))), LengthPrefixed, 0)
+	reader.EnableCompression(4096, nil)
+	frame, err := reader.ReadFrame()
+	assert.NoError(t, err)
+	assert.Len(t, frame, 4096)
+
+	// Without negotiation the flag reads as an oversized frame
+	reader = NewFrameReader(bytes.NewReader(bomb), LengthPrefixed, 0)
+	_, err = reader.ReadFrame()
+	assert.Equal(t, ErrFrameTooLarge, err)
+
+	// A corrupt stream is an error, not a panic
+	corrupt := compressedFrame([]byte(strings.Repeat("x", 100)))
+	corrupt[frameHeaderSize] ^= 0xff
+	reader = NewFrameReader(bytes.NewReader(corrupt), LengthPrefixed, 0)
+	reader.EnableCompression(DefaultMaxDecompressedSize, nil)
+	_, err = reader.ReadFrame()
+	assert.Error(t, err)
+}
+
+func TestCompressedSession(t *testing.T) {
+	srv, addr := startTestServer(t)
+
+	conn, decoder := dialHello(t, addr, HelloRequest{
+		ProtocolVersion: ProtocolVersion,
+		Features:        []string{FeatureCompression},
+		Token:           testToken(t, "alice"),
+	})
+	packet, err := decoder.Decode()
+	if assert.NoError(t, err) {
+		assert.JSONEq(t, `["compression"]`, string(mustField(t, packet.EventBody, "features")))
+	}
+	decoder.EnableCompression(DefaultMaxDecompressedSize, nil)
+	_, err = readEvent(decoder, SpawnPlayerEvent)
+	assert.NoError(t, err)
+
+	// Large packets from the server arrive deflated
+	session, _ := srv.GetSessions().GetByAccount("alice")
+	snapshot := strings.Repeat("grass,", 1000)
+	session.Send("SNAPSHOT", snapshot)
+	reply, err := readEvent(decoder, "SNAPSHOT")
+	if assert.NoError(t, err) {
+		assert.Equal(t, `"`+snapshot+`"`, string(reply.EventBody))
+	}
+	assert.Equal(t, uint64(1), srv.GetCompressionMetrics().Sent().Frames)
+
+	// and the client may deflate its own
+	encoder := NewPacketEncoder(conn, LengthPrefixed, DefaultMaxFrameSize)
+	encoder.EnableCompression(64, nil)
+	body, _ := json.Marshal(strings.Repeat("north,", 1000))
+	encoder.Encode(&Packet{EventName: "NOT_AN_EVENT", EventBody: body})
+	reply, err = readEvent(decoder, ErrorEvent)
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(reply.EventBody), "NOT_AN_EVENT")
+	}
+	assert.Equal(t, uint64(1), srv.GetCompressionMetrics().Received().Frames)
+}
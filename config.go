@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DefaultJWTSecret       = "your_jwt_secret"
+	DefaultShutdownMessage = "Server is shutting down"
+)
+
+// Duration is a time.Duration written as a Go duration string ("20s", "5m")
+// in config files.
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	value, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(value)
+	return nil
+}
+
+type JWTConfig struct {
+	Secret     string   `json:"secret" yaml:"secret"`
+	Algorithms []string `json:"algorithms" yaml:"algorithms"`
+	KeyFile    string   `json:"key_file" yaml:"key_file"`
+	Issuer     string   `json:"issuer" yaml:"issuer"`
+	Audience   string   `json:"audience" yaml:"audience"`
+}
+
+// TLSConfig serves TLS instead of plain TCP when CertFile and KeyFile are
+// set. The files are reloaded when they change, checked every
+// ReloadInterval, and on SIGHUP.
+type TLSConfig struct {
+	CertFile       string           `json:"cert_file" yaml:"cert_file"`
+	KeyFile        string           `json:"key_file" yaml:"key_file"`
+	MinVersion     TLSVersion       `json:"min_version" yaml:"min_version"`
+	ClientCAFile   string           `json:"client_ca_file" yaml:"client_ca_file"`
+	ClientAuth     ClientAuthPolicy `json:"client_auth" yaml:"client_auth"`
+	ReloadInterval Duration         `json:"reload_interval" yaml:"reload_interval"`
+}
+
+// Enabled reports whether the server should listen with TLS.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+// WebSocketConfig runs the WebSocket gateway when Address is set.
+// AllowedOrigins restricts which web pages may connect; empty allows any.
+type WebSocketConfig struct {
+	Address        string   `json:"address" yaml:"address"`
+	Path           string   `json:"path" yaml:"path"`
+	AllowedOrigins []string `json:"allowed_origins" yaml:"allowed_origins"`
+}
+
+// TelnetConfig runs the telnet gateway when Address is set. IdleTimeout
+// replaces the server-wide one for telnet players, who are people at a
+// keyboard rather than clients sending packets on their own.
+type TelnetConfig struct {
+	Address     string   `json:"address" yaml:"address"`
+	IdleTimeout Duration `json:"idle_timeout" yaml:"idle_timeout"`
+}
+
+// MetricsConfig serves the Prometheus metrics endpoint when Address is set.
+type MetricsConfig struct {
+	Address string `json:"address" yaml:"address"`
+	Path    string `json:"path" yaml:"path"`
+}
+
+// Config is everything the server can be tuned with. It is built from
+// DefaultConfig, then a JSON or YAML file, then environment variables, and
+// validated before a Server is created from it.
+type Config struct {
+	ServerAddress   string   `json:"server_address" yaml:"server_address"`
+	ConnTimeout     Duration `json:"conn_timeout" yaml:"conn_timeout"`
+	KeepAlivePeriod Duration `json:"keep_alive_period" yaml:"keep_alive_period"`
+
+	// IdleTimeout disconnects a client that sent nothing for that long, and
+	// PingInterval is how often the server pings each client. Zero disables
+	// either.
+	IdleTimeout  Duration `json:"idle_timeout" yaml:"idle_timeout"`
+	PingInterval Duration `json:"ping_interval" yaml:"ping_interval"`
+
+	// ShutdownTimeout is how long clients get to disconnect after the
+	// SERVER_SHUTDOWN notice before they are closed by force
+	ShutdownTimeout Duration `json:"shutdown_timeout" yaml:"shutdown_timeout"`
+	ShutdownMessage string   `json:"shutdown_message" yaml:"shutdown_message"`
+
+	FrameMode    FrameMode `json:"frame_mode" yaml:"frame_mode"`
+	MaxFrameSize int       `json:"max_frame_size" yaml:"max_frame_size"`
+	// CompressionThreshold is the payload size from which frames sent to
+	// clients that negotiated compression are deflated. Zero disables
+	// compression.
+	CompressionThreshold int `json:"compression_threshold" yaml:"compression_threshold"`
+	// MaxDecompressedSize caps the size a compressed frame may inflate to
+	MaxDecompressedSize int `json:"max_decompressed_size" yaml:"max_decompressed_size"`
+
+	// InboundQueueSize is how many packets a session may have waiting for its
+	// handlers before the server stops reading from the client
+	InboundQueueSize int `json:"inbound_queue_size" yaml:"inbound_queue_size"`
+	// DedupWindow is how many recent request IDs each session remembers to
+	// recognise retried packets. Zero disables de-duplication.
+	DedupWindow int `json:"dedup_window" yaml:"dedup_window"`
+	// MaxPanics disconnects a session after its packets made handlers panic
+	// that many times. Zero never disconnects.
+	MaxPanics int `json:"max_panics" yaml:"max_panics"`
+
+	// ResumeGracePeriod is how long the player of a dropped connection stays
+	// in the world waiting for the client to resume. Zero disables resuming.
+	ResumeGracePeriod Duration `json:"resume_grace_period" yaml:"resume_grace_period"`
+	// ReplayBufferSize is how many sent events each session keeps to replay
+	// to a resuming client
+	ReplayBufferSize int `json:"replay_buffer_size" yaml:"replay_buffer_size"`
+
+	// MaxMoveDistance is how many tiles a single MOVE may cover, and
+	// TileSize how many world units the positions of legacy MOVE bodies count
+	// per tile
+	MaxMoveDistance int `json:"max_move_distance" yaml:"max_move_distance"`
+	TileSize        int `json:"tile_size" yaml:"tile_size"`
+
+	LoginPolicy LoginPolicy     `json:"login_policy" yaml:"login_policy"`
+	JWT         JWTConfig       `json:"jwt" yaml:"jwt"`
+	TLS         TLSConfig       `json:"tls" yaml:"tls"`
+	WebSocket   WebSocketConfig `json:"websocket" yaml:"websocket"`
+	Telnet      TelnetConfig    `json:"telnet" yaml:"telnet"`
+	Metrics     MetricsConfig   `json:"metrics" yaml:"metrics"`
+	RateLimit   RateLimitConfig `json:"rate_limit" yaml:"rate_limit"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		ServerAddress:        ":8080",
+		ConnTimeout:          Duration(20 * time.Second),
+		KeepAlivePeriod:      Duration(5 * time.Minute),
+		IdleTimeout:          Duration(DefaultIdleTimeout),
+		PingInterval:         Duration(DefaultPingInterval),
+		ShutdownTimeout:      Duration(10 * time.Second),
+		ShutdownMessage:      DefaultShutdownMessage,
+		FrameMode:            LengthPrefixed,
+		MaxFrameSize:         DefaultMaxFrameSize,
+		CompressionThreshold: DefaultCompressionThreshold,
+		MaxDecompressedSize:  DefaultMaxDecompressedSize,
+		InboundQueueSize:     DefaultInboundQueueSize,
+		DedupWindow:          DefaultDedupWindow,
+		MaxPanics:            DefaultMaxPanics,
+		ResumeGracePeriod:    Duration(DefaultResumeGracePeriod),
+		ReplayBufferSize:     DefaultReplayBufferSize,
+		MaxMoveDistance:      DefaultMaxMoveDistance,
+		TileSize:             DefaultTileSize,
+		LoginPolicy:          LoginReject,
+		JWT: JWTConfig{
+			Secret:     DefaultJWTSecret,
+			Algorithms: []string{"HS256"},
+		},
+		TLS: TLSConfig{
+			MinVersion:     TLSVersion(tls.VersionTLS12),
+			ReloadInterval: Duration(DefaultTLSReloadInterval),
+		},
+		WebSocket: WebSocketConfig{
+			Path: DefaultWebSocketPath,
+		},
+		Telnet: TelnetConfig{
+			IdleTimeout: Duration(DefaultTelnetIdleTimeout),
+		},
+		Metrics: MetricsConfig{
+			Path: DefaultMetricsPath,
+		},
+		RateLimit: DefaultRateLimitConfig(),
+	}
+}
+
+// ConfigError lists every problem found while loading or validating a Config.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid config: " + strings.Join(e.Problems, "; ")
+}
+
+func (e *ConfigError) add(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+// LoadConfig builds the effective configuration. path may be empty, in which
+// case only defaults and environment variables apply.
+func LoadConfig(path string) (*Config, error) {
+	config := DefaultConfig()
+
+	if path != "" {
+		if err := config.LoadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := config.ApplyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// LoadFile merges a JSON or YAML file, chosen by extension, over the current
+// values. Unknown keys are errors so typos do not go unnoticed.
+func (c *Config) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(c)
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(c)
+	default:
+		return fmt.Errorf("%s: unsupported config format, use .json, .yaml or .yml", path)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// ApplyEnv overrides values from environment variables. Durations accept Go
+// duration strings; bare integers keep their historical units (seconds for
+// CONN_TIMEOUT and SHUTDOWN_TIMEOUT, minutes for KEEP_ALIVE_PERIOD).
+func (c *Config) ApplyEnv(lookup func(string) (string, bool)) error {
+	problems := &ConfigError{}
+
+	str := func(key string, target *string) {
+		if value, ok := lookup(key); ok && value != "" {
+			*target = value
+		}
+	}
+	integer := func(key string, target *int) {
+		if value, ok := lookup(key); ok && value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				problems.add("%s: %q is not an integer", key, value)
+				return
+			}
+			*target = parsed
+		}
+	}
+	duration := func(key string, unit time.Duration, target *Duration) {
+		if value, ok := lookup(key); ok && value != "" {
+			if n, err := strconv.Atoi(value); err == nil {
+				*target = Duration(time.Duration(n) * unit)
+				return
+			}
+			parsed, err := time.ParseDuration(value)
+			if err != nil {
+				problems.add("%s: %q is not a duration", key, value)
+				return
+			}
+			*target = Duration(parsed)
+		}
+	}
+	text := func(key string, target interface{ UnmarshalText([]byte) error }) {
+		if value, ok := lookup(key); ok && value != "" {
+			if err := target.UnmarshalText([]byte(value)); err != nil {
+				problems.add("%s: %v", key, err)
+			}
+		}
+	}
+
+	str("SERVER_ADDRESS", &c.ServerAddress)
+	duration("CONN_TIMEOUT", time.Second, &c.ConnTimeout)
+	duration("KEEP_ALIVE_PERIOD", time.Minute, &c.KeepAlivePeriod)
+	duration("IDLE_TIMEOUT", time.Second, &c.IdleTimeout)
+	duration("PING_INTERVAL", time.Second, &c.PingInterval)
+	duration("SHUTDOWN_TIMEOUT", time.Second, &c.ShutdownTimeout)
+	str("SHUTDOWN_MESSAGE", &c.ShutdownMessage)
+	text("FRAME_MODE", &c.FrameMode)
+	integer("MAX_FRAME_SIZE", &c.MaxFrameSize)
+	integer("COMPRESSION_THRESHOLD", &c.CompressionThreshold)
+	integer("MAX_DECOMPRESSED_SIZE", &c.MaxDecompressedSize)
+	integer("INBOUND_QUEUE_SIZE", &c.InboundQueueSize)
+	integer("DEDUP_WINDOW", &c.DedupWindow)
+	integer("MAX_PANICS", &c.MaxPanics)
+	duration("RESUME_GRACE_PERIOD", time.Second, &c.ResumeGracePeriod)
+	integer("REPLAY_BUFFER_SIZE", &c.ReplayBufferSize)
+	integer("MAX_MOVE_DISTANCE", &c.MaxMoveDistance)
+	integer("TILE_SIZE", &c.TileSize)
+	text("LOGIN_POLICY", &c.LoginPolicy)
+
+	str("JWT_SECRET", &c.JWT.Secret)
+	str("JWT_KEY_FILE", &c.JWT.KeyFile)
+	str("JWT_ISSUER", &c.JWT.Issuer)
+	str("JWT_AUDIENCE", &c.JWT.Audience)
+	if value, ok := lookup("JWT_ALGORITHMS"); ok && value != "" {
+		c.JWT.Algorithms = strings.Split(value, ",")
+	}
+
+	str("TLS_CERT_FILE", &c.TLS.CertFile)
+	str("TLS_KEY_FILE", &c.TLS.KeyFile)
+	text("TLS_MIN_VERSION", &c.TLS.MinVersion)
+	str("TLS_CLIENT_CA_FILE", &c.TLS.ClientCAFile)
+	text("TLS_CLIENT_AUTH", &c.TLS.ClientAuth)
+	duration("TLS_RELOAD_INTERVAL", time.Second, &c.TLS.ReloadInterval)
+
+	str("WEBSOCKET_ADDRESS", &c.WebSocket.Address)
+	str("WEBSOCKET_PATH", &c.WebSocket.Path)
+	if value, ok := lookup("WEBSOCKET_ALLOWED_ORIGINS"); ok && value != "" {
+		c.WebSocket.AllowedOrigins = strings.Split(value, ",")
+	}
+
+	str("TELNET_ADDRESS", &c.Telnet.Address)
+	duration("TELNET_IDLE_TIMEOUT", time.Second, &c.Telnet.IdleTimeout)
+
+	str("METRICS_ADDRESS", &c.Metrics.Address)
+	str("METRICS_PATH", &c.Metrics.Path)
+
+	integer("MAX_CONNECTIONS_PER_SEC", &c.RateLimit.ConnectionsPerSec)
+	integer("MAX_CONNECTIONS_PER_IP", &c.RateLimit.ConnectionsPerIP)
+	integer("MAX_PACKETS_PER_SEC", &c.RateLimit.PacketsPerSec)
+	integer("MAX_PACKET_BURST", &c.RateLimit.PacketBurst)
+	integer("MAX_BYTES_PER_SEC", &c.RateLimit.BytesPerSec)
+	text("RATE_LIMIT_PENALTY", &c.RateLimit.Penalty)
+	integer("RATE_LIMIT_MAX_VIOLATIONS", &c.RateLimit.MaxViolations)
+	duration("RATE_LIMIT_VIOLATION_WINDOW", time.Second, &c.RateLimit.ViolationWindow)
+
+	if len(problems.Problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// Validate checks ranges and cross-field constraints, normalising the JWT
+// algorithm list and defaulting unset token bucket bursts.
+func (c *Config) Validate() error {
+	problems := &ConfigError{}
+
+	if c.ServerAddress == "" {
+		problems.add("server_address must be set")
+	}
+	if c.ConnTimeout <= 0 {
+		problems.add("conn_timeout must be positive")
+	}
+	if c.KeepAlivePeriod <= 0 {
+		problems.add("keep_alive_period must be positive")
+	}
+	if c.IdleTimeout < 0 {
+		problems.add("idle_timeout must not be negative")
+	}
+	if c.PingInterval < 0 {
+		problems.add("ping_interval must not be negative")
+	}
+	if c.IdleTimeout > 0 && c.PingInterval >= c.IdleTimeout {
+		problems.add("ping_interval must be shorter than idle_timeout")
+	}
+	if c.ShutdownTimeout <= 0 {
+		problems.add("shutdown_timeout must be positive")
+	}
+	if c.MaxFrameSize <= 0 {
+		problems.add("max_frame_size must be positive")
+	}
+	// The top bit of the length header flags compressed frames
+	if int64(c.MaxFrameSize) >= frameCompressed {
+		problems.add("max_frame_size must be less than %d", int64(frameCompressed))
+	}
+	if c.CompressionThreshold < 0 {
+		problems.add("compression_threshold must not be negative")
+	}
+	if c.MaxDecompressedSize < c.MaxFrameSize {
+		problems.add("max_decompressed_size must be at least max_frame_size")
+	}
+	if c.InboundQueueSize <= 0 {
+		problems.add("inbound_queue_size must be positive")
+	}
+	if c.DedupWindow < 0 {
+		problems.add("dedup_window must not be negative")
+	}
+	if c.MaxPanics < 0 {
+		problems.add("max_panics must not be negative")
+	}
+	if c.ResumeGracePeriod < 0 {
+		problems.add("resume_grace_period must not be negative")
+	}
+	if c.ReplayBufferSize < 0 {
+		problems.add("replay_buffer_size must not be negative")
+	}
+	if c.MaxMoveDistance <= 0 {
+		problems.add("max_move_distance must be positive")
+	}
+	if c.TileSize <= 0 {
+		problems.add("tile_size must be positive")
+	}
+
+	algorithms, err := ParseAlgorithms(strings.Join(c.JWT.Algorithms, ","))
+	if err != nil {
+		problems.add("jwt.algorithms: %v", err)
+	}
+	c.JWT.Algorithms = algorithms
+
+	usesHMAC := false
+	for _, alg := range algorithms {
+		if strings.HasPrefix(alg, "HS") {
+			usesHMAC = true
+		}
+	}
+	if usesHMAC && c.JWT.Secret == "" {
+		problems.add("jwt.secret must be set when an HS algorithm is accepted")
+	}
+	if !usesHMAC && len(algorithms) > 0 && c.JWT.KeyFile == "" {
+		problems.add("jwt.key_file must be set for %s", strings.Join(algorithms, ","))
+	}
+
+	if c.TLS.Enabled() && (c.TLS.CertFile == "" || c.TLS.KeyFile == "") {
+		problems.add("tls.cert_file and tls.key_file must be set together")
+	}
+	if !c.TLS.Enabled() && (c.TLS.ClientCAFile != "" || c.TLS.ClientAuth != ClientAuthNone) {
+		problems.add("tls.client_ca_file and tls.client_auth need tls.cert_file and tls.key_file")
+	}
+	if c.TLS.ClientAuth != ClientAuthNone && c.TLS.ClientCAFile == "" {
+		problems.add("tls.client_ca_file must be set when tls.client_auth is %s", c.TLS.ClientAuth)
+	}
+	if c.TLS.ReloadInterval < 0 {
+		problems.add("tls.reload_interval must not be negative")
+	}
+
+	if !strings.HasPrefix(c.WebSocket.Path, "/") {
+		problems.add("websocket.path must start with /")
+	}
+	if c.Telnet.IdleTimeout < 0 {
+		problems.add("telnet.idle_timeout must not be negative")
+	}
+	if !strings.HasPrefix(c.Metrics.Path, "/") {
+		problems.add("metrics.path must start with /")
+	}
+
+	limits := &c.RateLimit
+	for _, field := range []struct {
+		name  string
+		value int
+	}{
+		{"rate_limit.packets_per_sec", limits.PacketsPerSec},
+		{"rate_limit.packet_burst", limits.PacketBurst},
+		{"rate_limit.bytes_per_sec", limits.BytesPerSec},
+		{"rate_limit.bytes_burst", limits.BytesBurst},
+		{"rate_limit.max_violations", limits.MaxViolations},
+		{"rate_limit.connections_per_sec", limits.ConnectionsPerSec},
+		{"rate_limit.connections_per_ip", limits.ConnectionsPerIP},
+	} {
+		if field.value < 0 {
+			problems.add("%s must not be negative", field.name)
+		}
+	}
+	if limits.ViolationWindow < 0 {
+		problems.add("rate_limit.violation_window must not be negative")
+	}
+	if limits.PacketBurst == 0 {
+		limits.PacketBurst = limits.PacketsPerSec
+	}
+	if limits.BytesBurst == 0 {
+		limits.BytesBurst = c.MaxFrameSize
+	}
+
+	if len(problems.Problems) > 0 {
+		return problems
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func lookupFrom(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+}
+
+func TestDefaultConfigIsValid(t *testing.T) {
+	config := DefaultConfig()
+	assert.NoError(t, config.Validate())
+	assert.Equal(t, ":8080", config.ServerAddress)
+	assert.Equal(t, LengthPrefixed, config.FrameMode)
+	assert.Equal(t, []string{"HS256"}, config.JWT.Algorithms)
+}
+
+func TestConfigLoadJSON(t *testing.T) {
+	path := writeTestFile(t, "config.json", []byte(`{
+		"server_address": ":9000",
+		"conn_timeout": "5s",
+		"frame_mode": "newline",
+		"login_policy": "kick",
+		"jwt": {"secret": "s3cret"},
+		"rate_limit": {"packets_per_sec": 50, "penalty": "delay"}
+	}`))
+
+	config := DefaultConfig()
+	assert.NoError(t, config.LoadFile(path))
+	assert.Equal(t, ":9000", config.ServerAddress)
+	assert.Equal(t, Duration(5*time.Second), config.ConnTimeout)
+	assert.Equal(t, NewlineDelimited, config.FrameMode)
+	assert.Equal(t, LoginKickOld, config.LoginPolicy)
+	assert.Equal(t, "s3cret", config.JWT.Secret)
+	assert.Equal(t, 50, config.RateLimit.PacketsPerSec)
+	assert.Equal(t, PenaltyDelay, config.RateLimit.Penalty)
+
+	// Values missing from the file keep their defaults
+	assert.Equal(t, Duration(5*time.Minute), config.KeepAlivePeriod)
+	assert.Equal(t, MaxConnectionsPerIP, config.RateLimit.ConnectionsPerIP)
+}
+
+func TestConfigLoadYAML(t *testing.T) {
+	path := writeTestFile(t, "config.yaml", []byte(`
+server_address: ":9001"
+keep_alive_period: 1m
+jwt:
+  algorithms: [HS256, HS512]
+rate_limit:
+  max_violations: 3
+`))
+
+	config := DefaultConfig()
+	assert.NoError(t, config.LoadFile(path))
+	assert.Equal(t, ":9001", config.ServerAddress)
+	assert.Equal(t, Duration(time.Minute), config.KeepAlivePeriod)
+	assert.Equal(t, []string{"HS256", "HS512"}, config.JWT.Algorithms)
+	assert.Equal(t, 3, config.RateLimit.MaxViolations)
+}
+
+func TestConfigLoadFileErrors(t *testing.T) {
+	jsonPath := writeTestFile(t, "typo.json", []byte(`{"server_adress": ":9000"}`))
+	assert.Error(t, DefaultConfig().LoadFile(jsonPath))
+
+	yamlPath := writeTestFile(t, "typo.yaml", []byte("server_adress: \":9000\"\n"))
+	assert.Error(t, DefaultConfig().LoadFile(yamlPath))
+
+	badValue := writeTestFile(t, "bad.json", []byte(`{"frame_mode": "carrier-pigeon"}`))
+	assert.Error(t, DefaultConfig().LoadFile(badValue))
+
+	tomlPath := writeTestFile(t, "config.toml", []byte(""))
+	assert.Error(t, DefaultConfig().LoadFile(tomlPath))
+}
+
+func TestConfigApplyEnv(t *testing.T) {
+	config := DefaultConfig()
+	err := config.ApplyEnv(lookupFrom(map[string]string{
+		"SERVER_ADDRESS":              "localhost:9090",
+		"CONN_TIMEOUT":                "30",
+		"KEEP_ALIVE_PERIOD":           "90s",
+		"IDLE_TIMEOUT":                "45",
+		"PING_INTERVAL":               "15s",
+		"INBOUND_QUEUE_SIZE":          "8",
+		"DEDUP_WINDOW":                "16",
+		"MAX_PANICS":                  "5",
+		"MAX_MOVE_DISTANCE":           "3",
+		"TILE_SIZE":                   "50",
+		"SHUTDOWN_TIMEOUT":            "3",
+		"FRAME_MODE":                  "ndjson",
+		"JWT_ALGORITHMS":              "HS256,HS384",
+		"MAX_PACKETS_PER_SEC":         "7",
+		"RATE_LIMIT_PENALTY":          "warn",
+		"RATE_LIMIT_VIOLATION_WINDOW": "30",
+		"TLS_MIN_VERSION":             "1.3",
+		"TLS_CLIENT_AUTH":             "optional",
+		"TELNET_ADDRESS":              ":4000",
+		"TELNET_IDLE_TIMEOUT":         "600",
+		"METRICS_ADDRESS":             ":9100",
+	}))
+	assert.NoError(t, err)
+
+	assert.Equal(t, "localhost:9090", config.ServerAddress)
+	assert.Equal(t, Duration(30*time.Second), config.ConnTimeout)
+	assert.Equal(t, Duration(90*time.Second), config.KeepAlivePeriod)
+	assert.Equal(t, Duration(45*time.Second), config.IdleTimeout)
+	assert.Equal(t, Duration(15*time.Second), config.PingInterval)
+	assert.Equal(t, Duration(3*time.Second), config.ShutdownTimeout)
+	assert.Equal(t, 8, config.InboundQueueSize)
+	assert.Equal(t, 16, config.DedupWindow)
+	assert.Equal(t, 5, config.MaxPanics)
+	assert.Equal(t, 3, config.MaxMoveDistance)
+	assert.Equal(t, 50, config.TileSize)
+	assert.Equal(t, NewlineDelimited, config.FrameMode)
+	assert.Equal(t, []string{"HS256", "HS384"}, config.JWT.Algorithms)
+	assert.Equal(t, 7, config.RateLimit.PacketsPerSec)
+	assert.Equal(t, PenaltyWarn, config.RateLimit.Penalty)
+	assert.Equal(t, Duration(30*time.Second), config.RateLimit.ViolationWindow)
+	assert.Equal(t, TLSVersion(tls.VersionTLS13), config.TLS.MinVersion)
+	assert.Equal(t, ClientAuthOptional, config.TLS.ClientAuth)
+	assert.Equal(t, ":4000", config.Telnet.Address)
+	assert.Equal(t, Duration(10*time.Minute), config.Telnet.IdleTimeout)
+	assert.Equal(t, ":9100", config.Metrics.Address)
+	assert.Equal(t, DefaultMetricsPath, config.Metrics.Path)
+
+	// The packet burst follows the rate unless it is set as well
+	config = DefaultConfig()
+	assert.NoError(t, config.ApplyEnv(lookupFrom(map[string]string{"MAX_PACKETS_PER_SEC": "50"})))
+	assert.NoError(t, config.Validate())
+	assert.Equal(t, 50, config.RateLimit.PacketBurst)
+
+	config = DefaultConfig()
+	assert.NoError(t, config.ApplyEnv(lookupFrom(map[string]string{"MAX_PACKETS_PER_SEC": "50", "MAX_PACKET_BURST": "100"})))
+	assert.NoError(t, config.Validate())
+	assert.Equal(t, 100, config.RateLimit.PacketBurst)
+}
+
+func TestConfigApplyEnvErrors(t *testing.T) {
+	err := DefaultConfig().ApplyEnv(lookupFrom(map[string]string{
+		"MAX_FRAME_SIZE": "big",
+		"CONN_TIMEOUT":   "soon",
+		"LOGIN_POLICY":   "maybe",
+	}))
+
+	configErr, ok := err.(*ConfigError)
+	if assert.True(t, ok, "expected a *ConfigError, got %v", err) {
+		assert.Len(t, configErr.Problems, 3)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	config := DefaultConfig()
+	config.ServerAddress = ""
+	config.MaxFrameSize = 0
+	config.JWT.Algorithms = []string{"none"}
+	config.RateLimit.PacketsPerSec = -1
+
+	err := config.Validate()
+	configErr, ok := err.(*ConfigError)
+	if assert.True(t, ok, "expected a *ConfigError, got %v", err) {
+		assert.Len(t, configErr.Problems, 4)
+	}
+
+	config = DefaultConfig()
+	config.PingInterval = config.IdleTimeout
+	assert.Error(t, config.Validate(), "pings must come before the idle timeout")
+
+	config = DefaultConfig()
+	config.MaxDecompressedSize = config.MaxFrameSize - 1
+	assert.Error(t, config.Validate(), "compressed frames must be able to inflate to a full frame")
+
+	config = DefaultConfig()
+	config.MaxFrameSize = frameCompressed
+	config.MaxDecompressedSize = frameCompressed
+	assert.Error(t, config.Validate(), "frame sizes must leave the compression flag free")
+
+	config = DefaultConfig()
+	config.MaxMoveDistance = 0
+	assert.Error(t, config.Validate(), "players must be able to move")
+
+	config = DefaultConfig()
+	config.TileSize = 0
+	assert.Error(t, config.Validate(), "world positions must map to tiles")
+
+	config = DefaultConfig()
+	config.WebSocket.Path = "ws"
+	assert.Error(t, config.Validate(), "websocket paths are absolute")
+
+	config = DefaultConfig()
+	config.RateLimit.ViolationWindow = Duration(-time.Second)
+	assert.Error(t, config.Validate())
+
+	config = DefaultConfig()
+	config.Telnet.IdleTimeout = Duration(-time.Second)
+	assert.Error(t, config.Validate())
+
+	config = DefaultConfig()
+	config.Metrics.Path = "metrics"
+	assert.Error(t, config.Validate(), "metrics paths are absolute")
+
+	config = DefaultConfig()
+	config.TLS.CertFile = "server.crt"
+	assert.Error(t, config.Validate(), "a certificate needs its key")
+
+	config = DefaultConfig()
+	config.TLS.CertFile, config.TLS.KeyFile = "server.crt", "server.key"
+	config.TLS.ClientAuth = ClientAuthRequire
+	assert.Error(t, config.Validate(), "client certificates need a CA to verify them")
+
+	config = DefaultConfig()
+	config.TLS.ClientCAFile = "clients.crt"
+	assert.Error(t, config.Validate(), "client CAs need TLS")
+
+	config = DefaultConfig()
+	config.JWT.Algorithms = []string{"RS256"}
+	assert.Error(t, config.Validate(), "asymmetric algorithms need a key file")
+
+	config = DefaultConfig()
+	config.RateLimit.PacketBurst = 0
+	config.RateLimit.BytesBurst = 0
+	assert.NoError(t, config.Validate())
+	assert.Equal(t, config.RateLimit.PacketsPerSec, config.RateLimit.PacketBurst)
+	assert.Equal(t, config.MaxFrameSize, config.RateLimit.BytesBurst)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+const ErrorEvent = "ERROR"
+
+// ErrorCode identifies the kind of failure reported in an ERROR event, so
+// clients can react without parsing the message.
+type ErrorCode string
+
+const (
+	ErrCodeInvalidPacket ErrorCode = "INVALID_PACKET"
+	ErrCodeUnauthorized  ErrorCode = "UNAUTHORIZED"
+	ErrCodeRateLimited   ErrorCode = "RATE_LIMITED"
+	ErrCodeNotFound      ErrorCode = "NOT_FOUND"
+	ErrCodeInvalidState  ErrorCode = "INVALID_STATE"
+	ErrCodeVersion       ErrorCode = "UNSUPPORTED_VERSION"
+	ErrCodeInternal      ErrorCode = "INTERNAL_ERROR"
+)
+
+// ProtocolError is an error that is safe to report to the client as is.
+// Handlers return one of the typed errors below; anything else is logged and
+// reported as INTERNAL_ERROR without its message.
+type ProtocolError interface {
+	error
+	Code() ErrorCode
+}
+
+// PacketValidationError reports a malformed packet or event body
+type PacketValidationError struct {
+	msg string
+}
+
+func (e *PacketValidationError) Error() string {
+	return e.msg
+}
+
+func (e *PacketValidationError) Code() ErrorCode {
+	return ErrCodeInvalidPacket
+}
+
+// UnauthorizedError reports an action the session's roles do not allow
+type UnauthorizedError struct {
+	msg string
+}
+
+func (e *UnauthorizedError) Error() string {
+	return e.msg
+}
+
+func (e *UnauthorizedError) Code() ErrorCode {
+	return ErrCodeUnauthorized
+}
+
+// RateLimitedError reports an action refused because the session is going
+// too fast
+type RateLimitedError struct {
+	msg string
+}
+
+func (e *RateLimitedError) Error() string {
+	return e.msg
+}
+
+func (e *RateLimitedError) Code() ErrorCode {
+	return ErrCodeRateLimited
+}
+
+// NotFoundError reports a missing target, such as an offline player
+type NotFoundError struct {
+	msg string
+}
+
+func (e *NotFoundError) Error() string {
+	return e.msg
+}
+
+func (e *NotFoundError) Code() ErrorCode {
+	return ErrCodeNotFound
+}
+
+// InvalidStateError reports an action that is not possible right now, such
+// as moving before a player is bound to the session
+type InvalidStateError struct {
+	msg string
+}
+
+func (e *InvalidStateError) Error() string {
+	return e.msg
+}
+
+func (e *InvalidStateError) Code() ErrorCode {
+	return ErrCodeInvalidState
+}
+
+// VersionError reports a HELLO whose protocol version the server cannot speak
+type VersionError struct {
+	msg string
+}
+
+func (e *VersionError) Error() string {
+	return e.msg
+}
+
+func (e *VersionError) Code() ErrorCode {
+	return ErrCodeVersion
+}
+
+// ErrorNotice is the body of the ERROR event. CorrelationID is the id of the
+// packet that caused the error, empty when the packet had none or could not
+// be decoded.
+type ErrorNotice struct {
+	Code          ErrorCode `json:"code"`
+	Message       string    `json:"message"`
+	EventName     string    `json:"event_name,omitempty"`
+	CorrelationID string    `json:"correlation_id,omitempty"`
+}
+
+// newErrorNotice builds the ERROR body for err. Errors that are not a
+// ProtocolError are hidden behind a generic message.
+func newErrorNotice(err error, packet *Packet) ErrorNotice {
+	notice := ErrorNotice{Code: ErrCodeInternal, Message: "internal server error"}
+
+	var protocolErr ProtocolError
+	if errors.As(err, &protocolErr) {
+		notice.Code = protocolErr.Code()
+		notice.Message = protocolErr.Error()
+	}
+
+	if packet != nil {
+		notice.EventName = packet.EventName
+		notice.CorrelationID = packet.ID
+	}
+	return notice
+}
+
+// SendError reports err to the client as an ERROR event. packet is the
+// offending packet, or nil if it could not be decoded.
+func (s *Session) SendError(err error, packet *Packet) error {
+	notice := newErrorNotice(err, packet)
+	if notice.Code == ErrCodeInternal {
+		logrus.Error("Internal error on session ", s.id.String(), ": ", err)
+	}
+	return s.Send(ErrorEvent, notice)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewErrorNoticeCodes(t *testing.T) {
+	packet := &Packet{ID: "42", EventName: "MOVE"}
+
+	for _, tc := range []struct {
+		err  error
+		code ErrorCode
+	}{
+		{&PacketValidationError{msg: "bad"}, ErrCodeInvalidPacket},
+		{&UnauthorizedError{msg: "bad"}, ErrCodeUnauthorized},
+		{&RateLimitedError{msg: "bad"}, ErrCodeRateLimited},
+		{&NotFoundError{msg: "bad"}, ErrCodeNotFound},
+		{&InvalidStateError{msg: "bad"}, ErrCodeInvalidState},
+		{&VersionError{msg: "bad"}, ErrCodeVersion},
+		{fmt.Errorf("wrapped: %w", &NotFoundError{msg: "bad"}), ErrCodeNotFound},
+	} {
+		notice := newErrorNotice(tc.err, packet)
+		assert.Equal(t, tc.code, notice.Code)
+		assert.Equal(t, "42", notice.CorrelationID)
+		assert.Equal(t, "MOVE", notice.EventName)
+	}
+}
+
+func TestNewErrorNoticeHidesInternalErrors(t *testing.T) {
+	notice := newErrorNotice(errors.New("database password is hunter2"), nil)
+	assert.Equal(t, ErrCodeInternal, notice.Code)
+	assert.NotContains(t, notice.Message, "hunter2")
+	assert.Empty(t, notice.CorrelationID)
+}
+
+func TestHandlerErrorReply(t *testing.T) {
+	srv, addr := startTestServer(t)
+	srv.RegisterEventHandler("testMissing", func(session *Session, eventBody json.RawMessage) error {
+		return &NotFoundError{msg: "No such player: Bob"}
+	})
+
+	client, decoder := joinTestClient(t, srv, addr, "alice")
+
+	sendPacket(client, &Packet{ID: "abc", EventName: "testMissing", EventBody: json.RawMessage(`{}`)})
+
+	reply, err := decoder.Decode()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, ErrorEvent, reply.EventName)
+
+	var notice ErrorNotice
+	assert.NoError(t, json.Unmarshal(reply.EventBody, &notice))
+	assert.Equal(t, ErrorNotice{
+		Code:          ErrCodeNotFound,
+		Message:       "No such player: Bob",
+		EventName:     "testMissing",
+		CorrelationID: "abc",
+	}, notice)
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Wire format
+//
+// In the default length-prefixed mode every packet travels as a frame made of
+// a 4-byte big-endian unsigned length followed by exactly that many bytes of
+// UTF-8 JSON:
+//
+//	+----------------+------------------------------------------------+
+//	| length (u32 BE)| {"event_name":"MOVE","event_body":...}         |
+//	+----------------+------------------------------------------------+
+//
+// In newline-delimited mode each packet is a single line of JSON terminated
+// by '\n' (a trailing '\r' is tolerated). Zero-length frames and blank lines
+// are ignored. Frames larger than the configured maximum close the
+// connection.
+//
+// Connections that negotiate the "binary" feature carry BinaryCodec payloads
+// instead of JSON in the same frames; see codec.go.
+//
+// WebSocket connections carry one packet per message instead; see
+// websocket.go.
+//
+// Connections that negotiate "compression" may deflate any length-prefixed
+// frame. Such a frame has the top bit of its length set; the remaining bits
+// give the size of the deflated payload, which must still fit MaxFrameSize
+// and may inflate to at most MaxDecompressedSize.
+
+type FrameMode int
+
+const (
+	LengthPrefixed FrameMode = iota
+	NewlineDelimited
+)
+
+const (
+	DefaultMaxFrameSize = 64 * 1024
+	frameHeaderSize     = 4
+)
+
+var ErrFrameTooLarge = errors.New("frame exceeds maximum size")
+
+func (m FrameMode) String() string {
+	switch m {
+	case LengthPrefixed:
+		return "length"
+	case NewlineDelimited:
+		return "newline"
+	default:
+		return "unknown"
+	}
+}
+
+func (m FrameMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *FrameMode) UnmarshalText(text []byte) error {
+	mode, err := ParseFrameMode(string(text))
+	if err != nil {
+		return err
+	}
+	*m = mode
+	return nil
+}
+
+// ParseFrameMode maps a configuration value onto a FrameMode.
+func ParseFrameMode(value string) (FrameMode, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "length", "length-prefixed":
+		return LengthPrefixed, nil
+	case "newline", "ndjson", "json-lines":
+		return NewlineDelimited, nil
+	default:
+		return LengthPrefixed, fmt.Errorf("unknown frame mode: %s", value)
+	}
+}
+
+// FrameReader splits a byte stream into frames, regardless of how TCP
+// coalesces or splits the underlying reads.
+type FrameReader struct {
+	r        *bufio.Reader
+	messages messageConn // set when r carries whole messages
+	mode     FrameMode
+	maxSize  int
+	inflater *inflater // nil unless compression was negotiated
+}
+
+func NewFrameReader(r io.Reader, mode FrameMode, maxSize int) *FrameReader {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxFrameSize
+	}
+	messages, _ := r.(messageConn)
+	return &FrameReader{
+		r:        bufio.NewReader(r),
+		messages: messages,
+		mode:     mode,
+		maxSize:  maxSize,
+	}
+}
+
+// EnableCompression accepts deflated frames that inflate to at most maxSize.
+func (fr *FrameReader) EnableCompression(maxSize int, metrics *CompressionMetrics) {
+	fr.inflater = newInflater(maxSize, metrics)
+}
+
+// ReadFrame returns the payload of the next non-empty frame. io.EOF is only
+// returned on a clean frame boundary; a stream cut mid-frame yields
+// io.ErrUnexpectedEOF.
+func (fr *FrameReader) ReadFrame() ([]byte, error) {
+	for {
+		var frame []byte
+		var err error
+		if fr.messages != nil {
+			frame, err = fr.messages.ReadMessage(fr.maxSize)
+		} else if fr.mode == NewlineDelimited {
+			frame, err = fr.readLine()
+		} else {
+			frame, err = fr.readLengthPrefixed()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(frame) > 0 {
+			return frame, nil
+		}
+	}
+}
+
+// ReadHandshake returns the first message of a connection. Clients that
+// speak the framing send their HELLO as an ordinary frame, but older clients
+// write a bare token, a RESUME command or a HELLO object with no framing at
+// all. Whatever the client sent after the first message stays buffered for
+// ReadFrame.
+func (fr *FrameReader) ReadHandshake() ([]byte, error) {
+	if fr.messages != nil {
+		return fr.ReadFrame()
+	}
+
+	first, err := fr.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case fr.mode == LengthPrefixed && first[0] == 0:
+		// The length header of any frame under 16MiB starts with a zero
+		// byte, which no text message does
+		return fr.ReadFrame()
+	case first[0] == '{':
+		return fr.readObject()
+	default:
+		return fr.readUnframed()
+	}
+}
+
+// readObject reads one JSON object, however many reads it arrives in.
+func (fr *FrameReader) readObject() ([]byte, error) {
+	var object []byte
+	depth := 0
+	inString, escaped := false, false
+	for {
+		if len(object) >= fr.maxSize {
+			return nil, ErrFrameTooLarge
+		}
+		c, err := fr.r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		object = append(object, c)
+
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			escaped = c == '\\'
+			inString = c != '"'
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			depth--
+			if depth == 0 {
+				return object, nil
+			}
+		}
+	}
+}
+
+// readUnframed reads a token or RESUME command, which has no delimiter. The
+// client sends it in one write and waits for the answer, so it is all that
+// has arrived, up to the end of the first line if there is one.
+func (fr *FrameReader) readUnframed() ([]byte, error) {
+	size := fr.r.Buffered()
+	buffered, err := fr.r.Peek(size)
+	if err != nil {
+		return nil, err
+	}
+	if i := bytes.IndexByte(buffered, '\n'); i >= 0 {
+		size = i + 1
+	}
+	if size > fr.maxSize {
+		return nil, ErrFrameTooLarge
+	}
+
+	message := make([]byte, size)
+	if _, err := io.ReadFull(fr.r, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func (fr *FrameReader) readLengthPrefixed() ([]byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(fr.r, header[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	compressed := size&frameCompressed != 0 && fr.inflater != nil
+	if compressed {
+		size &^= frameCompressed
+	}
+	if uint64(size) > uint64(fr.maxSize) {
+		return nil, ErrFrameTooLarge
+	}
+
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(fr.r, frame); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if compressed {
+		return fr.inflater.decompress(frame)
+	}
+	return frame, nil
+}
+
+func (fr *FrameReader) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := fr.r.ReadSlice('\n')
+		if len(line)+len(chunk) > fr.maxSize+2 {
+			return nil, ErrFrameTooLarge
+		}
+		line = append(line, chunk...)
+
+		if err == nil {
+			break
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(line) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	line = bytes.TrimRight(line, "\r\n")
+	if len(line) > fr.maxSize {
+		return nil, ErrFrameTooLarge
+	}
+	return line, nil
+}
+
+// FrameWriter writes payloads using the same framing as FrameReader.
+type FrameWriter struct {
+	w        io.Writer
+	messages messageConn // set when w carries whole messages
+	binary   bool        // payloads are not text, for message transports
+	mode     FrameMode
+	maxSize  int
+	deflater *deflater // nil unless compression was negotiated
+}
+
+func NewFrameWriter(w io.Writer, mode FrameMode, maxSize int) *FrameWriter {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxFrameSize
+	}
+	messages, _ := w.(messageConn)
+	return &FrameWriter{
+		w:        w,
+		messages: messages,
+		mode:     mode,
+		maxSize:  maxSize,
+	}
+}
+
+// EnableCompression deflates length-prefixed frames whose payload is at
+// least threshold bytes, when that makes them smaller.
+func (fw *FrameWriter) EnableCompression(threshold int, metrics *CompressionMetrics) {
+	if fw.mode == LengthPrefixed && fw.messages == nil {
+		fw.deflater = newDeflater(threshold, metrics)
+	}
+}
+
+// WriteFrame writes a single frame with one Write call so concurrent
+// writers on the same connection cannot interleave partial frames.
+func (fw *FrameWriter) WriteFrame(payload []byte) error {
+	var flags uint32
+	if fw.deflater != nil {
+		if compressed, ok := fw.deflater.compress(payload); ok {
+			payload = compressed
+			flags = frameCompressed
+		}
+	}
+	if len(payload) > fw.maxSize {
+		return ErrFrameTooLarge
+	}
+	if fw.messages != nil {
+		return fw.messages.WriteMessage(payload, fw.binary)
+	}
+
+	var buf []byte
+	if fw.mode == NewlineDelimited {
+		if bytes.IndexByte(payload, '\n') >= 0 {
+			return errors.New("newline-delimited frame contains a newline")
+		}
+		buf = make([]byte, 0, len(payload)+1)
+		buf = append(buf, payload...)
+		buf = append(buf, '\n')
+	} else {
+		buf = make([]byte, frameHeaderSize+len(payload))
+		binary.BigEndian.PutUint32(buf, uint32(len(payload))|flags)
+		copy(buf[frameHeaderSize:], payload)
+	}
+
+	_, err := fw.w.Write(buf)
+	return err
+}
+
+// PacketDecoder is a streaming decoder turning frames into Packet values.
+type PacketDecoder struct {
+	frames    *FrameReader
+	codec     Codec
+	frameSize int
+}
+
+func NewPacketDecoder(r io.Reader, mode FrameMode, maxSize int) *PacketDecoder {
+	return &PacketDecoder{frames: NewFrameReader(r, mode, maxSize), codec: JSONCodec{}}
+}
+
+// EnableCompression accepts deflated frames; see FrameReader.
+func (d *PacketDecoder) EnableCompression(maxSize int, metrics *CompressionMetrics) {
+	d.frames.EnableCompression(maxSize, metrics)
+}
+
+// ReadHandshake returns the first message of the connection; see
+// FrameReader.
+func (d *PacketDecoder) ReadHandshake() ([]byte, error) {
+	return d.frames.ReadHandshake()
+}
+
+// SetCodec changes how the following frames are decoded.
+func (d *PacketDecoder) SetCodec(codec Codec) {
+	d.codec = codec
+}
+
+func (d *PacketDecoder) Decode() (Packet, error) {
+	var packet Packet
+
+	frame, err := d.frames.ReadFrame()
+	if err != nil {
+		return packet, err
+	}
+	d.frameSize = len(frame)
+
+	if err := d.codec.Unmarshal(frame, &packet); err != nil {
+		return packet, err
+	}
+	return packet, nil
+}
+
+// LastFrameSize is the payload size of the most recently decoded frame.
+func (d *PacketDecoder) LastFrameSize() int {
+	return d.frameSize
+}
+
+// PacketEncoder is the outbound counterpart of PacketDecoder.
+type PacketEncoder struct {
+	frames *FrameWriter
+	codec  Codec
+}
+
+func NewPacketEncoder(w io.Writer, mode FrameMode, maxSize int) *PacketEncoder {
+	return &PacketEncoder{frames: NewFrameWriter(w, mode, maxSize), codec: JSONCodec{}}
+}
+
+// EnableCompression deflates large frames; see FrameWriter.
+func (e *PacketEncoder) EnableCompression(threshold int, metrics *CompressionMetrics) {
+	e.frames.EnableCompression(threshold, metrics)
+}
+
+// SetCodec changes how the following packets are encoded.
+func (e *PacketEncoder) SetCodec(codec Codec) {
+	e.codec = codec
+	e.frames.binary = codec.Name() != (JSONCodec{}).Name()
+}
+
+func (e *PacketEncoder) Encode(packet *Packet) error {
+	data, err := e.codec.Marshal(packet)
+	if err != nil {
+		return err
+	}
+	return e.frames.WriteFrame(data)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	for _, mode := range []FrameMode{LengthPrefixed, NewlineDelimited} {
+		var buf bytes.Buffer
+		writer := NewFrameWriter(&buf, mode, 0)
+		assert.NoError(t, writer.WriteFrame([]byte(`{"a":1}`)))
+		assert.NoError(t, writer.WriteFrame([]byte(`{"b":2}`)))
+
+		reader := NewFrameReader(&buf, mode, 0)
+		frame, err := reader.ReadFrame()
+		assert.NoError(t, err)
+		assert.Equal(t, `{"a":1}`, string(frame), mode.String())
+
+		frame, err = reader.ReadFrame()
+		assert.NoError(t, err)
+		assert.Equal(t, `{"b":2}`, string(frame), mode.String())
+
+		_, err = reader.ReadFrame()
+		assert.Equal(t, io.EOF, err, mode.String())
+	}
+}
+
+func TestFrameReaderSplitReads(t *testing.T) {
+	var buf bytes.Buffer
+	encoder := NewPacketEncoder(&buf, LengthPrefixed, 0)
+	encoder.Encode(&Packet{EventName: "MOVE", EventBody: json.RawMessage(`"1,2,3"`)})
+
+	// OneByteReader forces every frame to arrive across many reads
+	decoder := NewPacketDecoder(iotest.OneByteReader(&buf), LengthPrefixed, 0)
+	packet, err := decoder.Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, "MOVE", packet.EventName)
+	assert.Equal(t, `"1,2,3"`, string(packet.EventBody))
+}
+
+func TestFrameReaderTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	NewFrameWriter(&buf, LengthPrefixed, 0).WriteFrame(bytes.Repeat([]byte("x"), 64))
+
+	_, err := NewFrameReader(&buf, LengthPrefixed, 32).ReadFrame()
+	assert.Equal(t, ErrFrameTooLarge, err)
+
+	line := strings.Repeat("x", 64) + "\n"
+	_, err = NewFrameReader(strings.NewReader(line), NewlineDelimited, 32).ReadFrame()
+	assert.Equal(t, ErrFrameTooLarge, err)
+
+	err = NewFrameWriter(&buf, LengthPrefixed, 32).WriteFrame(bytes.Repeat([]byte("x"), 64))
+	assert.Equal(t, ErrFrameTooLarge, err)
+}
+
+func TestFrameReaderTruncated(t *testing.T) {
+	_, err := NewFrameReader(bytes.NewReader([]byte{0, 0, 0, 10, 'x'}), LengthPrefixed, 0).ReadFrame()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	_, err = NewFrameReader(strings.NewReader(`{"a":1}`), NewlineDelimited, 0).ReadFrame()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestNewlineDelimitedSkipsBlankLines(t *testing.T) {
+	input := "\r\n\n{\"event_name\":\"PING\",\"event_body\":\"\"}\r\n"
+	packet, err := NewPacketDecoder(strings.NewReader(input), NewlineDelimited, 0).Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, "PING", packet.EventName)
+}
+
+func TestFrameReaderReadHandshake(t *testing.T) {
+	hello := `{"protocol_version":1,"token":"a}b\\\"{"}`
+
+	var framed bytes.Buffer
+	writer := NewFrameWriter(&framed, LengthPrefixed, 0)
+	writer.WriteFrame([]byte(hello))
+	writer.WriteFrame([]byte(`{"a":1}`))
+
+	var unframed bytes.Buffer
+	unframed.WriteString(hello)
+	NewFrameWriter(&unframed, LengthPrefixed, 0).WriteFrame([]byte(`{"a":1}`))
+
+	for name, reader := range map[string]*FrameReader{
+		"framed":   NewFrameReader(iotest.OneByteReader(&framed), LengthPrefixed, 0),
+		"unframed": NewFrameReader(iotest.OneByteReader(&unframed), LengthPrefixed, 0),
+		"newline":  NewFrameReader(strings.NewReader(hello+"\n{\"a\":1}\n"), NewlineDelimited, 0),
+	} {
+		message, err := reader.ReadHandshake()
+		assert.NoError(t, err, name)
+		assert.Equal(t, hello, string(message), name)
+
+		// What the client sent next is still there
+		frame, err := reader.ReadFrame()
+		assert.NoError(t, err, name)
+		assert.Equal(t, `{"a":1}`, string(frame), name)
+	}
+
+	reader := NewFrameReader(strings.NewReader("RESUME abc 7\n{\"a\":1}\n"), NewlineDelimited, 0)
+	message, err := reader.ReadHandshake()
+	assert.NoError(t, err)
+	assert.Equal(t, "RESUME abc 7\n", string(message))
+	frame, err := reader.ReadFrame()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":1}`, string(frame))
+
+	message, err = NewFrameReader(strings.NewReader("eyJhbGciOiJIUzI1NiJ9.e30.sig"), LengthPrefixed, 0).ReadHandshake()
+	assert.NoError(t, err)
+	assert.Equal(t, "eyJhbGciOiJIUzI1NiJ9.e30.sig", string(message))
+
+	_, err = NewFrameReader(strings.NewReader(`{"token":"`+strings.Repeat("x", 64)+`"}`), LengthPrefixed, 32).ReadHandshake()
+	assert.Equal(t, ErrFrameTooLarge, err)
+}
+
+func TestParseFrameMode(t *testing.T) {
+	mode, err := ParseFrameMode("newline")
+	assert.NoError(t, err)
+	assert.Equal(t, NewlineDelimited, mode)
+
+	mode, err = ParseFrameMode("")
+	assert.NoError(t, err)
+	assert.Equal(t, LengthPrefixed, mode)
+
+	_, err = ParseFrameMode("carrier-pigeon")
+	assert.Error(t, err)
+}
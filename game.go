@@ -0,0 +1,492 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Bioblaze/mud/Map"
+	"github.com/Bioblaze/mud/Player"
+)
+
+// Events spoken by UTcpClientObject
+const (
+	PingEvent        = "PING"
+	MoveEvent        = "MOVE"
+	SpawnPlayerEvent = "SPAWN_PLAYER"
+	SpawnObjectEvent = "SPAWN_OBJECT"
+	ChatEvent        = "CHAT"
+	PrivateChatEvent = "PRIVATE_CHAT"
+
+	// Chat is limited per session on top of the packet rate limit
+	ChatMessagesPerSec = 2
+	ChatBurst          = 5
+
+	// DefaultMaxMoveDistance is how many tiles a single MOVE may cover
+	DefaultMaxMoveDistance = 1
+	// DefaultTileSize is how many world units, UE centimetres, make a tile
+	DefaultTileSize = 100
+)
+
+// Queries a client sends with an empty object body, each answered with an
+// event of the same name
+const (
+	LookEvent  = "LOOK"
+	WhoEvent   = "WHO"
+	ScoreEvent = "SCORE"
+)
+
+// Directions a player can move in, as MoveBody names them
+var Directions = []string{"North", "East", "South", "West"}
+
+// MoveBody asks to move the session's player, either to an absolute position
+// or a number of tiles in a direction (North, East, South or West). Either
+// way the move is bounded by the server's MaxMoveDistance. The
+// legacy form is "controllerId,x,y" with x and y in world units; the
+// controller ID is ignored since the server knows which player the session
+// controls.
+type MoveBody struct {
+	ControllerID int32    `json:"controller_id,omitempty"`
+	X            *float64 `json:"x,omitempty"`
+	Y            *float64 `json:"y,omitempty"`
+	Direction    string   `json:"direction,omitempty"`
+	Distance     int      `json:"distance,omitempty" validate:"min=0"`
+
+	world bool // X and Y are world positions rather than tiles
+}
+
+func (b *MoveBody) UnmarshalLegacy(body string) error {
+	fields := strings.Split(body, ",")
+	if len(fields) != 3 {
+		return fmt.Errorf("expected controllerId,x,y, got %q", body)
+	}
+
+	controllerID, err := strconv.ParseInt(strings.TrimSpace(fields[0]), 10, 32)
+	if err != nil {
+		return fmt.Errorf("controllerId: %v", err)
+	}
+	x, err := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64)
+	if err != nil {
+		return fmt.Errorf("x: %v", err)
+	}
+	y, err := strconv.ParseFloat(strings.TrimSpace(fields[2]), 64)
+	if err != nil {
+		return fmt.Errorf("y: %v", err)
+	}
+
+	b.ControllerID = int32(controllerID)
+	b.X, b.Y = &x, &y
+	b.world = true
+	return nil
+}
+
+// toTiles turns a world position into the tile it lies in.
+func (b *MoveBody) toTiles(tileSize int) {
+	if !b.world || b.X == nil || b.Y == nil {
+		return
+	}
+	x := math.Floor(*b.X / float64(tileSize))
+	y := math.Floor(*b.Y / float64(tileSize))
+	b.X, b.Y = &x, &y
+	b.world = false
+}
+
+func (b *MoveBody) distance() int {
+	if b.Distance == 0 {
+		return 1
+	}
+	return b.Distance
+}
+
+// delta works out how far a player at x, y moves.
+func (b *MoveBody) delta(x, y int) (int, int, error) {
+	if b.Direction != "" {
+		distance := b.distance()
+		switch b.Direction {
+		case "North":
+			return 0, distance, nil
+		case "East":
+			return distance, 0, nil
+		case "South":
+			return 0, -distance, nil
+		case "West":
+			return -distance, 0, nil
+		default:
+			return 0, 0, fmt.Errorf("unknown direction %q", b.Direction)
+		}
+	}
+
+	if b.X == nil || b.Y == nil {
+		return 0, 0, fmt.Errorf("either x and y or direction is required")
+	}
+	if math.IsNaN(*b.X) || math.IsNaN(*b.Y) || math.IsInf(*b.X, 0) || math.IsInf(*b.Y, 0) {
+		return 0, 0, fmt.Errorf("x and y must be finite")
+	}
+	return int(math.Round(*b.X)) - x, int(math.Round(*b.Y)) - y, nil
+}
+
+// ChatBody is the body of CHAT. The legacy form is "sender,message"; the
+// sender is ignored in favour of the session's player name.
+type ChatBody struct {
+	Sender  string `json:"sender,omitempty"`
+	Message string `json:"message" validate:"required,maxlen=500"`
+}
+
+func (b *ChatBody) UnmarshalLegacy(body string) error {
+	fields := strings.SplitN(body, ",", 2)
+	if len(fields) == 1 {
+		b.Message = fields[0]
+		return nil
+	}
+	b.Sender, b.Message = fields[0], fields[1]
+	return nil
+}
+
+// PrivateChatBody is the body of PRIVATE_CHAT. The legacy form is
+// "recipient,message".
+type PrivateChatBody struct {
+	To      string `json:"to" validate:"required"`
+	Message string `json:"message" validate:"required,maxlen=500"`
+}
+
+func (b *PrivateChatBody) UnmarshalLegacy(body string) error {
+	fields := strings.SplitN(body, ",", 2)
+	if len(fields) != 2 {
+		return fmt.Errorf("expected recipient,message, got %q", body)
+	}
+	b.To, b.Message = strings.TrimSpace(fields[0]), fields[1]
+	return nil
+}
+
+// QueryBody is the body of LOOK, WHO and SCORE, which take no arguments.
+type QueryBody struct{}
+
+// PlayerPosition is the body of MOVE and SPAWN_PLAYER, "controllerId,x,y" in
+// legacy form.
+type PlayerPosition struct {
+	ControllerID int32  `json:"controller_id"`
+	Name         string `json:"name"`
+	X            int    `json:"x"`
+	Y            int    `json:"y"`
+}
+
+func (p PlayerPosition) LegacyString() string {
+	return fmt.Sprintf("%d,%d,%d", p.ControllerID, p.X, p.Y)
+}
+
+// ObjectPosition is the body of SPAWN_OBJECT, "objectId,x,y" in legacy form.
+type ObjectPosition struct {
+	ObjectID int32 `json:"object_id"`
+	X        int   `json:"x"`
+	Y        int   `json:"y"`
+}
+
+func (p ObjectPosition) LegacyString() string {
+	return fmt.Sprintf("%d,%d,%d", p.ObjectID, p.X, p.Y)
+}
+
+// ChatMessage is the body of CHAT and PRIVATE_CHAT sent to clients,
+// "sender,message" in legacy form. The UE client drops bodies with more than
+// two fields, so commas in the message are replaced there.
+type ChatMessage struct {
+	From    string `json:"from"`
+	Message string `json:"message"`
+}
+
+func (m ChatMessage) LegacyString() string {
+	return m.From + "," + strings.ReplaceAll(m.Message, ",", ";")
+}
+
+// Surroundings is the body of LOOK sent to clients: where the player stands,
+// the directions it can move in and who else is on the map.
+type Surroundings struct {
+	Map     string   `json:"map"`
+	X       int      `json:"x"`
+	Y       int      `json:"y"`
+	Terrain string   `json:"terrain"`
+	Exits   []string `json:"exits"`
+	Players []string `json:"players"`
+}
+
+// WhoEntry is one player in the body of WHO sent to clients.
+type WhoEntry struct {
+	Name string `json:"name"`
+	Map  string `json:"map,omitempty"`
+}
+
+type WhoList struct {
+	Players []WhoEntry `json:"players"`
+}
+
+// Score is the body of SCORE sent to clients.
+type Score struct {
+	Name        string  `json:"name"`
+	Level       int     `json:"level"`
+	Exp         int     `json:"exp"`
+	HP          int     `json:"hp"`
+	MaxHP       int     `json:"max_hp"`
+	ArmorRating float64 `json:"armor_rating"`
+}
+
+func (s *Server) registerGameHandlers() error {
+	handlers := []struct {
+		event      string
+		handler    interface{}
+		middleware []Middleware
+	}{
+		{PingEvent, s.handlePing, nil},
+		{PongEvent, s.handlePong, nil},
+		{MoveEvent, s.handleMove, nil},
+		{ChatEvent, s.handleChat, []Middleware{EventRateLimit(ChatMessagesPerSec, ChatBurst)}},
+		{PrivateChatEvent, s.handlePrivateChat, []Middleware{EventRateLimit(ChatMessagesPerSec, ChatBurst)}},
+		{LookEvent, s.handleLook, nil},
+		{WhoEvent, s.handleWho, nil},
+		{ScoreEvent, s.handleScore, nil},
+	}
+
+	for _, h := range handlers {
+		if err := s.RegisterTypedHandler(h.event, h.handler, h.middleware...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleMove moves the session's player on its map, in a straight line of
+// at most MaxMoveDistance walkable tiles. A refused move is answered with the
+// player's actual position so the client can snap back.
+func (s *Server) handleMove(session *Session, body *MoveBody) error {
+	player := session.GetPlayer()
+	if player == nil {
+		return &InvalidStateError{msg: "Not logged in"}
+	}
+
+	x, y, _ := player.GetLocation()
+	body.toTiles(s.config.TileSize)
+	dx, dy, err := body.delta(x, y)
+	if err != nil {
+		return &PacketValidationError{msg: fmt.Sprintf("Invalid %s body: %v", MoveEvent, err)}
+	}
+
+	m, ok := s.world.MapOf(player)
+	if !ok {
+		return &InvalidStateError{msg: "Not on a map"}
+	}
+
+	err = s.checkPath(m, x, y, dx, dy)
+	if err == nil {
+		err = m.MovePlayer(player, dx, dy)
+	}
+	if err != nil {
+		session.SendEvent(MoveEvent, s.playerPosition(player))
+		return &InvalidStateError{msg: fmt.Sprintf("Cannot move: %v", err)}
+	}
+
+	s.sendToMap(m, MoveEvent, s.playerPosition(player), session)
+	return nil
+}
+
+// checkPath makes sure a move of dx, dy from x, y keeps to one direction,
+// covers no more than MaxMoveDistance tiles and only crosses walkable ones.
+func (s *Server) checkPath(m *Map.Map, x, y, dx, dy int) error {
+	if dx != 0 && dy != 0 {
+		return fmt.Errorf("moves must keep to one direction")
+	}
+
+	distance := abs(dx) + abs(dy)
+	if distance > s.config.MaxMoveDistance {
+		return fmt.Errorf("%d tiles is further than %d", distance, s.config.MaxMoveDistance)
+	}
+
+	stepX, stepY := sign(dx), sign(dy)
+	for i := 1; i <= distance; i++ {
+		tile, err := m.GetTile(x+i*stepX, y+i*stepY)
+		if err != nil {
+			return err
+		}
+		if !tile.IsWalkable() {
+			return fmt.Errorf("(%d, %d) is not walkable", x+i*stepX, y+i*stepY)
+		}
+	}
+	return nil
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func (s *Server) handleChat(session *Session, body *ChatBody) error {
+	player := session.GetPlayer()
+	if player == nil {
+		return &InvalidStateError{msg: "Not logged in"}
+	}
+
+	m, ok := s.world.MapOf(player)
+	if !ok {
+		return &InvalidStateError{msg: "Not on a map"}
+	}
+
+	s.sendToMap(m, ChatEvent, ChatMessage{From: player.GetName(), Message: body.Message}, nil)
+	return nil
+}
+
+func (s *Server) handlePrivateChat(session *Session, body *PrivateChatBody) error {
+	player := session.GetPlayer()
+	if player == nil {
+		return &InvalidStateError{msg: "Not logged in"}
+	}
+
+	recipient, ok := s.sessions.GetByName(body.To)
+	if !ok {
+		return &NotFoundError{msg: fmt.Sprintf("Player %s is not online", body.To)}
+	}
+
+	recipient.SendEvent(PrivateChatEvent, ChatMessage{From: player.GetName(), Message: body.Message})
+	return nil
+}
+
+// handleLook describes the tile the session's player stands on.
+func (s *Server) handleLook(session *Session, body *QueryBody) error {
+	player := session.GetPlayer()
+	if player == nil {
+		return &InvalidStateError{msg: "Not logged in"}
+	}
+
+	m, ok := s.world.MapOf(player)
+	if !ok {
+		return &InvalidStateError{msg: "Not on a map"}
+	}
+
+	x, y, _ := player.GetLocation()
+	tile, err := m.GetTile(x, y)
+	if err != nil {
+		return err
+	}
+
+	surroundings := Surroundings{Map: m.GetName(), X: x, Y: y, Terrain: tile.Description(), Exits: []string{}, Players: []string{}}
+	for _, direction := range Directions {
+		move := MoveBody{Direction: direction}
+		dx, dy, _ := move.delta(x, y)
+		if next, err := m.GetTile(x+dx, y+dy); err == nil && next.IsWalkable() {
+			surroundings.Exits = append(surroundings.Exits, direction)
+		}
+	}
+	for _, other := range m.GetPlayers() {
+		if other != player {
+			surroundings.Players = append(surroundings.Players, other.GetName())
+		}
+	}
+	sort.Strings(surroundings.Players)
+
+	return session.Send(LookEvent, surroundings)
+}
+
+// handleWho lists the players online and the map each is on.
+func (s *Server) handleWho(session *Session, body *QueryBody) error {
+	list := WhoList{Players: []WhoEntry{}}
+	s.sessions.ForEach(func(other *Session) bool {
+		if player := other.GetPlayer(); player != nil {
+			entry := WhoEntry{Name: player.GetName()}
+			if m, ok := s.world.MapOf(player); ok {
+				entry.Map = m.GetName()
+			}
+			list.Players = append(list.Players, entry)
+		}
+		return true
+	})
+	sort.Slice(list.Players, func(i, j int) bool {
+		return nameKey(list.Players[i].Name) < nameKey(list.Players[j].Name)
+	})
+
+	return session.Send(WhoEvent, list)
+}
+
+func (s *Server) handleScore(session *Session, body *QueryBody) error {
+	player := session.GetPlayer()
+	if player == nil {
+		return &InvalidStateError{msg: "Not logged in"}
+	}
+
+	return session.Send(ScoreEvent, Score{
+		Name:        player.GetName(),
+		Level:       player.GetLevel(),
+		Exp:         player.GetExp(),
+		HP:          player.GetHP(),
+		MaxHP:       player.GetMaxHP(),
+		ArmorRating: player.GetArmorRating(),
+	})
+}
+
+// SpawnObject tells every player on m about an object at x, y.
+func (s *Server) SpawnObject(m *Map.Map, objectID int32, x, y int) {
+	s.sendToMap(m, SpawnObjectEvent, ObjectPosition{ObjectID: objectID, X: x, Y: y}, nil)
+}
+
+// enterWorld places the session's player on a map and spawns it for
+// everyone there. The client itself is sent its own player first, then
+// everyone else on the map.
+func (s *Server) enterWorld(session *Session) error {
+	player := session.GetPlayer()
+	m, err := s.world.Enter(player)
+	if err != nil {
+		return err
+	}
+
+	s.sendToMap(m, SpawnPlayerEvent, s.playerPosition(player), session)
+	session.SendEvent(SpawnPlayerEvent, s.playerPosition(player))
+	for _, other := range m.GetPlayers() {
+		if other != player {
+			session.SendEvent(SpawnPlayerEvent, s.playerPosition(other))
+		}
+	}
+	return nil
+}
+
+// leaveWorld takes the session's player off its map, unless the player has
+// since logged in on another session.
+func (s *Server) leaveWorld(session *Session) {
+	player := session.GetPlayer()
+	if player == nil {
+		return
+	}
+	if current, ok := s.sessions.GetByPlayer(player.GetID()); ok && current != session {
+		return
+	}
+	s.world.Leave(player)
+}
+
+func (s *Server) playerPosition(player *Player.Player) PlayerPosition {
+	x, y, _ := player.GetLocation()
+	return PlayerPosition{
+		ControllerID: s.world.ControllerID(player),
+		Name:         player.GetName(),
+		X:            x,
+		Y:            y,
+	}
+}
+
+// sendToMap sends an event to the session of every player on m except
+// exclude, each in the body format its client speaks.
+func (s *Server) sendToMap(m *Map.Map, eventName string, body LegacyEvent, exclude *Session) {
+	for _, player := range m.GetPlayers() {
+		if session, ok := s.sessions.GetByPlayer(player.GetID()); ok && session != exclude {
+			session.SendEvent(eventName, body)
+		}
+	}
+}
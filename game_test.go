@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Bioblaze/mud/Map"
+	"github.com/stretchr/testify/assert"
+)
+
+// joinTestClient logs in as accountID with roles and reads the client's own
+// SPAWN_PLAYER, which comes first, returning the connection and its decoder.
+func joinTestClient(t *testing.T, srv *Server, addr, accountID string, roles ...string) (net.Conn, *PacketDecoder) {
+	t.Helper()
+
+	conn := dialTestClient(t, addr, accountID, roles...)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	decoder := NewPacketDecoder(conn, LengthPrefixed, DefaultMaxFrameSize)
+
+	assert.Eventually(t, func() bool {
+		session, ok := srv.GetSessions().GetByAccount(accountID)
+		return ok && session.GetPlayer() != nil
+	}, time.Second, 10*time.Millisecond)
+	session, _ := srv.GetSessions().GetByAccount(accountID)
+	want := fmt.Sprintf("%q", srv.playerPosition(session.GetPlayer()).LegacyString())
+
+	packet, err := readEvent(decoder, SpawnPlayerEvent)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, want, string(packet.EventBody))
+	return conn, decoder
+}
+
+func TestMoveBodyLegacy(t *testing.T) {
+	var body MoveBody
+	assert.NoError(t, body.UnmarshalLegacy("3,1.600000,-2.000000"))
+	assert.Equal(t, int32(3), body.ControllerID)
+
+	dx, dy, err := body.delta(1, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, -3}, []int{dx, dy})
+
+	for _, legacy := range []string{"", "3,1", "x,1,2", "3,1,north"} {
+		assert.Error(t, (&MoveBody{}).UnmarshalLegacy(legacy), legacy)
+	}
+}
+
+func TestMoveBodyDirection(t *testing.T) {
+	dx, dy, err := (&MoveBody{Direction: "West", Distance: 2}).delta(5, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{-2, 0}, []int{dx, dy})
+
+	dx, dy, err = (&MoveBody{Direction: "North"}).delta(5, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 1}, []int{dx, dy})
+
+	_, _, err = (&MoveBody{Direction: "Up"}).delta(5, 5)
+	assert.Error(t, err)
+	_, _, err = (&MoveBody{}).delta(5, 5)
+	assert.Error(t, err)
+}
+
+func TestChatMessageLegacyString(t *testing.T) {
+	assert.Equal(t, "alice,hi; there", ChatMessage{From: "alice", Message: "hi, there"}.LegacyString())
+}
+
+func TestSpawnPlayersOnLogin(t *testing.T) {
+	srv, addr := startTestServer(t)
+	_, alice := joinTestClient(t, srv, addr, "alice")
+	_, bob := joinTestClient(t, srv, addr, "bob")
+
+	bobSession, _ := srv.GetSessions().GetByAccount("bob")
+	want := srv.playerPosition(bobSession.GetPlayer())
+
+	packet, err := readEvent(alice, SpawnPlayerEvent)
+	if assert.NoError(t, err) {
+		assert.Equal(t, fmt.Sprintf("%q", want.LegacyString()), string(packet.EventBody))
+	}
+
+	// Bob is told about Alice as well
+	aliceSession, _ := srv.GetSessions().GetByAccount("alice")
+	aliceSpawn := fmt.Sprintf("%q", srv.playerPosition(aliceSession.GetPlayer()).LegacyString())
+	packet, err = readEvent(bob, SpawnPlayerEvent)
+	if assert.NoError(t, err) {
+		assert.Equal(t, aliceSpawn, string(packet.EventBody))
+	}
+}
+
+func TestChatRouting(t *testing.T) {
+	srv, addr := startTestServer(t)
+	aliceConn, alice := joinTestClient(t, srv, addr, "alice")
+	bobConn, bob := joinTestClient(t, srv, addr, "bob")
+
+	// Legacy CHAT: the claimed sender is ignored and the reply is legacy too
+	sendPacket(aliceConn, &Packet{EventName: ChatEvent, EventBody: json.RawMessage(`"mallory,hello, bob"`)})
+	packet, err := readEvent(bob, ChatEvent)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `"alice,hello; bob"`, string(packet.EventBody))
+	}
+
+	// JSON PRIVATE_CHAT to a legacy client
+	sendPacket(bobConn, &Packet{EventName: PrivateChatEvent, EventBody: json.RawMessage(`{"to":"Alice","message":"psst"}`)})
+	packet, err = readEvent(alice, PrivateChatEvent)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `"bob,psst"`, string(packet.EventBody))
+	}
+
+	// Bob spoke JSON last, so Bob is answered in JSON
+	sendPacket(aliceConn, &Packet{EventName: PrivateChatEvent, EventBody: json.RawMessage(`"bob,hi"`)})
+	packet, err = readEvent(bob, PrivateChatEvent)
+	if assert.NoError(t, err) {
+		var message ChatMessage
+		assert.NoError(t, json.Unmarshal(packet.EventBody, &message))
+		assert.Equal(t, ChatMessage{From: "alice", Message: "hi"}, message)
+	}
+
+	sendPacket(aliceConn, &Packet{EventName: PrivateChatEvent, EventBody: json.RawMessage(`"carol,anyone?"`)})
+	packet, err = readEvent(alice, ErrorEvent)
+	if assert.NoError(t, err) {
+		var notice ErrorNotice
+		assert.NoError(t, json.Unmarshal(packet.EventBody, &notice))
+		assert.Equal(t, ErrCodeNotFound, notice.Code)
+	}
+}
+
+func TestMoveRejectedSnapsBack(t *testing.T) {
+	srv, addr := startTestServer(t)
+	conn, decoder := joinTestClient(t, srv, addr, "alice")
+
+	session, _ := srv.GetSessions().GetByAccount("alice")
+	player := session.GetPlayer()
+	x, y, _ := player.GetLocation()
+
+	sendPacket(conn, &Packet{EventName: MoveEvent, EventBody: json.RawMessage(`"1,-5.0,-5.0"`)})
+
+	packet, err := readEvent(decoder, MoveEvent)
+	if assert.NoError(t, err) {
+		assert.Equal(t, fmt.Sprintf("%q", srv.playerPosition(player).LegacyString()), string(packet.EventBody))
+	}
+	packet, err = readEvent(decoder, ErrorEvent)
+	if assert.NoError(t, err) {
+		var notice ErrorNotice
+		assert.NoError(t, json.Unmarshal(packet.EventBody, &notice))
+		assert.Equal(t, ErrCodeInvalidState, notice.Code)
+	}
+
+	px, py, _ := player.GetLocation()
+	assert.Equal(t, []int{x, y}, []int{px, py})
+}
+
+func TestMoveBroadcast(t *testing.T) {
+	srv, addr := startTestServer(t)
+	_, alice := joinTestClient(t, srv, addr, "alice")
+	bobConn, _ := joinTestClient(t, srv, addr, "bob")
+
+	session, _ := srv.GetSessions().GetByAccount("bob")
+	player := session.GetPlayer()
+	x, y, _ := player.GetLocation()
+
+	// Moves keep to one direction, so diagonal neighbours are out of reach
+	var tiles []Map.Tile
+	for _, tile := range srv.world.StartMap().GetWalkableAdjacentTiles(x, y) {
+		if tile.GetX() == x || tile.GetY() == y {
+			tiles = append(tiles, tile)
+		}
+	}
+	if len(tiles) == 0 {
+		t.Skip("the spawn tile has no walkable neighbour")
+	}
+	target := tiles[0]
+
+	body := fmt.Sprintf(`{"x":%d,"y":%d}`, target.GetX(), target.GetY())
+	sendPacket(bobConn, &Packet{EventName: MoveEvent, EventBody: json.RawMessage(body)})
+
+	packet, err := readEvent(alice, MoveEvent)
+	if assert.NoError(t, err) {
+		want := PlayerPosition{ControllerID: srv.world.ControllerID(player), X: target.GetX(), Y: target.GetY()}
+		assert.Equal(t, fmt.Sprintf("%q", want.LegacyString()), string(packet.EventBody))
+	}
+
+	px, py, _ := player.GetLocation()
+	assert.Equal(t, []int{target.GetX(), target.GetY()}, []int{px, py})
+}
+
+func TestMoveLegacyWorldPosition(t *testing.T) {
+	srv, addr := startTestServer(t)
+	conn, decoder := joinTestClient(t, srv, addr, "alice")
+
+	session, _ := srv.GetSessions().GetByAccount("alice")
+	player := session.GetPlayer()
+	x, y, _ := player.GetLocation()
+	controllerID := srv.world.ControllerID(player)
+
+	// The UE client sends where the pawn is in world units, which wanders
+	// within a tile far more often than it crosses into the next one
+	body := fmt.Sprintf(`"%d,%f,%f"`, controllerID, float64(x*DefaultTileSize)+37.5, float64(y*DefaultTileSize)+80.25)
+	sendPacket(conn, &Packet{ID: "m1", EventName: MoveEvent, EventBody: json.RawMessage(body)})
+	_, err := readEvent(decoder, AckEvent)
+	assert.NoError(t, err)
+	px, py, _ := player.GetLocation()
+	assert.Equal(t, []int{x, y}, []int{px, py})
+
+	var target *Map.Tile
+	for _, tile := range srv.world.StartMap().GetWalkableAdjacentTiles(x, y) {
+		if tile.GetX() == x || tile.GetY() == y {
+			target = &tile
+			break
+		}
+	}
+	if target == nil {
+		t.Skip("the spawn tile has no walkable neighbour")
+	}
+
+	body = fmt.Sprintf(`"%d,%f,%f"`, controllerID, float64(target.GetX()*DefaultTileSize)+12.5, float64(target.GetY()*DefaultTileSize)+99.0)
+	sendPacket(conn, &Packet{ID: "m2", EventName: MoveEvent, EventBody: json.RawMessage(body)})
+	_, err = readEvent(decoder, AckEvent)
+	assert.NoError(t, err)
+	px, py, _ = player.GetLocation()
+	assert.Equal(t, []int{target.GetX(), target.GetY()}, []int{px, py})
+}
+
+func TestMoveBounds(t *testing.T) {
+	srv, addr := startTestServer(t, func(config *Config) {
+		config.MaxMoveDistance = 2
+	})
+	joinTestClient(t, srv, addr, "alice")
+
+	session, _ := srv.GetSessions().GetByAccount("alice")
+	player := session.GetPlayer()
+	m := srv.world.StartMap()
+	walkable := func(x, y int) bool {
+		tile, err := m.GetTile(x, y)
+		return err == nil && tile.IsWalkable()
+	}
+	place := func(x, y int) {
+		player.SetLocation(x, y, m.GetID())
+	}
+	refused := func(body MoveBody) {
+		t.Helper()
+		x, y, _ := player.GetLocation()
+		assert.Error(t, srv.handleMove(session, &body))
+		px, py, _ := player.GetLocation()
+		assert.Equal(t, []int{x, y}, []int{px, py})
+	}
+
+	// Find a walkable row of three tiles, and a wall between two walkable tiles
+	open, wall := -1, -1
+	for x := 0; x+2 < m.GetWidth(); x++ {
+		for y := 0; y < m.GetHeight(); y++ {
+			if !walkable(x, y) || !walkable(x+2, y) {
+				continue
+			}
+			if walkable(x+1, y) && open < 0 {
+				open = x*m.GetHeight() + y
+			}
+			if !walkable(x+1, y) && wall < 0 {
+				wall = x*m.GetHeight() + y
+			}
+		}
+	}
+
+	if open >= 0 {
+		x, y := open/m.GetHeight(), open%m.GetHeight()
+		place(x, y)
+		assert.NoError(t, srv.handleMove(session, &MoveBody{Direction: "East", Distance: 2}))
+		px, py, _ := player.GetLocation()
+		assert.Equal(t, []int{x + 2, y}, []int{px, py})
+
+		place(x, y)
+		refused(MoveBody{Direction: "East", Distance: 3})
+		far, diagonal := float64(x+2), float64(y+1)
+		refused(MoveBody{X: &far, Y: &diagonal})
+	}
+	if wall >= 0 {
+		x, y := wall/m.GetHeight(), wall%m.GetHeight()
+		place(x, y)
+		refused(MoveBody{Direction: "East", Distance: 2})
+	}
+
+	// Absolute positions are no way to teleport across the map
+	place(0, 0)
+	farX, farY := float64(m.GetWidth()-1), float64(0)
+	refused(MoveBody{X: &farX, Y: &farY})
+	refused(MoveBody{Direction: "West"})
+
+	// Nor is moving off the map
+	m.RemovePlayer(player)
+	refused(MoveBody{Direction: "North"})
+}
+
+func TestLeaveWorldKeepsKickedPlayerOnMap(t *testing.T) {
+	srv, addr := startTestServer(t, func(config *Config) {
+		config.LoginPolicy = LoginKickOld
+	})
+	joinTestClient(t, srv, addr, "alice")
+	joinTestClient(t, srv, addr, "alice")
+
+	session, _ := srv.GetSessions().GetByAccount("alice")
+	time.Sleep(50 * time.Millisecond) // let the kicked session unwind
+	assert.True(t, srv.world.StartMap().HasPlayer(session.GetPlayer()))
+}
+
+func TestLookWhoScore(t *testing.T) {
+	srv, addr := startTestServer(t)
+	aliceConn, alice := joinTestClient(t, srv, addr, "alice")
+	joinTestClient(t, srv, addr, "bob")
+
+	sendPacket(aliceConn, &Packet{EventName: LookEvent, EventBody: json.RawMessage(`{}`)})
+	packet, err := readEvent(alice, LookEvent)
+	if assert.NoError(t, err) {
+		var surroundings Surroundings
+		assert.NoError(t, json.Unmarshal(packet.EventBody, &surroundings))
+		assert.Equal(t, StartMapName, surroundings.Map)
+		assert.Equal(t, []string{"bob"}, surroundings.Players)
+		assert.NotEmpty(t, surroundings.Terrain)
+
+		session, _ := srv.GetSessions().GetByAccount("alice")
+		x, y, _ := session.GetPlayer().GetLocation()
+		assert.Equal(t, []int{x, y}, []int{surroundings.X, surroundings.Y})
+	}
+
+	sendPacket(aliceConn, &Packet{EventName: WhoEvent, EventBody: json.RawMessage(`{}`)})
+	packet, err = readEvent(alice, WhoEvent)
+	if assert.NoError(t, err) {
+		assert.JSONEq(t, `{"players":[{"name":"alice","map":"Start"},{"name":"bob","map":"Start"}]}`, string(packet.EventBody))
+	}
+
+	sendPacket(aliceConn, &Packet{EventName: ScoreEvent, EventBody: json.RawMessage(`{}`)})
+	packet, err = readEvent(alice, ScoreEvent)
+	if assert.NoError(t, err) {
+		var score Score
+		assert.NoError(t, json.Unmarshal(packet.EventBody, &score))
+		assert.Equal(t, "alice", score.Name)
+		assert.Equal(t, 1, score.Level)
+		assert.Equal(t, DefaultPlayerMaxHP, score.MaxHP)
+	}
+
+	// Queries take no arguments
+	sendPacket(aliceConn, &Packet{EventName: LookEvent, EventBody: json.RawMessage(`{"at":"bob"}`)})
+	_, err = readEvent(alice, ErrorEvent)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	PongEvent = "PONG"
+
+	DefaultIdleTimeout  = 30 * time.Second
+	DefaultPingInterval = 10 * time.Second
+)
+
+// PingBody is the body of PING in both directions. The UE client sends an
+// empty string; the server sends a nonce, "nonce" in legacy form, which the
+// client echoes in its PONG so the round trip can be timed.
+type PingBody struct {
+	Nonce     uint64 `json:"nonce,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"` // Unix milliseconds
+}
+
+func (b *PingBody) UnmarshalLegacy(body string) error {
+	nonce, err := parseNonce(body)
+	b.Nonce = nonce
+	return err
+}
+
+func (b PingBody) LegacyString() string {
+	return formatNonce(b.Nonce)
+}
+
+// PongBody answers a PING with the nonce and timestamp it carried.
+type PongBody struct {
+	Nonce     uint64 `json:"nonce,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+}
+
+func (b *PongBody) UnmarshalLegacy(body string) error {
+	nonce, err := parseNonce(body)
+	b.Nonce = nonce
+	return err
+}
+
+func (b PongBody) LegacyString() string {
+	return formatNonce(b.Nonce)
+}
+
+func parseNonce(body string) (uint64, error) {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return 0, nil
+	}
+	nonce, err := strconv.ParseUint(body, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("nonce: %v", err)
+	}
+	return nonce, nil
+}
+
+func formatNonce(nonce uint64) string {
+	if nonce == 0 {
+		return ""
+	}
+	return strconv.FormatUint(nonce, 10)
+}
+
+func (s *Server) handlePing(session *Session, body *PingBody) error {
+	return session.SendEvent(PongEvent, PongBody{Nonce: body.Nonce, Timestamp: body.Timestamp})
+}
+
+// handlePong times the round trip of the server's last PING. Stale or
+// unsolicited PONGs are ignored.
+func (s *Server) handlePong(session *Session, body *PongBody) error {
+	if rtt, ok := session.recordPong(body.Nonce); ok {
+		logrus.Debug("Session ", session.id.String(), " round trip time ", rtt)
+	}
+	return nil
+}
+
+// keepAlive sends the session a PING every PingInterval until it closes.
+func (s *Server) keepAlive(session *Session) {
+	interval := time.Duration(s.config.PingInterval)
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			session.SendEvent(PingEvent, session.startPing())
+		case <-session.Done():
+			return
+		}
+	}
+}
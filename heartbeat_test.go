@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPingRepliesPong(t *testing.T) {
+	srv, addr := startTestServer(t)
+	conn, decoder := joinTestClient(t, srv, addr, "alice")
+
+	// The UE client's heartbeat
+	sendPacket(conn, &Packet{EventName: PingEvent, EventBody: json.RawMessage(`""`)})
+	packet, err := readEvent(decoder, PongEvent)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `""`, string(packet.EventBody))
+	}
+
+	sendPacket(conn, &Packet{EventName: PingEvent, EventBody: json.RawMessage(`{"nonce":5,"timestamp":1234}`)})
+	packet, err = readEvent(decoder, PongEvent)
+	if assert.NoError(t, err) {
+		var pong PongBody
+		assert.NoError(t, json.Unmarshal(packet.EventBody, &pong))
+		assert.Equal(t, PongBody{Nonce: 5, Timestamp: 1234}, pong)
+	}
+}
+
+func TestServerPingMeasuresRTT(t *testing.T) {
+	srv, addr := startTestServer(t, func(config *Config) {
+		config.PingInterval = Duration(200 * time.Millisecond)
+	})
+	conn, decoder := joinTestClient(t, srv, addr, "alice")
+	session, _ := srv.GetSessions().GetByAccount("alice")
+
+	packet, err := readEvent(decoder, PingEvent)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Zero(t, session.RTT())
+
+	// A PONG for some other PING is ignored
+	sendPacket(conn, &Packet{EventName: PongEvent, EventBody: json.RawMessage(`"999"`)})
+	sendPacket(conn, &Packet{EventName: PongEvent, EventBody: packet.EventBody})
+	assert.Eventually(t, func() bool { return session.RTT() > 0 }, time.Second, 5*time.Millisecond)
+}
+
+func TestIdleTimeoutDisconnects(t *testing.T) {
+	srv, addr := startTestServer(t, func(config *Config) {
+		config.IdleTimeout = Duration(100 * time.Millisecond)
+		config.PingInterval = 0
+		config.ResumeGracePeriod = 0
+	})
+	_, decoder := joinTestClient(t, srv, addr, "alice")
+
+	start := time.Now()
+	packet, err := readEvent(decoder, KickedEvent)
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(packet.EventBody), "idle timeout")
+		assert.GreaterOrEqual(t, int64(time.Since(start)), int64(50*time.Millisecond))
+	}
+	_, err = decoder.Decode()
+	assert.Equal(t, io.EOF, err)
+	assert.Eventually(t, func() bool { return srv.GetSessions().Count() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestIdleTimeoutResetByTraffic(t *testing.T) {
+	srv, addr := startTestServer(t, func(config *Config) {
+		config.IdleTimeout = Duration(150 * time.Millisecond)
+		config.PingInterval = 0
+	})
+	conn, decoder := joinTestClient(t, srv, addr, "alice")
+
+	for i := 0; i < 5; i++ {
+		time.Sleep(50 * time.Millisecond)
+		sendPacket(conn, &Packet{EventName: PingEvent, EventBody: json.RawMessage(`""`)})
+		_, err := readEvent(decoder, PongEvent)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, srv.GetSessions().Count())
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	HelloEvent = "HELLO"
+
+	// ProtocolVersion is the newest protocol version the server speaks, and
+	// MinProtocolVersion the oldest. Clients that send no HELLO speak 1.
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+
+	// Features a client can ask for in its HELLO
+	FeatureResume      = "resume"
+	FeatureCompression = "compression"
+	FeatureBinary      = "binary"
+)
+
+// ServerBuild identifies the server build in HELLO replies. Set it with
+// -ldflags "-X main.ServerBuild=..." when building a release.
+var ServerBuild = "dev"
+
+// HelloRequest is the first message of a connection, sent as a JSON object
+// in place of the bare token. It carries either a login Token or, to resume
+// a session, a ResumeToken and the last Seq received.
+type HelloRequest struct {
+	ProtocolVersion int      `json:"protocol_version"`
+	ClientBuild     string   `json:"client_build,omitempty" validate:"maxlen=64"`
+	Features        []string `json:"features,omitempty" validate:"maxlen=16"`
+	Token           string   `json:"token,omitempty"`
+	ResumeToken     string   `json:"resume_token,omitempty"`
+	LastSeq         uint64   `json:"last_seq,omitempty"`
+
+	// legacy is set when the client sent a bare token or RESUME command
+	// rather than a HELLO, and so expects no HELLO reply
+	legacy bool
+}
+
+// HelloReply answers a HELLO with the protocol version and the features the
+// connection will use: those the client asked for that the server supports.
+type HelloReply struct {
+	ProtocolVersion    int      `json:"protocol_version"`
+	MinProtocolVersion int      `json:"min_protocol_version"`
+	MaxProtocolVersion int      `json:"max_protocol_version"`
+	ServerBuild        string   `json:"server_build"`
+	Features           []string `json:"features"`
+}
+
+var helloRules = mustCompileRules(reflect.TypeOf(HelloRequest{}))
+
+func mustCompileRules(t reflect.Type) []fieldRule {
+	rules, err := compileRules(t)
+	if err != nil {
+		panic(err)
+	}
+	return rules
+}
+
+// parseHello reads the first message of a connection, which is a HELLO, or
+// from older clients a bare token or a RESUME command.
+func parseHello(message string) (*HelloRequest, error) {
+	message = strings.TrimSpace(message)
+
+	if !strings.HasPrefix(message, "{") {
+		// A bare token asks for no features. Only a client that sends RESUME
+		// knows about resuming, so only it is offered resume tokens.
+		hello := &HelloRequest{ProtocolVersion: 1, legacy: true}
+		if token, lastSeq, ok := parseResumeRequest(message); ok {
+			hello.ResumeToken, hello.LastSeq = token, lastSeq
+			hello.Features = []string{FeatureResume}
+		} else {
+			hello.Token = message
+		}
+		return hello, nil
+	}
+
+	// The version is checked first, as a HELLO of another version may well
+	// not fit HelloRequest
+	var version struct {
+		ProtocolVersion int `json:"protocol_version"`
+	}
+	if err := json.Unmarshal([]byte(message), &version); err != nil {
+		return nil, &PacketValidationError{msg: fmt.Sprintf("Invalid %s: %v", HelloEvent, err)}
+	}
+	if version.ProtocolVersion < MinProtocolVersion || version.ProtocolVersion > ProtocolVersion {
+		return nil, &VersionError{msg: fmt.Sprintf(
+			"Protocol version %d is not supported; this server speaks versions %d to %d",
+			version.ProtocolVersion, MinProtocolVersion, ProtocolVersion)}
+	}
+
+	var hello HelloRequest
+	decoder := json.NewDecoder(strings.NewReader(message))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&hello); err != nil {
+		return nil, &PacketValidationError{msg: fmt.Sprintf("Invalid %s: %v", HelloEvent, err)}
+	}
+	if err := validateRules(reflect.ValueOf(hello), helloRules); err != nil {
+		return nil, &PacketValidationError{msg: fmt.Sprintf("Invalid %s: %v", HelloEvent, err)}
+	}
+	if (hello.Token == "") == (hello.ResumeToken == "") {
+		return nil, &PacketValidationError{msg: fmt.Sprintf("Invalid %s: exactly one of token and resume_token is required", HelloEvent)}
+	}
+	return &hello, nil
+}
+
+// supportedFeatures lists the features this server can enable on conn.
+func (s *Server) supportedFeatures(conn net.Conn) map[string]bool {
+	// Binary and compressed payloads may contain newlines. Message transports
+	// have binary messages, but no length header to flag compression in.
+	_, messages := conn.(messageConn)
+	lengthPrefixed := !messages && s.config.FrameMode == LengthPrefixed
+
+	return map[string]bool{
+		FeatureResume:      s.config.ResumeGracePeriod > 0,
+		FeatureBinary:      messages || lengthPrefixed,
+		FeatureCompression: lengthPrefixed && s.config.CompressionThreshold > 0,
+	}
+}
+
+// negotiate picks the features of hello that the server supports on conn,
+// sorted.
+func (s *Server) negotiate(conn net.Conn, hello *HelloRequest) []string {
+	supported := s.supportedFeatures(conn)
+
+	features := []string{}
+	seen := make(map[string]bool)
+	for _, feature := range hello.Features {
+		if supported[feature] && !seen[feature] {
+			features = append(features, feature)
+			seen[feature] = true
+		}
+	}
+	sort.Strings(features)
+	return features
+}
+
+// greet settles the features of a new session and answers the client's
+// HELLO, before anything else is sent to it. Clients that sent no HELLO are
+// not answered.
+func (s *Server) greet(session *Session, hello *HelloRequest) {
+	session.setHello(hello, s.negotiate(session.conn, hello))
+	if hello.legacy {
+		return
+	}
+	logrus.Debug("Session ", session.id.String(), " speaks protocol ", hello.ProtocolVersion,
+		" from client build ", hello.ClientBuild, " with features ", session.Features())
+
+	reply := HelloReply{
+		ProtocolVersion:    hello.ProtocolVersion,
+		MinProtocolVersion: MinProtocolVersion,
+		MaxProtocolVersion: ProtocolVersion,
+		ServerBuild:        ServerBuild,
+		Features:           session.Features(),
+	}
+	body, _ := json.Marshal(reply)
+	if err := session.writeFirst(&Packet{EventName: HelloEvent, EventBody: body}); err != nil {
+		logrus.Error("Error writing HELLO to session ", session.id.String(), ": ", err)
+		session.Close()
+	}
+
+	// Everything after the reply is sent as agreed
+	session.encoder.SetCodec(session.Codec())
+	if session.HasFeature(FeatureCompression) {
+		session.encoder.EnableCompression(s.config.CompressionThreshold, s.compression)
+	}
+}
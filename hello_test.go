@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// dialHello connects to addr and sends hello as the first message.
+func dialHello(t *testing.T, addr string, hello HelloRequest) (net.Conn, *PacketDecoder) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to the server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	message, _ := json.Marshal(hello)
+	conn.Write(message)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	return conn, NewPacketDecoder(conn, LengthPrefixed, DefaultMaxFrameSize)
+}
+
+func TestParseHello(t *testing.T) {
+	hello, err := parseHello("eyJhbGciOiJIUzI1NiJ9.e30.sig")
+	if assert.NoError(t, err) {
+		assert.True(t, hello.legacy)
+		assert.Equal(t, 1, hello.ProtocolVersion)
+		assert.Equal(t, "eyJhbGciOiJIUzI1NiJ9.e30.sig", hello.Token)
+		assert.Empty(t, hello.Features, "a bare token does not ask to resume")
+	}
+
+	hello, err = parseHello("RESUME abc 7")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "abc", hello.ResumeToken)
+		assert.Equal(t, uint64(7), hello.LastSeq)
+		assert.Equal(t, []string{FeatureResume}, hello.Features)
+	}
+
+	hello, err = parseHello(`{"protocol_version":1,"client_build":"ue-1.2","features":["binary"],"token":"t"}`)
+	if assert.NoError(t, err) {
+		assert.False(t, hello.legacy)
+		assert.Equal(t, "ue-1.2", hello.ClientBuild)
+		assert.Equal(t, []string{FeatureBinary}, hello.Features)
+	}
+
+	for _, message := range []string{
+		`{"protocol_version":1}`,
+		`{"protocol_version":1,"token":"t","resume_token":"r"}`,
+		`{"protocol_version":1,"token":"t","colour":"blue"}`,
+		`{"protocol_version":1,"token":`,
+	} {
+		_, err := parseHello(message)
+		if assert.Error(t, err, message) {
+			assert.Equal(t, ErrCodeInvalidPacket, err.(ProtocolError).Code(), message)
+		}
+	}
+
+	_, err = parseHello(`{"protocol_version":99,"token":"t"}`)
+	if assert.Error(t, err) {
+		assert.Equal(t, ErrCodeVersion, err.(ProtocolError).Code())
+		assert.Contains(t, err.Error(), "Protocol version 99 is not supported")
+	}
+
+	// A missing version is unsupported like any other, and so is a newer one
+	// whatever else its HELLO holds
+	for _, message := range []string{
+		`{"token":"t"}`,
+		`{"protocol_version":0,"token":"t"}`,
+		`{"protocol_version":-1,"token":"t"}`,
+		`{"protocol_version":2,"token":"t","session":{"id":1}}`,
+	} {
+		_, err := parseHello(message)
+		if assert.Error(t, err, message) {
+			assert.Equal(t, ErrCodeVersion, err.(ProtocolError).Code(), message)
+		}
+	}
+}
+
+// dialRaw connects to addr and writes each of writes in turn, pausing
+// between them so that they arrive as separate reads.
+func dialRaw(t *testing.T, addr string, writes ...[]byte) (net.Conn, *PacketDecoder) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to the server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	for i, data := range writes {
+		if i > 0 {
+			time.Sleep(50 * time.Millisecond)
+		}
+		conn.Write(data)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	return conn, NewPacketDecoder(conn, LengthPrefixed, DefaultMaxFrameSize)
+}
+
+func TestHelloCoalescedWithPacket(t *testing.T) {
+	srv, addr := startTestServer(t)
+	hello, _ := json.Marshal(HelloRequest{ProtocolVersion: ProtocolVersion, Token: testToken(t, "alice")})
+	ping := &Packet{EventName: PingEvent, EventBody: json.RawMessage(`{"nonce":7}`)}
+
+	var framed bytes.Buffer
+	NewFrameWriter(&framed, LengthPrefixed, 0).WriteFrame(hello)
+	NewPacketEncoder(&framed, LengthPrefixed, 0).Encode(ping)
+
+	var unframed bytes.Buffer
+	unframed.Write(hello)
+	NewPacketEncoder(&unframed, LengthPrefixed, 0).Encode(ping)
+
+	// The PING arrives in the same read as the HELLO, and is still answered
+	for name, data := range map[string][]byte{"framed": framed.Bytes(), "unframed": unframed.Bytes()} {
+		_, decoder := dialRaw(t, addr, data)
+		_, err := readEvent(decoder, HelloEvent)
+		assert.NoError(t, err, name)
+
+		packet, err := readEvent(decoder, PongEvent)
+		if assert.NoError(t, err, name) {
+			assert.JSONEq(t, `7`, string(mustField(t, packet.EventBody, "nonce")), name)
+		}
+
+		session, _ := srv.GetSessions().GetByAccount("alice")
+		session.Close()
+		assert.Eventually(t, func() bool { return srv.GetSessions().Count() == 0 }, time.Second, 10*time.Millisecond)
+	}
+}
+
+func TestHelloSplitAcrossWrites(t *testing.T) {
+	srv, addr := startTestServer(t)
+	hello, _ := json.Marshal(HelloRequest{ProtocolVersion: ProtocolVersion, Token: testToken(t, "alice")})
+
+	var framed bytes.Buffer
+	NewFrameWriter(&framed, LengthPrefixed, 0).WriteFrame(hello)
+
+	for name, data := range map[string][]byte{"framed": framed.Bytes(), "unframed": hello} {
+		half := len(data) / 2
+		_, decoder := dialRaw(t, addr, data[:half], data[half:])
+		_, err := readEvent(decoder, HelloEvent)
+		assert.NoError(t, err, name)
+
+		session, ok := srv.GetSessions().GetByAccount("alice")
+		if assert.True(t, ok, name) {
+			session.Close()
+		}
+		assert.Eventually(t, func() bool { return srv.GetSessions().Count() == 0 }, time.Second, 10*time.Millisecond)
+	}
+}
+
+func TestHelloNegotiatesFeatures(t *testing.T) {
+	srv, addr := startTestServer(t)
+
+	_, decoder := dialHello(t, addr, HelloRequest{
+		ProtocolVersion: ProtocolVersion,
+		ClientBuild:     "test-client",
+		Features:        []string{"teleport", FeatureResume, FeatureResume},
+		Token:           testToken(t, "alice"),
+	})
+
+	packet, err := decoder.Decode()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, HelloEvent, packet.EventName, "the reply comes first")
+	assert.Zero(t, packet.Seq)
+
+	var reply HelloReply
+	assert.NoError(t, json.Unmarshal(packet.EventBody, &reply))
+	assert.Equal(t, HelloReply{
+		ProtocolVersion:    ProtocolVersion,
+		MinProtocolVersion: MinProtocolVersion,
+		MaxProtocolVersion: ProtocolVersion,
+		ServerBuild:        ServerBuild,
+		Features:           []string{FeatureResume},
+	}, reply)
+
+	_, notice := readSessionNotice(t, decoder)
+	assert.NotEmpty(t, notice.ResumeToken)
+
+	session, _ := srv.GetSessions().GetByAccount("alice")
+	assert.Equal(t, "test-client", session.ClientBuild())
+	assert.True(t, session.HasFeature(FeatureResume))
+	assert.False(t, session.HasFeature("teleport"))
+}
+
+func TestHelloWithoutResume(t *testing.T) {
+	srv, addr := startTestServer(t)
+
+	_, decoder := dialHello(t, addr, HelloRequest{ProtocolVersion: ProtocolVersion, Token: testToken(t, "alice")})
+	packet, err := readEvent(decoder, HelloEvent)
+	if assert.NoError(t, err) {
+		assert.JSONEq(t, `[]`, string(mustField(t, packet.EventBody, "features")))
+	}
+
+	// A client that did not ask to resume sessions is sent no resume token,
+	// and as it spoke HELLO it is sent JSON bodies
+	packet, err = readEvent(decoder, SpawnPlayerEvent)
+	if assert.NoError(t, err) {
+		assert.JSONEq(t, `"alice"`, string(mustField(t, packet.EventBody, "name")))
+	}
+	session, _ := srv.GetSessions().GetByAccount("alice")
+	assert.Empty(t, session.getResumeToken())
+}
+
+func TestHelloRejectsVersion(t *testing.T) {
+	srv, addr := startTestServer(t)
+
+	_, decoder := dialHello(t, addr, HelloRequest{ProtocolVersion: ProtocolVersion + 1, Token: testToken(t, "alice")})
+	packet, err := decoder.Decode()
+	if assert.NoError(t, err) {
+		assert.Equal(t, ErrorEvent, packet.EventName)
+
+		var notice ErrorNotice
+		assert.NoError(t, json.Unmarshal(packet.EventBody, &notice))
+		assert.Equal(t, ErrCodeVersion, notice.Code)
+		assert.Contains(t, notice.Message, "is not supported")
+	}
+	_, err = decoder.Decode()
+	assert.Equal(t, io.EOF, err)
+	assert.Zero(t, srv.GetSessions().Count())
+}
+
+func TestHelloRejectsToken(t *testing.T) {
+	srv, addr := startTestServer(t)
+
+	_, decoder := dialHello(t, addr, HelloRequest{ProtocolVersion: ProtocolVersion, Token: "not-a-token"})
+	packet, err := decoder.Decode()
+	if assert.NoError(t, err) {
+		assert.Equal(t, ErrorEvent, packet.EventName)
+
+		var notice ErrorNotice
+		assert.NoError(t, json.Unmarshal(packet.EventBody, &notice))
+		assert.Equal(t, ErrCodeUnauthorized, notice.Code)
+	}
+	_, err = decoder.Decode()
+	assert.Equal(t, io.EOF, err)
+	assert.Zero(t, srv.GetSessions().Count())
+}
+
+func TestHelloResume(t *testing.T) {
+	srv, addr := startTestServer(t)
+
+	conn, decoder := dialHello(t, addr, HelloRequest{
+		ProtocolVersion: ProtocolVersion,
+		Features:        []string{FeatureResume},
+		Token:           testToken(t, "alice"),
+	})
+	sessionPacket, notice := readSessionNotice(t, decoder)
+	conn.Close()
+	assert.Eventually(t, func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return len(srv.parked) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	_, decoder = dialHello(t, addr, HelloRequest{
+		ProtocolVersion: ProtocolVersion,
+		Features:        []string{FeatureResume},
+		ResumeToken:     notice.ResumeToken,
+		LastSeq:         sessionPacket.Seq,
+	})
+	packet, err := decoder.Decode()
+	if assert.NoError(t, err) {
+		assert.Equal(t, HelloEvent, packet.EventName, "the reply comes before the replay")
+	}
+	_, resumed := readSessionNotice(t, decoder)
+	assert.True(t, resumed.Resumed)
+	assert.Equal(t, notice.SessionID, resumed.SessionID)
+}
+
+func mustField(t *testing.T, body json.RawMessage, name string) json.RawMessage {
+	t.Helper()
+
+	var fields map[string]json.RawMessage
+	if !assert.NoError(t, json.Unmarshal(body, &fields)) {
+		t.FailNow()
+	}
+	return fields[name]
+}
@@ -1,103 +1,64 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
-	"net"
 	"os"
 	"os/signal"
-	"strconv"
-	"sync"
 	"syscall"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/time/rate"
-)
-
-const (
-	ConnTimeout         = 20 * time.Second
-	KeepAlivePeriod     = 5 * time.Minute
-	ServerAddress       = ":8080"
-	MaxConnectionsPerSec = 5
-	MaxPacketsPerSec     = 20
 )
 
+// Packet is the unit exchanged with clients. ID is an optional request ID
+// chosen by the client and Seq an optional, increasing sequence number. A
+// packet carrying either is answered with ACK or NACK, retries of it are
+// recognised, and ID is echoed in any ERROR caused by the packet.
+//
+// Packets sent by the server carry their own Seq when sessions can be
+// resumed; a resuming client reports the last one it received.
 type Packet struct {
+	ID        string          `json:"id,omitempty"`
+	Seq       uint64          `json:"seq,omitempty"`
 	EventName string          `json:"event_name"`
 	EventBody json.RawMessage `json:"event_body"`
 }
 
-type JwtClaims struct {
-	jwt.StandardClaims
-}
-
-type EventHandler func(eventBody json.RawMessage)
+// EventHandler handles one packet. A returned error is reported to the
+// client as an ERROR event; see ProtocolError.
+type EventHandler func(session *Session, eventBody json.RawMessage) error
 
-var jwtSecret = []byte("your_jwt_secret")
-var eventRegistry = make(map[string]EventHandler)
-var connectionLimiter = rate.NewLimiter(rate.Limit(MaxConnectionsPerSec), MaxConnectionsPerSec)
-var packetLimiter = rate.NewLimiter(rate.Limit(MaxPacketsPerSec), MaxPacketsPerSec)
-
-func registerEventHandler(eventName string, handler EventHandler) {
-	eventRegistry[eventName] = handler
+// RegisterEventHandler routes packets named eventName to handler, wrapped in
+// the given per-event middleware. It may be called while the server is
+// running.
+func (s *Server) RegisterEventHandler(eventName string, handler EventHandler, middleware ...Middleware) {
+	s.events.Register(eventName, handler, middleware...)
 }
 
-func HandleConnection(conn net.Conn, wg *sync.WaitGroup) {
-	defer wg.Done()
-
-	err := authenticateConnection(conn)
-	if err != nil {
-		logrus.Error("Authentication error: ", err)
-		conn.Close()
-		return
-	}
-
-	processConnection(conn)
+// RegisterTypedHandler routes packets named eventName to a
+// func(*Session, *T) error; see EventRegistry.RegisterTyped.
+func (s *Server) RegisterTypedHandler(eventName string, handler interface{}, middleware ...Middleware) error {
+	return s.events.RegisterTyped(eventName, handler, middleware...)
 }
 
-func authenticateConnection(conn net.Conn) error {
-	conn.SetDeadline(time.Now().Add(ConnTimeout))
-
-	buf := make([]byte, 4096)
-	n, err := conn.Read(buf)
-	if err != nil {
-		return err
-	}
-
-	token, err := jwt.ParseWithClaims(string(buf[:n]), &JwtClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
-
-	if err != nil {
-		return err
-	}
-
-	if !token.Valid {
-		return fmt.Errorf("invalid JWT")
-	}
-
-	return nil
-}
-
-// Add a custom error type for packet validation errors
-type PacketValidationError struct {
-	msg string
+// Use adds middleware around every event handler.
+func (s *Server) Use(middleware ...Middleware) {
+	s.events.Use(middleware...)
 }
 
-func (e *PacketValidationError) Error() string {
-	return e.msg
+func (s *Server) eventHandler(eventName string) (EventHandler, bool) {
+	return s.events.Lookup(eventName)
 }
 
-func validatePacket(packet *Packet) error {
+func (s *Server) validatePacket(packet *Packet) error {
 	if packet.EventName == "" {
 		return &PacketValidationError{msg: "Event name is missing"}
 	}
 
-	handler, ok := eventRegistry[packet.EventName]
-	if !ok {
+	if _, ok := s.eventHandler(packet.EventName); !ok {
 		return &PacketValidationError{msg: fmt.Sprintf("Unknown event: %s", packet.EventName)}
 	}
 
@@ -105,153 +66,110 @@ func validatePacket(packet *Packet) error {
 		return &PacketValidationError{msg: "Event body is missing"}
 	}
 
-	// Add additional validation checks for specific events if needed
-	// For example, you can unmarshal EventBody into a specific struct and check if required fields are set
-
+	// Bodies of typed handlers are decoded and validated by the registry
 	return nil
 }
 
-func processConnection(conn net.Conn) {
-    defer conn.Close() // Ensure the connection is closed
-
-    conn.SetDeadline(time.Time{})
-    conn.SetKeepAlive(true)
-    conn.SetKeepAlivePeriod(KeepAlivePeriod)
-
-    buf := make([]byte, 4096)
-    for {
-        if !packetLimiter.Allow() {
-            logrus.Warn("Packet rate limit exceeded")
-            continue
-        }
-
-        n, err := conn.Read(buf)
-        if err != nil {
-            if err == io.EOF {
-                logrus.Info("Client disconnected")
-                return
-            }
-            logrus.Error("Error reading packet: ", err)
-            return
-        }
-
-        var packet Packet
-        err = json.Unmarshal(buf[:n], &packet)
-        if err != nil {
-            logrus.Error("Error parsing packet: ", err)
-            return
-        }
-
-        err = validatePacket(&packet)
-        if err != nil {
-            logrus.Warn("Invalid packet: ", err)
-            continue
-        }
+// applyRateLimit notifies the client of a rate limit violation and applies
+// delay penalties. It returns false when the session must be disconnected;
+// dropped packets are left for the caller to skip.
+func applyRateLimit(session *Session, result RateLimitResult) bool {
+	if result.Action == RateLimitAllow {
+		return true
+	}
 
-        go handlePacket(packet)
-    }
+	notice := RateLimitNotice{
+		Reason:       result.Reason,
+		Action:       result.Action.String(),
+		RetryAfterMs: result.Delay.Milliseconds(),
+		Violations:   result.Violations,
+	}
+	session.Send(RateLimitedEvent, notice)
+
+	switch result.Action {
+	case RateLimitWarn:
+		logrus.Warn("Packet rate limit exceeded for session ", session.id.String(), " (", result.Reason, ")")
+	case RateLimitDisconnect:
+		logrus.Warn("Disconnecting session ", session.id.String(), " after ", result.Violations, " rate limit violations")
+		return false
+	case RateLimitDelay:
+		select {
+		case <-time.After(result.Delay):
+		case <-session.Done():
+			return false
+		}
+	}
+	return true
 }
 
-func handlePacket(packet Packet) {
-	handler, ok := eventRegistry[packet.EventName]
+func (s *Server) handlePacket(session *Session, packet Packet) error {
+	handler, ok := s.eventHandler(packet.EventName)
 	if !ok {
-		logrus.Warn("Unknown event: ", packet.EventName)
-		return
+		return &PacketValidationError{msg: fmt.Sprintf("Unknown event: %s", packet.EventName)}
 	}
 
-	handler(packet.EventBody)
+	return handler(session, packet.EventBody)
 }
 
-// Read environment variables and provide default values
-func getEnv(key, fallback string) string {
-	value := os.Getenv(key)
-	if len(value) == 0 {
-		return fallback
-	}
-	return value
-}
+func main() {
+	dumpSchema := flag.Bool("dump-schema", false, "print the schema of every event as JSON and exit")
+	flag.Parse()
 
-func getEnvInt(key string, fallback int) int {
-	value := os.Getenv(key)
-	if len(value) == 0 {
-		return fallback
-	}
-	intValue, err := strconv.Atoi(value)
+	config, err := LoadConfig(os.Getenv("CONFIG_FILE"))
 	if err != nil {
-		return fallback
+		logrus.Fatal(err)
 	}
-	return intValue
-}
-
-func main() {
-
-		// Set variables from environment variables or use default values
-		jwtSecret := []byte(getEnv("JWT_SECRET", "your_jwt_secret"))
-		ServerAddress := getEnv("SERVER_ADDRESS", ":8080")
-		ConnTimeout := time.Duration(getEnvInt("CONN_TIMEOUT", 20)) * time.Second
-		KeepAlivePeriod := time.Duration(getEnvInt("KEEP_ALIVE_PERIOD", 5)) * time.Minute
-		maxConnectionsPerSec := getEnvInt("MAX_CONNECTIONS_PER_SEC", 5)
-		maxPacketsPerSec := getEnvInt("MAX_PACKETS_PER_SEC", 20)
-	
-		connectionLimiter := rate.NewLimiter(rate.Limit(maxConnectionsPerSec), maxConnectionsPerSec)
-		packetLimiter := rate.NewLimiter(rate.Limit(maxPacketsPerSec), maxPacketsPerSec)
-	
-
-	registerEventHandler("event1", func(eventBody json.RawMessage) {
-		// Handle event1
-	})
 
-	registerEventHandler("event2", func(eventBody json.RawMessage) {
-		// Handle event2
-	})
-
-	ln, err := net.Listen("tcp", ServerAddress)
+	server, err := NewServer(config)
 	if err != nil {
 		logrus.Fatal(err)
 	}
 
-	logrus.Info("Server listening on ", ServerAddress)
+	if *dumpSchema {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(server.events.Schemas()); err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	}
 
 	// Set up signal handling for graceful shutdown
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
-	done := make(chan struct{})
 
-	var wg sync.WaitGroup
+	// Reload verification keys and TLS certificates on SIGHUP so they can be
+	// rotated without a restart
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
 
-	go func() {
-		<-shutdown
-		logrus.Info("Shutting down server...")
-
-		// Stop accepting new connections
-		ln.Close()
-
-		// Cancel ongoing connections
-		wg.Wait()
-		close(done)
-	}()
+	if err := server.Start(); err != nil {
+		logrus.Fatal(err)
+	}
 
+wait:
 	for {
-		if !connectionLimiter.Allow() {
-			logrus.Warn("Connection rate limit exceeded")
-			time.Sleep(100 * time.Millisecond) // Sleep for a short duration before trying again
-			continue
-		}
-
-		conn, err := ln.Accept()
-		if err != nil {
-			if opErr, ok := err.(*net.OpError); ok && opErr.Op == "accept" {
-				logrus.Info("Server stopped accepting new connections")
-				break
+		select {
+		case <-reload:
+			if err := server.ReloadKeys(); err != nil {
+				logrus.Error("Error reloading token keys: ", err)
 			}
-			logrus.Error("Error accepting connection: ", err)
-			continue
+			if err := server.ReloadCertificates(); err != nil {
+				logrus.Error("Error reloading TLS certificates: ", err)
+			}
+		case <-shutdown:
+			break wait
 		}
+	}
 
-		wg.Add(1)
-		go HandleConnection(conn, &wg)
+	logrus.Info("Shutting down server...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.ShutdownTimeout))
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		logrus.Warn("Forced shutdown: ", err)
 	}
 
-	<-done
 	logrus.Info("Server gracefully stopped")
-}
\ No newline at end of file
+}
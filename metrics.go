@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Metrics
+//
+// With MetricsConfig.Address set the server serves its counters over HTTP in
+// the Prometheus text exposition format, for Prometheus or anything else
+// that scrapes it. The endpoint is plain HTTP without authentication and is
+// meant for a private port.
+
+const (
+	DefaultMetricsPath = "/metrics"
+
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+	// otherEvent stands in for event names without a handler, so a client
+	// cannot create a series per name it makes up
+	otherEvent = "other"
+)
+
+var (
+	// latencyBuckets are the upper bounds, in seconds, of the handler
+	// latency histograms
+	latencyBuckets = []float64{.0001, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+	// queueDepthBuckets are the upper bounds of the outbound queue depth
+	// histogram, up to SendQueueSize
+	queueDepthBuckets = []float64{0, 1, 2, 4, 8, 16, 32, SendQueueSize}
+)
+
+// Histogram counts observations into buckets by upper bound. It is not safe
+// for concurrent use; its owner locks around it.
+type Histogram struct {
+	bounds []float64
+	counts []uint64 // per bucket, the last one for values above every bound
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *Histogram) observe(value float64) {
+	i := sort.SearchFloat64s(h.bounds, value)
+	h.counts[i]++
+	h.count++
+	h.sum += value
+}
+
+// snapshot returns a copy of h that h can go on changing under.
+func (h *Histogram) snapshot() Histogram {
+	snapshot := *h
+	snapshot.counts = append([]uint64(nil), h.counts...)
+	return snapshot
+}
+
+func (h Histogram) Count() uint64 {
+	return h.count
+}
+
+func (h Histogram) Sum() float64 {
+	return h.sum
+}
+
+// ServerMetrics counts what happens to the connections and packets of a
+// server, beyond the handler stats EventMetrics keeps. Its methods do
+// nothing on a nil *ServerMetrics, as for sessions made outside a server.
+type ServerMetrics struct {
+	mu                  sync.Mutex
+	connectionsAccepted uint64
+	connectionsRejected map[string]uint64 // by reason
+	authFailures        map[string]uint64 // by reason
+	packetsReceived     map[string]uint64 // by event name
+	packetsSent         map[string]uint64 // by event name
+	rateLimitDrops      map[string]uint64 // by limit
+	queueDepth          *Histogram
+}
+
+func NewServerMetrics() *ServerMetrics {
+	return &ServerMetrics{
+		connectionsRejected: make(map[string]uint64),
+		authFailures:        make(map[string]uint64),
+		packetsReceived:     make(map[string]uint64),
+		packetsSent:         make(map[string]uint64),
+		rateLimitDrops:      make(map[string]uint64),
+		queueDepth:          newHistogram(queueDepthBuckets),
+	}
+}
+
+func (m *ServerMetrics) add(counters map[string]uint64, key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counters[key]++
+}
+
+func (m *ServerMetrics) connectionAccepted() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.connectionsAccepted++
+}
+
+// connectionRejected counts a connection refused before its handshake,
+// because of the connection limits or a shutdown.
+func (m *ServerMetrics) connectionRejected(reason string) {
+	if m != nil {
+		m.add(m.connectionsRejected, reason)
+	}
+}
+
+// authFailed counts a connection that could not log in: a bad handshake,
+// token or resume token, or a login refused by the LoginPolicy.
+func (m *ServerMetrics) authFailed(reason string) {
+	if m != nil {
+		m.add(m.authFailures, reason)
+	}
+}
+
+func (m *ServerMetrics) packetReceived(eventName string) {
+	if m != nil {
+		m.add(m.packetsReceived, eventName)
+	}
+}
+
+// packetSent counts a packet queued for a client, and how many were queued
+// for it with the packet.
+func (m *ServerMetrics) packetSent(eventName string, queueDepth int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.packetsSent[eventName]++
+	m.queueDepth.observe(float64(queueDepth))
+}
+
+// rateLimitDropped counts a packet discarded by a rate limit: the packets or
+// bytes limit of a session, or the event limit of a handler.
+func (m *ServerMetrics) rateLimitDropped(limit string) {
+	if m != nil {
+		m.add(m.rateLimitDrops, limit)
+	}
+}
+
+// metricsSnapshot is a copy of ServerMetrics taken for one scrape.
+type metricsSnapshot struct {
+	connectionsAccepted uint64
+	connectionsRejected map[string]uint64
+	authFailures        map[string]uint64
+	packetsReceived     map[string]uint64
+	packetsSent         map[string]uint64
+	rateLimitDrops      map[string]uint64
+	queueDepth          Histogram
+}
+
+func (m *ServerMetrics) snapshot() metricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	copyCounters := func(counters map[string]uint64) map[string]uint64 {
+		copied := make(map[string]uint64, len(counters))
+		for key, value := range counters {
+			copied[key] = value
+		}
+		return copied
+	}
+	return metricsSnapshot{
+		connectionsAccepted: m.connectionsAccepted,
+		connectionsRejected: copyCounters(m.connectionsRejected),
+		authFailures:        copyCounters(m.authFailures),
+		packetsReceived:     copyCounters(m.packetsReceived),
+		packetsSent:         copyCounters(m.packetsSent),
+		rateLimitDrops:      copyCounters(m.rateLimitDrops),
+		queueDepth:          m.queueDepth.snapshot(),
+	}
+}
+
+// metricsWriter writes metric families in the Prometheus text format.
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+func (mw *metricsWriter) family(name, kind, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one value; labels are name and value pairs.
+func (mw *metricsWriter) sample(name string, value float64, labels ...string) {
+	mw.w.WriteString(name)
+	if len(labels) > 0 {
+		mw.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				mw.w.WriteByte(',')
+			}
+			mw.w.WriteString(labels[i] + `="` + escapeLabel(labels[i+1]) + `"`)
+		}
+		mw.w.WriteByte('}')
+	}
+	mw.w.WriteString(" " + formatValue(value) + "\n")
+}
+
+func (mw *metricsWriter) gauge(name, help string, value float64) {
+	mw.family(name, "gauge", help)
+	mw.sample(name, value)
+}
+
+func (mw *metricsWriter) counter(name, help string, value uint64) {
+	mw.family(name, "counter", help)
+	mw.sample(name, float64(value))
+}
+
+// counters writes a counter family with one series per label value, sorted.
+func (mw *metricsWriter) counters(name, help, label string, values map[string]uint64) {
+	mw.family(name, "counter", help)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		mw.sample(name, float64(values[key]), label, key)
+	}
+}
+
+// histogram writes the cumulative buckets, sum and count of h.
+func (mw *metricsWriter) histogram(name string, h Histogram, labels ...string) {
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		mw.sample(name+"_bucket", float64(cumulative), append(labels, "le", formatValue(bound))...)
+	}
+	mw.sample(name+"_bucket", float64(h.count), append(labels, "le", "+Inf")...)
+	mw.sample(name+"_sum", h.sum, labels...)
+	mw.sample(name+"_count", float64(h.count), labels...)
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+// WriteMetrics writes every metric of the server to w in the Prometheus text
+// format.
+func (s *Server) WriteMetrics(w io.Writer) error {
+	mw := &metricsWriter{w: bufio.NewWriter(w)}
+	snapshot := s.metrics.snapshot()
+
+	mw.counter("mud_connections_accepted_total", "Connections admitted on any transport.", snapshot.connectionsAccepted)
+	mw.counters("mud_connections_rejected_total", "Connections refused by the connection limits or a shutdown.", "reason", snapshot.connectionsRejected)
+	mw.counters("mud_auth_failures_total", "Connections that failed to log in.", "reason", snapshot.authFailures)
+	mw.counters("mud_packets_received_total", "Packets received from clients.", "event", snapshot.packetsReceived)
+	mw.counters("mud_packets_sent_total", "Packets queued for clients.", "event", snapshot.packetsSent)
+	mw.counters("mud_rate_limit_drops_total", "Packets discarded by a rate limit.", "limit", snapshot.rateLimitDrops)
+
+	mw.family("mud_outbound_queue_depth", "histogram", "Packets waiting in a session's send queue, including the one just queued.")
+	mw.histogram("mud_outbound_queue_depth", snapshot.queueDepth)
+
+	// The queues as they stand now, as the histogram only sees them grow
+	var queued, deepest int
+	s.sessions.ForEach(func(session *Session) bool {
+		depth := len(session.outbound)
+		queued += depth
+		if depth > deepest {
+			deepest = depth
+		}
+		return true
+	})
+	mw.gauge("mud_outbound_queued", "Packets waiting in the send queues of all sessions.", float64(queued))
+	mw.gauge("mud_outbound_queue_depth_max", "Packets waiting in the fullest send queue of any session.", float64(deepest))
+
+	events := s.eventMetrics.Events()
+	mw.family("mud_handler_calls_total", "counter", "Event handler calls for packets from clients.")
+	for _, name := range events {
+		stats, _ := s.eventMetrics.Get(name)
+		mw.sample("mud_handler_calls_total", float64(stats.Count), "event", name)
+	}
+	mw.family("mud_handler_errors_total", "counter", "Event handler calls that returned an error.")
+	for _, name := range events {
+		stats, _ := s.eventMetrics.Get(name)
+		mw.sample("mud_handler_errors_total", float64(stats.Errors), "event", name)
+	}
+	mw.family("mud_handler_duration_seconds", "histogram", "Event handler latency.")
+	for _, name := range events {
+		if latency, ok := s.eventMetrics.Latency(name); ok {
+			mw.histogram("mud_handler_duration_seconds", latency, "event", name)
+		}
+	}
+
+	sent, received := s.compression.Sent(), s.compression.Received()
+	mw.family("mud_compressed_frames_total", "counter", "Frames deflated for clients or inflated from them.")
+	mw.sample("mud_compressed_frames_total", float64(sent.Frames), "direction", "sent")
+	mw.sample("mud_compressed_frames_total", float64(received.Frames), "direction", "received")
+	mw.family("mud_compression_raw_bytes_total", "counter", "Payload bytes of compressed frames before compression.")
+	mw.sample("mud_compression_raw_bytes_total", float64(sent.RawBytes), "direction", "sent")
+	mw.sample("mud_compression_raw_bytes_total", float64(received.RawBytes), "direction", "received")
+	mw.family("mud_compression_wire_bytes_total", "counter", "Payload bytes of compressed frames after compression.")
+	mw.sample("mud_compression_wire_bytes_total", float64(sent.WireBytes), "direction", "sent")
+	mw.sample("mud_compression_wire_bytes_total", float64(received.WireBytes), "direction", "received")
+
+	mw.gauge("mud_sessions", "Sessions logged in, including those held for resumption.", float64(s.sessions.Count()))
+	mw.family("mud_players", "gauge", "Players on each map.")
+	for _, m := range s.world.Maps() {
+		mw.sample("mud_players", float64(len(m.GetPlayers())), "map", m.GetName())
+	}
+	mw.gauge("mud_goroutines", "Goroutines in the process.", float64(runtime.NumGoroutine()))
+
+	return mw.w.Flush()
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", metricsContentType)
+	if err := s.WriteMetrics(w); err != nil {
+		logrus.Warn("Error writing metrics to ", r.RemoteAddr, ": ", err)
+	}
+}
+
+// startMetrics serves the metrics endpoint in the background if it is
+// configured.
+func (s *Server) startMetrics() error {
+	if s.config.Metrics.Address == "" {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", s.config.Metrics.Address)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(s.config.Metrics.Path, s.handleMetrics)
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: time.Duration(s.config.ConnTimeout),
+	}
+
+	s.mu.Lock()
+	s.metricsServer = server
+	s.metricsListener = ln
+	s.mu.Unlock()
+
+	logrus.Info("Metrics served on ", ln.Addr().String(), s.config.Metrics.Path)
+	go server.Serve(ln)
+	return nil
+}
+
+// MetricsAddr returns the address the metrics endpoint listens on, or nil
+// when it is not running.
+func (s *Server) MetricsAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.metricsListener == nil {
+		return nil
+	}
+	return s.metricsListener.Addr()
+}
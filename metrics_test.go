@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogramFormat(t *testing.T) {
+	h := newHistogram([]float64{0.5, 1})
+	for _, value := range []float64{0.1, 0.5, 0.7, 3} {
+		h.observe(value)
+	}
+
+	var buf bytes.Buffer
+	mw := &metricsWriter{w: bufio.NewWriter(&buf)}
+	mw.histogram("latency", h.snapshot(), "event", `say "hi"`)
+	mw.w.Flush()
+
+	assert.Equal(t, `latency_bucket{event="say \"hi\"",le="0.5"} 2
+latency_bucket{event="say \"hi\"",le="1"} 3
+latency_bucket{event="say \"hi\"",le="+Inf"} 4
+latency_sum{event="say \"hi\""} 4.3
+latency_count{event="say \"hi\""} 4
+`, buf.String())
+}
+
+// scrapeMetrics fetches the metrics endpoint of srv and returns its samples
+// by series.
+func scrapeMetrics(t *testing.T, srv *Server) map[string]string {
+	t.Helper()
+
+	response, err := http.Get("http://" + srv.MetricsAddr().String() + DefaultMetricsPath)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer response.Body.Close()
+	assert.Equal(t, metricsContentType, response.Header.Get("Content-Type"))
+
+	body, _ := io.ReadAll(response.Body)
+	return parseMetrics(string(body))
+}
+
+// parseMetrics returns the samples of a text exposition by series.
+func parseMetrics(text string) map[string]string {
+	samples := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		samples[line[:i]] = line[i+1:]
+	}
+	return samples
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	srv, addr := startTestServer(t, func(config *Config) {
+		config.Metrics.Address = "127.0.0.1:0"
+		config.RateLimit.PacketsPerSec = 1
+		config.RateLimit.PacketBurst = 1
+	})
+	conn, decoder := joinTestClient(t, srv, addr, "alice")
+
+	bad, err := net.Dial("tcp", addr)
+	if assert.NoError(t, err) {
+		bad.Write([]byte("not a token"))
+		io.ReadAll(bad)
+		bad.Close()
+	}
+
+	// The second packet is over the limit of one a second
+	sendPacket(conn, &Packet{EventName: PingEvent, EventBody: json.RawMessage(`{"nonce":1}`)})
+	sendPacket(conn, &Packet{EventName: PingEvent, EventBody: json.RawMessage(`{"nonce":2}`)})
+	_, err = readEvent(decoder, RateLimitedEvent)
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return scrapeMetrics(t, srv)[`mud_handler_calls_total{event="PING"}`] == "1"
+	}, time.Second, 10*time.Millisecond)
+
+	samples := scrapeMetrics(t, srv)
+	assert.Equal(t, "2", samples["mud_connections_accepted_total"])
+	assert.Equal(t, "1", samples[`mud_auth_failures_total{reason="token"}`])
+	assert.Equal(t, "2", samples[`mud_packets_received_total{event="PING"}`])
+	assert.Equal(t, "1", samples[`mud_rate_limit_drops_total{limit="packets"}`])
+	assert.Equal(t, "1", samples[`mud_handler_duration_seconds_count{event="PING"}`])
+	assert.Equal(t, "1", samples[`mud_handler_duration_seconds_bucket{event="PING",le="+Inf"}`])
+	assert.Equal(t, "1", samples[`mud_players{map="Start"}`])
+	assert.Equal(t, "1", samples["mud_sessions"])
+	assert.NotEmpty(t, samples[`mud_packets_sent_total{event="PONG"}`])
+	assert.NotEqual(t, "0", samples[`mud_outbound_queue_depth_count`])
+	assert.NotEqual(t, "0", samples["mud_goroutines"])
+
+	response, err := http.Post("http://"+srv.MetricsAddr().String()+DefaultMetricsPath, "text/plain", nil)
+	if assert.NoError(t, err) {
+		response.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, response.StatusCode)
+	}
+}
+
+func TestMetricsOutboundQueue(t *testing.T) {
+	srv := newTestServer(t)
+	pipeTestClient(t, srv, "alice")
+	pipeTestClient(t, srv, "bob")
+
+	// Nobody reads the pipes, so the packets wait behind the one being
+	// written
+	alice, _ := srv.GetSessions().GetByAccount("alice")
+	for i := 0; i < 5; i++ {
+		alice.Send(PingEvent, PingBody{Nonce: uint64(i)})
+	}
+
+	assert.Eventually(t, func() bool {
+		var buf bytes.Buffer
+		srv.WriteMetrics(&buf)
+		samples := parseMetrics(buf.String())
+		bob, _ := srv.GetSessions().GetByAccount("bob")
+		deepest, total := len(alice.outbound), len(alice.outbound)+len(bob.outbound)
+		return deepest >= 4 &&
+			samples["mud_outbound_queue_depth_max"] == strconv.Itoa(deepest) &&
+			samples["mud_outbound_queued"] == strconv.Itoa(total)
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	srv, _ := startTestServer(t)
+	assert.Nil(t, srv.MetricsAddr())
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// SlowHandlerThreshold is how long a handler may run before TimingMiddleware
+// logs it as slow.
+const SlowHandlerThreshold = 100 * time.Millisecond
+
+// Middleware wraps the handler of one event. It is called once per event
+// when the chain is built, so it can prepare per-event state up front.
+type Middleware func(eventName string, next EventHandler) EventHandler
+
+// sessionID names a session in logs; handlers may run without one in tests.
+func sessionID(session *Session) string {
+	if session == nil {
+		return "-"
+	}
+	return session.id.String()
+}
+
+// LoggingMiddleware logs every handled event at debug level and failures at
+// warning level.
+func LoggingMiddleware() Middleware {
+	return func(eventName string, next EventHandler) EventHandler {
+		return func(session *Session, eventBody json.RawMessage) error {
+			err := next(session, eventBody)
+
+			entry := logrus.WithFields(logrus.Fields{"event": eventName, "session": sessionID(session)})
+			if err != nil {
+				entry.Warn("Handler failed: ", err)
+			} else {
+				entry.Debug("Handled event")
+			}
+			return err
+		}
+	}
+}
+
+// TimingMiddleware logs handlers that take longer than threshold.
+func TimingMiddleware(threshold time.Duration) Middleware {
+	return func(eventName string, next EventHandler) EventHandler {
+		return func(session *Session, eventBody json.RawMessage) error {
+			start := time.Now()
+			err := next(session, eventBody)
+
+			if elapsed := time.Since(start); elapsed > threshold {
+				logrus.WithFields(logrus.Fields{"event": eventName, "session": sessionID(session)}).
+					Warn("Slow handler took ", elapsed)
+			}
+			return err
+		}
+	}
+}
+
+// RecoverMiddleware turns a panicking handler into a PanicError for that
+// packet instead of taking the whole server down.
+func RecoverMiddleware() Middleware {
+	return func(eventName string, next EventHandler) EventHandler {
+		return func(session *Session, eventBody json.RawMessage) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = newPanicError(session, eventName, r)
+				}
+			}()
+			return next(session, eventBody)
+		}
+	}
+}
+
+// RequireRole only lets sessions holding at least one of roles through.
+func RequireRole(roles ...string) Middleware {
+	return func(eventName string, next EventHandler) EventHandler {
+		return func(session *Session, eventBody json.RawMessage) error {
+			if session != nil && session.GetClaims() != nil {
+				for _, role := range roles {
+					if session.GetClaims().HasRole(role) {
+						return next(session, eventBody)
+					}
+				}
+			}
+			return &UnauthorizedError{msg: fmt.Sprintf("%s requires role %s", eventName, strings.Join(roles, " or "))}
+		}
+	}
+}
+
+// EventRateLimit bounds how often each session may send the event, on top
+// of the session-wide packet budget. Packets over the limit are refused with
+// RATE_LIMITED.
+func EventRateLimit(perSec float64, burst int) Middleware {
+	return func(eventName string, next EventHandler) EventHandler {
+		var mu sync.Mutex
+		limiters := make(map[*Session]*rate.Limiter)
+
+		limiterFor := func(session *Session) *rate.Limiter {
+			mu.Lock()
+			defer mu.Unlock()
+
+			limiter, ok := limiters[session]
+			if !ok {
+				limiter = rate.NewLimiter(rate.Limit(perSec), burst)
+				limiters[session] = limiter
+
+				// Forget the session once it is gone
+				go func() {
+					<-session.Done()
+					mu.Lock()
+					delete(limiters, session)
+					mu.Unlock()
+				}()
+			}
+			return limiter
+		}
+
+		return func(session *Session, eventBody json.RawMessage) error {
+			if session != nil && !limiterFor(session).Allow() {
+				return &RateLimitedError{msg: fmt.Sprintf("Too many %s events", eventName)}
+			}
+			return next(session, eventBody)
+		}
+	}
+}
+
+// EventStats are the counters MetricsMiddleware keeps for one event.
+type EventStats struct {
+	Count     uint64
+	Errors    uint64
+	TotalTime time.Duration
+	MaxTime   time.Duration
+}
+
+// EventMetrics collects EventStats and a latency Histogram per event name.
+type EventMetrics struct {
+	mu      sync.Mutex
+	events  map[string]*EventStats
+	latency map[string]*Histogram // in seconds
+}
+
+func NewEventMetrics() *EventMetrics {
+	return &EventMetrics{
+		events:  make(map[string]*EventStats),
+		latency: make(map[string]*Histogram),
+	}
+}
+
+func (m *EventMetrics) record(eventName string, elapsed time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats, ok := m.events[eventName]
+	if !ok {
+		stats = &EventStats{}
+		m.events[eventName] = stats
+		m.latency[eventName] = newHistogram(latencyBuckets)
+	}
+	m.latency[eventName].observe(elapsed.Seconds())
+
+	stats.Count++
+	if err != nil {
+		stats.Errors++
+	}
+	stats.TotalTime += elapsed
+	if elapsed > stats.MaxTime {
+		stats.MaxTime = elapsed
+	}
+}
+
+// Get returns a copy of the stats of one event.
+func (m *EventMetrics) Get(eventName string) (EventStats, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats, ok := m.events[eventName]
+	if !ok {
+		return EventStats{}, false
+	}
+	return *stats, true
+}
+
+// Latency returns a copy of the latency histogram of one event.
+func (m *EventMetrics) Latency(eventName string) (Histogram, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	latency, ok := m.latency[eventName]
+	if !ok {
+		return Histogram{}, false
+	}
+	return latency.snapshot(), true
+}
+
+// Events lists the events that have stats, sorted by name.
+func (m *EventMetrics) Events() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.events))
+	for name := range m.events {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MetricsMiddleware records the count, errors and latency of every event in
+// metrics.
+func MetricsMiddleware(metrics *EventMetrics) Middleware {
+	return func(eventName string, next EventHandler) EventHandler {
+		return func(session *Session, eventBody json.RawMessage) error {
+			start := time.Now()
+			err := next(session, eventBody)
+			metrics.record(eventName, time.Since(start), err)
+			return err
+		}
+	}
+}
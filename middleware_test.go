@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// tracingMiddleware appends name to trace before and after the handler.
+func tracingMiddleware(trace *[]string, name string) Middleware {
+	return func(eventName string, next EventHandler) EventHandler {
+		return func(session *Session, eventBody json.RawMessage) error {
+			*trace = append(*trace, name+">"+eventName)
+			err := next(session, eventBody)
+			*trace = append(*trace, "<"+name)
+			return err
+		}
+	}
+}
+
+func TestEventRegistryMiddlewareOrder(t *testing.T) {
+	var trace []string
+	registry := NewEventRegistry()
+	registry.Use(tracingMiddleware(&trace, "global1"), tracingMiddleware(&trace, "global2"))
+	registry.Register("TEST", func(session *Session, eventBody json.RawMessage) error {
+		trace = append(trace, "handler")
+		return nil
+	}, tracingMiddleware(&trace, "event"))
+
+	// Global middleware added later still wraps existing events
+	registry.Use(tracingMiddleware(&trace, "global3"))
+
+	handler, _ := registry.Lookup("TEST")
+	assert.NoError(t, handler(nil, json.RawMessage(`{}`)))
+	assert.Equal(t, []string{
+		"global1>TEST", "global2>TEST", "global3>TEST", "event>TEST",
+		"handler",
+		"<event", "<global3", "<global2", "<global1",
+	}, trace)
+
+	// Nested calls skip the global middleware
+	trace = nil
+	handler, _ = registry.lookupNested("TEST")
+	assert.NoError(t, handler(nil, json.RawMessage(`{}`)))
+	assert.Equal(t, []string{"event>TEST", "handler", "<event"}, trace)
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	handler := RecoverMiddleware()("BOOM", func(session *Session, eventBody json.RawMessage) error {
+		panic("kaboom")
+	})
+
+	err := handler(nil, nil)
+	assert.Error(t, err)
+	assert.Equal(t, ErrCodeInternal, newErrorNotice(err, nil).Code)
+}
+
+func TestRequireRole(t *testing.T) {
+	ran := false
+	handler := RequireRole("admin", "builder")("SHUTDOWN", func(session *Session, eventBody json.RawMessage) error {
+		ran = true
+		return nil
+	})
+
+	session, _ := newTestSession(t)
+	session.claims = newTestClaims("acc", "Alice", "player")
+
+	var unauthorized *UnauthorizedError
+	assert.True(t, errors.As(handler(session, nil), &unauthorized))
+	assert.True(t, errors.As(handler(nil, nil), &unauthorized))
+	assert.False(t, ran)
+
+	session.claims = newTestClaims("acc", "Alice", "Builder")
+	assert.NoError(t, handler(session, nil))
+	assert.True(t, ran)
+}
+
+func TestEventRateLimit(t *testing.T) {
+	handler := EventRateLimit(1, 2)("CHAT", func(session *Session, eventBody json.RawMessage) error {
+		return nil
+	})
+
+	alice, _ := newTestSession(t)
+	bob, _ := newTestSession(t)
+
+	assert.NoError(t, handler(alice, nil))
+	assert.NoError(t, handler(alice, nil))
+
+	var limited *RateLimitedError
+	assert.True(t, errors.As(handler(alice, nil), &limited))
+
+	// Each session has its own budget
+	assert.NoError(t, handler(bob, nil))
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	metrics := NewEventMetrics()
+	fail := false
+	handler := MetricsMiddleware(metrics)("MOVE", func(session *Session, eventBody json.RawMessage) error {
+		time.Sleep(time.Millisecond)
+		if fail {
+			return &InvalidStateError{msg: "stuck"}
+		}
+		return nil
+	})
+
+	handler(nil, nil)
+	fail = true
+	handler(nil, nil)
+
+	stats, ok := metrics.Get("MOVE")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(2), stats.Count)
+	assert.Equal(t, uint64(1), stats.Errors)
+	assert.True(t, stats.MaxTime >= time.Millisecond)
+	assert.True(t, stats.TotalTime >= stats.MaxTime)
+	assert.Equal(t, []string{"MOVE"}, metrics.Events())
+}
+
+func TestServerRecordsEventMetrics(t *testing.T) {
+	srv := newTestServer(t)
+	srv.RegisterEventHandler("testMetrics", func(session *Session, eventBody json.RawMessage) error {
+		panic("handler bug")
+	})
+
+	handler, _ := srv.eventHandler("testMetrics")
+	assert.Error(t, handler(nil, json.RawMessage(`{}`)))
+
+	stats, ok := srv.GetEventMetrics().Get("testMetrics")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), stats.Errors)
+}
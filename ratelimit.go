@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	MaxConnectionsPerSec = 5
+	MaxConnectionsPerIP  = 10
+	MaxPacketsPerSec     = 20
+
+	RateLimitedEvent  = "RATE_LIMITED"
+	ipLimiterIdleTime = time.Minute
+
+	// DefaultViolationWindow is how long a rate limit violation counts
+	// towards MaxViolations
+	DefaultViolationWindow = time.Minute
+
+	// maxTrackedViolations bounds the violations remembered per session when
+	// MaxViolations does not
+	maxTrackedViolations = 1024
+)
+
+// RateLimitPenalty decides what happens to a packet that exceeds a
+// session's budget.
+type RateLimitPenalty int
+
+const (
+	// PenaltyDrop discards the packet
+	PenaltyDrop RateLimitPenalty = iota
+	// PenaltyDelay holds the packet until the bucket refills
+	PenaltyDelay
+	// PenaltyWarn tells the client and logs the violation but still
+	// processes the packet
+	PenaltyWarn
+)
+
+func (p RateLimitPenalty) String() string {
+	switch p {
+	case PenaltyDrop:
+		return "drop"
+	case PenaltyDelay:
+		return "delay"
+	case PenaltyWarn:
+		return "warn"
+	default:
+		return "unknown"
+	}
+}
+
+func ParseRateLimitPenalty(value string) (RateLimitPenalty, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "drop":
+		return PenaltyDrop, nil
+	case "delay":
+		return PenaltyDelay, nil
+	case "warn":
+		return PenaltyWarn, nil
+	default:
+		return PenaltyDrop, fmt.Errorf("unknown rate limit penalty: %s", value)
+	}
+}
+
+func (p RateLimitPenalty) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *RateLimitPenalty) UnmarshalText(text []byte) error {
+	penalty, err := ParseRateLimitPenalty(string(text))
+	if err != nil {
+		return err
+	}
+	*p = penalty
+	return nil
+}
+
+// RateLimitConfig bounds what each session may send. A zero PacketBurst
+// bursts at PacketsPerSec, and a zero BytesBurst at the maximum frame size.
+type RateLimitConfig struct {
+	PacketsPerSec int              `json:"packets_per_sec" yaml:"packets_per_sec"`
+	PacketBurst   int              `json:"packet_burst" yaml:"packet_burst"`
+	BytesPerSec   int              `json:"bytes_per_sec" yaml:"bytes_per_sec"`
+	BytesBurst    int              `json:"bytes_burst" yaml:"bytes_burst"`
+	Penalty       RateLimitPenalty `json:"penalty" yaml:"penalty"`
+	// MaxViolations disconnects a session after that many violations within
+	// ViolationWindow, whatever the penalty. Zero never disconnects, and a
+	// zero ViolationWindow counts violations over the whole session.
+	MaxViolations   int      `json:"max_violations" yaml:"max_violations"`
+	ViolationWindow Duration `json:"violation_window" yaml:"violation_window"`
+	// ConnectionsPerSec and ConnectionsPerIP are enforced per remote IP
+	ConnectionsPerSec int `json:"connections_per_sec" yaml:"connections_per_sec"`
+	ConnectionsPerIP  int `json:"connections_per_ip" yaml:"connections_per_ip"`
+}
+
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		PacketsPerSec:     MaxPacketsPerSec,
+		BytesPerSec:       64 * 1024,
+		BytesBurst:        DefaultMaxFrameSize,
+		Penalty:           PenaltyDrop,
+		MaxViolations:     50,
+		ViolationWindow:   Duration(DefaultViolationWindow),
+		ConnectionsPerSec: MaxConnectionsPerSec,
+		ConnectionsPerIP:  MaxConnectionsPerIP,
+	}
+}
+
+type RateLimitAction int
+
+const (
+	RateLimitAllow RateLimitAction = iota
+	RateLimitDrop
+	RateLimitDelay
+	RateLimitDisconnect
+	// RateLimitWarn processes the packet after telling the client
+	RateLimitWarn
+)
+
+func (a RateLimitAction) String() string {
+	switch a {
+	case RateLimitAllow:
+		return "allow"
+	case RateLimitDrop:
+		return "drop"
+	case RateLimitDelay:
+		return "delay"
+	case RateLimitDisconnect:
+		return "disconnect"
+	case RateLimitWarn:
+		return "warn"
+	default:
+		return "unknown"
+	}
+}
+
+type RateLimitResult struct {
+	Action     RateLimitAction
+	Reason     string
+	Delay      time.Duration
+	Violations int
+}
+
+// RateLimitNotice is the body of the RATE_LIMITED event sent to the client.
+type RateLimitNotice struct {
+	Reason       string `json:"reason"`
+	Action       string `json:"action"`
+	RetryAfterMs int64  `json:"retry_after_ms"`
+	Violations   int    `json:"violations"`
+}
+
+// SessionLimiter holds the packet and byte token buckets of one session. It
+// is only used from the session's read goroutine.
+type SessionLimiter struct {
+	config     RateLimitConfig
+	packets    *rate.Limiter
+	bytes      *rate.Limiter
+	violations []time.Time // those still counted, oldest first
+}
+
+func NewSessionLimiter(config RateLimitConfig) *SessionLimiter {
+	return &SessionLimiter{
+		config:  config,
+		packets: newLimiter(config.PacketsPerSec, config.PacketBurst),
+		bytes:   newLimiter(config.BytesPerSec, config.BytesBurst),
+	}
+}
+
+func newLimiter(perSec, burst int) *rate.Limiter {
+	if perSec <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	if burst <= 0 {
+		burst = perSec
+	}
+	return rate.NewLimiter(rate.Limit(perSec), burst)
+}
+
+// Check charges one packet of size bytes against the buckets and reports
+// what the caller should do with it.
+func (l *SessionLimiter) Check(size int) RateLimitResult {
+	now := time.Now()
+
+	// A single frame larger than the burst could never be admitted
+	if burst := l.bytes.Burst(); l.bytes.Limit() != rate.Inf && size > burst {
+		size = burst
+	}
+
+	packetRes := l.packets.ReserveN(now, 1)
+	byteRes := l.bytes.ReserveN(now, size)
+
+	reason := "packets"
+	delay := packetRes.DelayFrom(now)
+	if byteDelay := byteRes.DelayFrom(now); byteDelay > delay {
+		reason = "bytes"
+		delay = byteDelay
+	}
+
+	if delay == 0 {
+		return RateLimitResult{Action: RateLimitAllow}
+	}
+
+	violations := l.recordViolation(now)
+	result := RateLimitResult{Reason: reason, Delay: delay, Violations: violations}
+
+	if l.config.MaxViolations > 0 && violations >= l.config.MaxViolations {
+		packetRes.CancelAt(now)
+		byteRes.CancelAt(now)
+		result.Action = RateLimitDisconnect
+		return result
+	}
+
+	switch l.config.Penalty {
+	case PenaltyDelay:
+		result.Action = RateLimitDelay
+	case PenaltyWarn:
+		packetRes.CancelAt(now)
+		byteRes.CancelAt(now)
+		result.Action = RateLimitWarn
+	default:
+		packetRes.CancelAt(now)
+		byteRes.CancelAt(now)
+		result.Action = RateLimitDrop
+	}
+	return result
+}
+
+// recordViolation counts a violation at now and returns how many are still
+// counted, forgetting those older than the ViolationWindow.
+func (l *SessionLimiter) recordViolation(now time.Time) int {
+	if window := time.Duration(l.config.ViolationWindow); window > 0 {
+		expired := 0
+		for expired < len(l.violations) && now.Sub(l.violations[expired]) >= window {
+			expired++
+		}
+		l.violations = l.violations[expired:]
+	}
+	l.violations = append(l.violations, now)
+
+	limit := maxTrackedViolations
+	if l.config.MaxViolations > 0 && l.config.MaxViolations < limit {
+		limit = l.config.MaxViolations
+	}
+	if len(l.violations) > limit {
+		l.violations = l.violations[len(l.violations)-limit:]
+	}
+	return len(l.violations)
+}
+
+func (l *SessionLimiter) GetViolations() int {
+	return len(l.violations)
+}
+
+// IPConnectionLimiter bounds how fast and how many concurrent connections a
+// single remote IP may open.
+type IPConnectionLimiter struct {
+	mu            sync.Mutex
+	perSec        int
+	maxConcurrent int
+	entries       map[string]*ipEntry
+	lastSweep     time.Time
+}
+
+type ipEntry struct {
+	limiter  *rate.Limiter
+	active   int
+	lastSeen time.Time
+}
+
+func NewIPConnectionLimiter(perSec, maxConcurrent int) *IPConnectionLimiter {
+	return &IPConnectionLimiter{
+		perSec:        perSec,
+		maxConcurrent: maxConcurrent,
+		entries:       make(map[string]*ipEntry),
+		lastSweep:     time.Now(),
+	}
+}
+
+// Acquire registers a new connection from ip. Every successful Acquire must
+// be paired with a Release once the connection closes.
+func (l *IPConnectionLimiter) Acquire(ip string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	entry, ok := l.entries[ip]
+	if !ok {
+		entry = &ipEntry{limiter: newLimiter(l.perSec, l.perSec)}
+		l.entries[ip] = entry
+	}
+	entry.lastSeen = now
+
+	if l.maxConcurrent > 0 && entry.active >= l.maxConcurrent {
+		return fmt.Errorf("too many concurrent connections from %s", ip)
+	}
+
+	if !entry.limiter.AllowN(now, 1) {
+		return fmt.Errorf("connection rate limit exceeded for %s", ip)
+	}
+
+	entry.active++
+	return nil
+}
+
+func (l *IPConnectionLimiter) Release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if entry, ok := l.entries[ip]; ok && entry.active > 0 {
+		entry.active--
+		entry.lastSeen = time.Now()
+	}
+}
+
+// sweep forgets idle IPs so the map does not grow without bound.
+func (l *IPConnectionLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < ipLimiterIdleTime {
+		return
+	}
+	l.lastSweep = now
+
+	for ip, entry := range l.entries {
+		if entry.active == 0 && now.Sub(entry.lastSeen) >= ipLimiterIdleTime {
+			delete(l.entries, ip)
+		}
+	}
+}
+
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
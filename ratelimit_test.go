@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionLimiterPackets(t *testing.T) {
+	limiter := NewSessionLimiter(RateLimitConfig{PacketsPerSec: 1, PacketBurst: 2, Penalty: PenaltyDrop})
+
+	assert.Equal(t, RateLimitAllow, limiter.Check(10).Action)
+	assert.Equal(t, RateLimitAllow, limiter.Check(10).Action)
+
+	result := limiter.Check(10)
+	assert.Equal(t, RateLimitDrop, result.Action)
+	assert.Equal(t, "packets", result.Reason)
+	assert.True(t, result.Delay > 0)
+	assert.Equal(t, 1, limiter.GetViolations())
+}
+
+func TestSessionLimiterBytes(t *testing.T) {
+	limiter := NewSessionLimiter(RateLimitConfig{BytesPerSec: 100, BytesBurst: 100, Penalty: PenaltyDrop})
+
+	assert.Equal(t, RateLimitAllow, limiter.Check(80).Action)
+
+	result := limiter.Check(80)
+	assert.Equal(t, RateLimitDrop, result.Action)
+	assert.Equal(t, "bytes", result.Reason)
+}
+
+func TestSessionLimiterPenalties(t *testing.T) {
+	warn := NewSessionLimiter(RateLimitConfig{PacketsPerSec: 1, PacketBurst: 1, Penalty: PenaltyWarn})
+	warn.Check(1)
+	result := warn.Check(1)
+	assert.Equal(t, RateLimitWarn, result.Action)
+	assert.Equal(t, 1, result.Violations)
+
+	delay := NewSessionLimiter(RateLimitConfig{PacketsPerSec: 10, PacketBurst: 1, Penalty: PenaltyDelay})
+	delay.Check(1)
+	result = delay.Check(1)
+	assert.Equal(t, RateLimitDelay, result.Action)
+	assert.True(t, result.Delay > 0 && result.Delay <= 100*time.Millisecond)
+}
+
+func TestSessionLimiterDisconnect(t *testing.T) {
+	limiter := NewSessionLimiter(RateLimitConfig{PacketsPerSec: 1, PacketBurst: 1, Penalty: PenaltyWarn, MaxViolations: 3})
+	limiter.Check(1)
+
+	assert.Equal(t, RateLimitWarn, limiter.Check(1).Action)
+	assert.Equal(t, RateLimitWarn, limiter.Check(1).Action)
+	assert.Equal(t, RateLimitDisconnect, limiter.Check(1).Action)
+}
+
+func TestSessionLimiterViolationWindow(t *testing.T) {
+	limiter := NewSessionLimiter(RateLimitConfig{
+		PacketsPerSec:   1,
+		PacketBurst:     1,
+		Penalty:         PenaltyDrop,
+		MaxViolations:   2,
+		ViolationWindow: Duration(50 * time.Millisecond),
+	})
+	limiter.Check(1)
+	assert.Equal(t, RateLimitDrop, limiter.Check(1).Action)
+
+	// The first violation has been forgotten by the time of the second
+	time.Sleep(60 * time.Millisecond)
+	result := limiter.Check(1)
+	assert.Equal(t, RateLimitDrop, result.Action)
+	assert.Equal(t, 1, result.Violations)
+	assert.Equal(t, RateLimitDisconnect, limiter.Check(1).Action)
+}
+
+func TestIPConnectionLimiter(t *testing.T) {
+	limiter := NewIPConnectionLimiter(100, 2)
+
+	assert.NoError(t, limiter.Acquire("10.0.0.1"))
+	assert.NoError(t, limiter.Acquire("10.0.0.1"))
+	assert.Error(t, limiter.Acquire("10.0.0.1"))
+
+	// Other addresses are unaffected
+	assert.NoError(t, limiter.Acquire("10.0.0.2"))
+
+	limiter.Release("10.0.0.1")
+	assert.NoError(t, limiter.Acquire("10.0.0.1"))
+}
+
+func TestIPConnectionLimiterRate(t *testing.T) {
+	limiter := NewIPConnectionLimiter(1, 0)
+
+	assert.NoError(t, limiter.Acquire("10.0.0.1"))
+	limiter.Release("10.0.0.1")
+	assert.Error(t, limiter.Acquire("10.0.0.1"))
+}
+
+func TestHandleConnectionRateLimited(t *testing.T) {
+	eventName := "testRateLimited"
+	srv, addr := startTestServer(t, func(config *Config) {
+		config.RateLimit = RateLimitConfig{PacketsPerSec: 1, PacketBurst: 1, Penalty: PenaltyDrop, MaxViolations: 2}
+	})
+	srv.RegisterEventHandler(eventName, func(session *Session, eventBody json.RawMessage) error { return nil })
+
+	client, decoder := joinTestClient(t, srv, addr, "alice")
+
+	packet := Packet{EventName: eventName, EventBody: json.RawMessage(`{}`)}
+	client.SetDeadline(time.Now().Add(time.Second))
+
+	sendPacket(client, &packet)
+	sendPacket(client, &packet)
+
+	notice, err := decoder.Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, RateLimitedEvent, notice.EventName)
+
+	var body RateLimitNotice
+	assert.NoError(t, json.Unmarshal(notice.EventBody, &body))
+	assert.Equal(t, "drop", body.Action)
+	assert.Equal(t, "packets", body.Reason)
+
+	// The second violation disconnects the session
+	sendPacket(client, &packet)
+
+	notice, err = decoder.Decode()
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(notice.EventBody, &body))
+	assert.Equal(t, "disconnect", body.Action)
+
+	_, err = decoder.Decode()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestHandleConnectionRateLimitWarns(t *testing.T) {
+	eventName := "testRateLimitWarn"
+	srv, addr := startTestServer(t, func(config *Config) {
+		config.RateLimit = RateLimitConfig{PacketsPerSec: 1, PacketBurst: 1, Penalty: PenaltyWarn}
+	})
+	handled := make(chan struct{}, 2)
+	srv.RegisterEventHandler(eventName, func(session *Session, eventBody json.RawMessage) error {
+		handled <- struct{}{}
+		return nil
+	})
+
+	client, decoder := joinTestClient(t, srv, addr, "alice")
+
+	packet := Packet{EventName: eventName, EventBody: json.RawMessage(`{}`)}
+	client.SetDeadline(time.Now().Add(time.Second))
+
+	sendPacket(client, &packet)
+	sendPacket(client, &packet)
+
+	// The client is told, and the packet is handled all the same
+	notice, err := decoder.Decode()
+	if assert.NoError(t, err) {
+		assert.Equal(t, RateLimitedEvent, notice.EventName)
+		var body RateLimitNotice
+		assert.NoError(t, json.Unmarshal(notice.EventBody, &body))
+		assert.Equal(t, "warn", body.Action)
+		assert.Equal(t, 1, body.Violations)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			t.Fatal("a warned packet was not handled")
+		}
+	}
+}
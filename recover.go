@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime/debug"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultMaxPanics is how many handler panics a session may trigger before
+// it is disconnected.
+const DefaultMaxPanics = 3
+
+// PanicError is what a recovered panic turns into. It is reported to the
+// client as INTERNAL_ERROR; the value and stack only go to the log.
+type PanicError struct {
+	Event string
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic in %s handler: %v", e.Event, e.Value)
+}
+
+// newPanicError logs a recovered panic with its stack and context.
+func newPanicError(session *Session, eventName string, value interface{}) *PanicError {
+	err := &PanicError{Event: eventName, Value: value, Stack: debug.Stack()}
+	logrus.WithFields(logrus.Fields{"event": eventName, "session": sessionID(session)}).
+		Error("Recovered panic: ", value, "\n", string(err.Stack))
+	return err
+}
+
+// handleSafely runs one packet through its handler and replies with ERROR
+// and ACK/NACK as needed. Panics are recovered here as well as by
+// RecoverMiddleware, so a bug in middleware or in the replies cannot take the
+// dispatcher down. It returns the panic, if there was one.
+func (s *Server) handleSafely(session *Session, packet Packet) (panicErr *PanicError) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicErr = newPanicError(session, packet.EventName, r)
+			session.SendError(panicErr, &packet)
+			// Retries get the NACK rather than waiting on a reply forever
+			if key := packet.requestKey(); key != "" {
+				session.dedup.finish(key, session.acknowledge(&packet, panicErr))
+			}
+		}
+	}()
+
+	err := s.handlePacket(session, packet)
+	if err != nil {
+		session.SendError(err, &packet)
+	}
+	var rateLimited *RateLimitedError
+	if errors.As(err, &rateLimited) {
+		s.metrics.rateLimitDropped("event")
+	}
+	if key := packet.requestKey(); key != "" {
+		session.dedup.finish(key, session.acknowledge(&packet, err))
+	}
+
+	errors.As(err, &panicErr)
+	return panicErr
+}
+
+// countPanic records a panic triggered by session and reports whether the
+// session has now reached MaxPanics and must be disconnected. It is only
+// called from the session's dispatcher.
+func (s *Server) countPanic(session *Session) bool {
+	session.panics++
+	if s.config.MaxPanics <= 0 || session.panics < s.config.MaxPanics {
+		return false
+	}
+
+	logrus.Warn("Disconnecting session ", session.id.String(), " after ", session.panics, " handler panics")
+	return true
+}
+
+// recoverConnection stops a panic on a connection goroutine from reaching
+// the runtime, which would kill the server. The connection is closed.
+func recoverConnection(conn net.Conn) {
+	if r := recover(); r != nil {
+		logrus.WithField("remote", conn.RemoteAddr().String()).
+			Error("Recovered panic on connection: ", r, "\n", string(debug.Stack()))
+		conn.Close()
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPanickingHandlerRepliesAndDisconnects(t *testing.T) {
+	srv, addr := startTestServer(t, func(config *Config) {
+		config.MaxPanics = 2
+	})
+	srv.RegisterEventHandler("testPanic", func(session *Session, eventBody json.RawMessage) error {
+		var target map[string]int
+		target["boom"]++ // nil map
+		return nil
+	})
+
+	client, decoder := joinTestClient(t, srv, addr, "alice")
+	client.SetDeadline(time.Now().Add(time.Second))
+
+	for _, id := range []string{"p1", "p2"} {
+		sendPacket(client, &Packet{ID: id, EventName: "testPanic", EventBody: json.RawMessage(`{}`)})
+
+		reply, err := decoder.Decode()
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, ErrorEvent, reply.EventName)
+
+		var notice ErrorNotice
+		json.Unmarshal(reply.EventBody, &notice)
+		assert.Equal(t, ErrCodeInternal, notice.Code)
+		assert.NotContains(t, notice.Message, "nil map")
+		assert.Equal(t, id, notice.CorrelationID)
+
+		reply, err = decoder.Decode()
+		assert.NoError(t, err)
+		assert.Equal(t, NackEvent, reply.EventName)
+	}
+
+	// The second panic reaches MaxPanics
+	_, err := decoder.Decode()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestHandleSafelyRecoversOutsideMiddleware(t *testing.T) {
+	srv := newTestServer(t)
+	srv.events = NewEventRegistry() // no RecoverMiddleware
+	srv.RegisterEventHandler("testPanic", func(session *Session, eventBody json.RawMessage) error {
+		panic("handler bug")
+	})
+
+	session, decoder := newTestSession(t)
+	packet := Packet{EventName: "testPanic", EventBody: json.RawMessage(`{}`), ID: "req-1"}
+	session.dedup.begin(packet.requestKey())
+	panicErr := srv.handleSafely(session, packet)
+	if assert.NotNil(t, panicErr) {
+		assert.Equal(t, "testPanic", panicErr.Event)
+		assert.Equal(t, "handler bug", panicErr.Value)
+		assert.NotEmpty(t, panicErr.Stack)
+	}
+
+	reply, err := decoder.Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, ErrorEvent, reply.EventName)
+	reply, err = decoder.Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, NackEvent, reply.EventName)
+
+	// A retry is answered with the NACK instead of being dropped
+	nack, fresh := session.dedup.begin(packet.requestKey())
+	assert.False(t, fresh)
+	if assert.NotNil(t, nack) {
+		assert.Equal(t, NackEvent, nack.EventName)
+	}
+
+	assert.False(t, srv.countPanic(session))
+	assert.False(t, srv.countPanic(session))
+	assert.True(t, srv.countPanic(session), "the third panic reaches the default MaxPanics")
+}
+
+// panicConn panics on the first read, standing in for a bug anywhere on the
+// connection goroutine.
+type panicConn struct {
+	net.Conn
+}
+
+func (c *panicConn) Read(b []byte) (int, error) {
+	panic("read bug")
+}
+
+func TestHandleConnectionRecoversPanic(t *testing.T) {
+	srv := newTestServer(t)
+	client, server := createMockConnection()
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go srv.HandleConnection(&panicConn{Conn: server}, &wg)
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("HandleConnection did not return after a panic")
+	}
+
+	// The connection was closed
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := client.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+var (
+	sessionType    = reflect.TypeOf((*Session)(nil))
+	errorType      = reflect.TypeOf((*error)(nil)).Elem()
+	legacyBodyType = reflect.TypeOf((*LegacyBody)(nil)).Elem()
+)
+
+// LegacyBody is implemented by typed event bodies that can also be sent the
+// way the UE client sends them: a JSON string of comma-separated fields.
+type LegacyBody interface {
+	UnmarshalLegacy(body string) error
+}
+
+// EventRegistry maps event names to their handlers. Handlers registered with
+// RegisterTyped also carry the schema their bodies are checked against.
+//
+// Every handler runs inside a middleware chain: the global middleware added
+// with Use, outermost first, then the middleware given when the event was
+// registered.
+type EventRegistry struct {
+	mu         sync.RWMutex
+	entries    map[string]*eventEntry
+	middleware []Middleware
+}
+
+type eventEntry struct {
+	handler    EventHandler
+	middleware []Middleware
+	inner      EventHandler // handler wrapped in the event middleware only
+	chain      EventHandler // inner wrapped in the global middleware
+	schema     EventSchema
+}
+
+func NewEventRegistry() *EventRegistry {
+	return &EventRegistry{entries: make(map[string]*eventEntry)}
+}
+
+// Use appends global middleware, which wraps every event, including those
+// already registered.
+func (r *EventRegistry) Use(middleware ...Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.middleware = append(r.middleware, middleware...)
+	for eventName, entry := range r.entries {
+		r.buildChain(eventName, entry)
+	}
+}
+
+// Register routes packets named eventName to handler, which receives the raw
+// event body, wrapped in the given per-event middleware. It may be called
+// while the server is running.
+func (r *EventRegistry) Register(eventName string, handler EventHandler, middleware ...Middleware) {
+	r.set(eventName, &eventEntry{
+		handler:    handler,
+		middleware: middleware,
+		schema:     EventSchema{Event: eventName, Raw: true},
+	})
+}
+
+// RegisterTyped registers handler, which must be a
+//
+//	func(session *Session, body *T) error
+//
+// where T is a struct. Each event body is decoded into a new T, rejecting
+// unknown fields, and checked against the `validate` tags of T before the
+// handler runs; see compileRules for the supported rules. Validation happens
+// inside the middleware chain, so middleware sees rejected bodies too.
+//
+// If *T implements LegacyBody, a JSON string body is passed to
+// UnmarshalLegacy instead, and the session remembers which form the client
+// used so replies can be sent the same way; see Session.SendEvent.
+func (r *EventRegistry) RegisterTyped(eventName string, handler interface{}, middleware ...Middleware) error {
+	fn := reflect.ValueOf(handler)
+	fnType := fn.Type()
+	if fnType.Kind() != reflect.Func || fnType.NumIn() != 2 || fnType.NumOut() != 1 ||
+		fnType.In(0) != sessionType || fnType.Out(0) != errorType ||
+		fnType.In(1).Kind() != reflect.Ptr || fnType.In(1).Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("%s: handler must be a func(*Session, *struct) error, got %s", eventName, fnType)
+	}
+
+	bodyType := fnType.In(1).Elem()
+	legacy := fnType.In(1).Implements(legacyBodyType)
+	rules, err := compileRules(bodyType)
+	if err != nil {
+		return fmt.Errorf("%s: %v", eventName, err)
+	}
+
+	typed := func(session *Session, eventBody json.RawMessage) error {
+		body := reflect.New(bodyType)
+
+		if legacy && isJSONString(eventBody) {
+			var fields string
+			if err := json.Unmarshal(eventBody, &fields); err != nil {
+				return &PacketValidationError{msg: fmt.Sprintf("Invalid %s body: %v", eventName, err)}
+			}
+			if err := body.Interface().(LegacyBody).UnmarshalLegacy(fields); err != nil {
+				return &PacketValidationError{msg: fmt.Sprintf("Invalid %s body: %v", eventName, err)}
+			}
+		} else {
+			decoder := json.NewDecoder(bytes.NewReader(eventBody))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(body.Interface()); err != nil {
+				return &PacketValidationError{msg: fmt.Sprintf("Invalid %s body: %v", eventName, err)}
+			}
+		}
+
+		if legacy && session != nil {
+			session.setLegacyBodies(isJSONString(eventBody))
+		}
+
+		if err := validateRules(body.Elem(), rules); err != nil {
+			return &PacketValidationError{msg: fmt.Sprintf("Invalid %s body: %v", eventName, err)}
+		}
+
+		result := fn.Call([]reflect.Value{reflect.ValueOf(session), body})
+		if err := result[0].Interface(); err != nil {
+			return err.(error)
+		}
+		return nil
+	}
+
+	r.set(eventName, &eventEntry{
+		handler:    typed,
+		middleware: middleware,
+		schema:     EventSchema{Event: eventName, Legacy: legacy, Fields: describeRules(rules)},
+	})
+	return nil
+}
+
+func isJSONString(data json.RawMessage) bool {
+	data = bytes.TrimSpace(data)
+	return len(data) > 0 && data[0] == '"'
+}
+
+func (r *EventRegistry) set(eventName string, entry *eventEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.buildChain(eventName, entry)
+	r.entries[eventName] = entry
+}
+
+// buildChain wraps the entry's handler so that the first global middleware
+// is the outermost and the last per-event middleware the innermost.
+func (r *EventRegistry) buildChain(eventName string, entry *eventEntry) {
+	inner := entry.handler
+	for i := len(entry.middleware) - 1; i >= 0; i-- {
+		inner = entry.middleware[i](eventName, inner)
+	}
+	chain := inner
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		chain = r.middleware[i](eventName, chain)
+	}
+	entry.inner, entry.chain = inner, chain
+}
+
+func (r *EventRegistry) Lookup(eventName string) (EventHandler, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	entry, ok := r.entries[eventName]
+	if !ok {
+		return nil, false
+	}
+	return entry.chain, true
+}
+
+// lookupNested finds the handler of eventName wrapped in its own middleware
+// but not the global middleware, for running it from within another handler
+// whose global middleware already logs, times and counts the call.
+func (r *EventRegistry) lookupNested(eventName string) (EventHandler, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	entry, ok := r.entries[eventName]
+	if !ok {
+		return nil, false
+	}
+	return entry.inner, true
+}
+
+// Schemas describes every registered event, sorted by name.
+func (r *EventRegistry) Schemas() []EventSchema {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	schemas := make([]EventSchema, 0, len(r.entries))
+	for _, entry := range r.entries {
+		schemas = append(schemas, entry.schema)
+	}
+	sort.Slice(schemas, func(i, j int) bool {
+		return schemas[i].Event < schemas[j].Event
+	})
+	return schemas
+}
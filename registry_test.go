@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testSayBody struct {
+	Message string `json:"message" validate:"required,maxlen=10"`
+}
+
+func TestEventRegistryTypedHandler(t *testing.T) {
+	registry := NewEventRegistry()
+
+	var received string
+	err := registry.RegisterTyped("SAY", func(session *Session, body *testSayBody) error {
+		received = body.Message
+		return nil
+	})
+	assert.NoError(t, err)
+
+	handler, ok := registry.Lookup("SAY")
+	assert.True(t, ok)
+
+	assert.NoError(t, handler(nil, json.RawMessage(`{"message":"hello"}`)))
+	assert.Equal(t, "hello", received)
+
+	for _, body := range []string{
+		`{"message":"hello","volume":11}`,  // unknown field
+		`{"message":""}`,                   // required
+		`{"message":"hello there, world"}`, // too long
+		`{"message":42}`,                   // wrong type
+		`"legacy,body"`,                    // not an object
+	} {
+		received = ""
+		err := handler(nil, json.RawMessage(body))
+
+		var validationErr *PacketValidationError
+		assert.True(t, errors.As(err, &validationErr), "%s: %v", body, err)
+		assert.Empty(t, received, "handler must not run for %s", body)
+	}
+}
+
+func TestEventRegistryTypedHandlerError(t *testing.T) {
+	registry := NewEventRegistry()
+	registry.RegisterTyped("SAY", func(session *Session, body *testSayBody) error {
+		return &NotFoundError{msg: "nobody is listening"}
+	})
+
+	handler, _ := registry.Lookup("SAY")
+	err := handler(nil, json.RawMessage(`{"message":"hello"}`))
+
+	var notFound *NotFoundError
+	assert.True(t, errors.As(err, &notFound))
+}
+
+func TestEventRegistryRegisterTypedRejectsBadHandlers(t *testing.T) {
+	registry := NewEventRegistry()
+
+	for _, handler := range []interface{}{
+		"not a function",
+		func(session *Session, body testSayBody) error { return nil },
+		func(session *Session, body *string) error { return nil },
+		func(body *testSayBody) error { return nil },
+		func(session *Session, body *testSayBody) {},
+		func(session *Session, body *struct {
+			N int `validate:"maxlen=1"`
+		}) error {
+			return nil
+		},
+	} {
+		assert.Error(t, registry.RegisterTyped("BAD", handler), "%T", handler)
+	}
+
+	_, ok := registry.Lookup("BAD")
+	assert.False(t, ok)
+}
+
+func TestEventRegistrySchemas(t *testing.T) {
+	registry := NewEventRegistry()
+	registry.Register("PING", func(session *Session, eventBody json.RawMessage) error { return nil })
+	registry.RegisterTyped("SAY", func(session *Session, body *testSayBody) error { return nil })
+
+	schemas := registry.Schemas()
+	if assert.Len(t, schemas, 2) {
+		assert.Equal(t, EventSchema{Event: "PING", Raw: true}, schemas[0])
+
+		assert.Equal(t, "SAY", schemas[1].Event)
+		assert.False(t, schemas[1].Raw)
+		assert.Equal(t, "message", schemas[1].Fields[0].Name)
+	}
+
+	data, err := json.Marshal(schemas)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"max_len":10`)
+}
+
+type testLegacySayBody struct {
+	Message string `json:"message" validate:"required"`
+}
+
+func (b *testLegacySayBody) UnmarshalLegacy(body string) error {
+	b.Message = body
+	return nil
+}
+
+func TestEventRegistryLegacyBody(t *testing.T) {
+	registry := NewEventRegistry()
+
+	var received string
+	registry.RegisterTyped("SAY", func(session *Session, body *testLegacySayBody) error {
+		received = body.Message
+		return nil
+	})
+	handler, _ := registry.Lookup("SAY")
+	session, _ := newTestSession(t)
+
+	assert.NoError(t, handler(session, json.RawMessage(`"hello, world"`)))
+	assert.Equal(t, "hello, world", received)
+	assert.True(t, session.LegacyBodies())
+
+	assert.NoError(t, handler(session, json.RawMessage(`{"message":"hello"}`)))
+	assert.Equal(t, "hello", received)
+	assert.False(t, session.LegacyBodies(), "the session should follow the form the client last used")
+
+	// Legacy bodies are validated too
+	var validationErr *PacketValidationError
+	assert.True(t, errors.As(handler(session, json.RawMessage(`""`)), &validationErr))
+
+	assert.True(t, registry.Schemas()[0].Legacy)
+}
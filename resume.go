@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	SessionEvent = "SESSION"
+
+	// ResumeCommand replaces the token as the first message of a connection
+	// that resumes a session: "RESUME <resume token> <last seq received>"
+	ResumeCommand = "RESUME"
+
+	DefaultResumeGracePeriod = 30 * time.Second
+	DefaultReplayBufferSize  = 256
+)
+
+var ErrUnknownResumeToken = errors.New("unknown or expired resume token")
+
+// SessionNotice is the body of the SESSION event, sent after login and after
+// every resume. ResumeToken is only good for one resume; a resumed session
+// is sent a new one. Replayed counts the events sent again on resume, and
+// Missed is set when some of the events the client had not received were no
+// longer buffered.
+type SessionNotice struct {
+	SessionID     string `json:"session_id"`
+	ResumeToken   string `json:"resume_token"`
+	GracePeriodMs int64  `json:"grace_period_ms"`
+	Resumed       bool   `json:"resumed,omitempty"`
+	Replayed      int    `json:"replayed,omitempty"`
+	Missed        bool   `json:"missed,omitempty"`
+}
+
+// replayBuffer numbers the packets sent to a session and keeps the most
+// recent ones, so that a client that reconnects can be sent what it missed.
+// Its lock is held while a packet is numbered and queued, so packets reach
+// the outbound queue in Seq order.
+type replayBuffer struct {
+	mu      sync.Mutex
+	size    int
+	seq     uint64    // Seq of the last packet recorded
+	packets []*Packet // oldest first
+}
+
+func newReplayBuffer(size int) *replayBuffer {
+	return &replayBuffer{size: size}
+}
+
+// recordLocked returns a copy of packet numbered with the next Seq and
+// remembers it, dropping the oldest packet when the buffer is full.
+func (b *replayBuffer) recordLocked(packet *Packet) *Packet {
+	numbered := *packet
+	b.seq++
+	numbered.Seq = b.seq
+
+	if len(b.packets) == b.size {
+		b.packets = append(b.packets[:0], b.packets[1:]...)
+	}
+	b.packets = append(b.packets, &numbered)
+	return &numbered
+}
+
+// sinceLocked returns the buffered packets after seq, and whether they are
+// all the client missed.
+func (b *replayBuffer) sinceLocked(seq uint64) ([]*Packet, bool) {
+	if seq >= b.seq {
+		return nil, true
+	}
+
+	for i, packet := range b.packets {
+		if packet.Seq > seq {
+			return b.packets[i:], packet.Seq == seq+1
+		}
+	}
+	return nil, false
+}
+
+// parkedSession is a disconnected session whose player is kept in the world
+// until the client resumes it or the grace period runs out.
+type parkedSession struct {
+	session *Session
+	timer   *time.Timer
+}
+
+func newResumeToken() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// parseResumeRequest recognises a RESUME command.
+func parseResumeRequest(message string) (token string, lastSeq uint64, ok bool) {
+	fields := strings.Fields(message)
+	if len(fields) < 2 || len(fields) > 3 || fields[0] != ResumeCommand {
+		return "", 0, false
+	}
+
+	if len(fields) == 3 {
+		seq, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return "", 0, false
+		}
+		lastSeq = seq
+	}
+	return fields[1], lastSeq, true
+}
+
+// issueResumeToken gives the session a fresh resume token and tells the
+// client about it.
+func (s *Server) issueResumeToken(session *Session, notice SessionNotice) {
+	grace := time.Duration(s.config.ResumeGracePeriod)
+	if grace <= 0 || !session.HasFeature(FeatureResume) {
+		return
+	}
+
+	notice.SessionID = session.id.String()
+	notice.ResumeToken = newResumeToken()
+	notice.GracePeriodMs = grace.Milliseconds()
+
+	session.setResumeToken(notice.ResumeToken)
+	session.Send(SessionEvent, notice)
+}
+
+// park holds a disconnected session for the grace period. Sessions that
+// were kicked, have no player or are closed by a shutdown are not held.
+func (s *Server) park(session *Session) bool {
+	grace := time.Duration(s.config.ResumeGracePeriod)
+	token := session.getResumeToken()
+	player := session.GetPlayer()
+	if grace <= 0 || token == "" || player == nil {
+		return false
+	}
+	if current, ok := s.sessions.GetByPlayer(player.GetID()); !ok || current != session {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A kick clears the token before looking for the session here
+	if s.shuttingDown || session.getResumeToken() != token {
+		return false
+	}
+
+	s.parked[token] = &parkedSession{
+		session: session,
+		timer:   time.AfterFunc(grace, func() { s.expire(token) }),
+	}
+	logrus.Info("Holding session ", session.id.String(), " of ", player.GetName(), " for ", grace)
+	return true
+}
+
+// unpark takes a held session out of the parked set, stopping its timer.
+func (s *Server) unpark(token string) (*Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parked, ok := s.parked[token]
+	if !ok {
+		return nil, false
+	}
+	parked.timer.Stop()
+	delete(s.parked, token)
+	return parked.session, true
+}
+
+func (s *Server) expire(token string) {
+	if session, ok := s.unpark(token); ok {
+		logrus.Info("Resume grace period of session ", session.id.String(), " ran out")
+		s.release(session)
+	}
+}
+
+// releaseParked lets go of every held session, or only those of accountID
+// when it is not empty.
+func (s *Server) releaseParked(accountID string) {
+	var tokens []string
+	s.mu.Lock()
+	for token, parked := range s.parked {
+		if accountID == "" || accountKey(parked.session) == accountID {
+			tokens = append(tokens, token)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, token := range tokens {
+		if session, ok := s.unpark(token); ok {
+			s.release(session)
+		}
+	}
+}
+
+// release takes a finished session's player out of the world, saves it and
+// forgets the session.
+func (s *Server) release(session *Session) {
+	s.leaveWorld(session)
+	if err := s.savePlayer(session); err != nil {
+		logrus.Error("Error saving player of session ", session.id.String(), ": ", err)
+	}
+	s.sessions.Remove(session)
+}
+
+// resume attaches conn to the session held under token. Events the client
+// missed after lastSeq are sent again before anything new.
+func (s *Server) resume(conn net.Conn, hello *HelloRequest) (*Session, error) {
+	old, ok := s.unpark(hello.ResumeToken)
+	if !ok {
+		return nil, ErrUnknownResumeToken
+	}
+
+	// The new session takes over the identity and history of the old one
+	// before its writer starts
+	session := buildSession(conn, old.claims, s.config)
+	session.metrics = s.metrics
+	session.id = old.id
+	session.dedup = old.dedup
+	session.replay = old.replay
+	session.legacyBodies = old.LegacyBodies()
+	session.start()
+	s.greet(session, hello)
+
+	notice := SessionNotice{Resumed: true}
+	if session.replay != nil {
+		session.replay.mu.Lock()
+		s.sessions.Replace(old, session)
+		packets, complete := session.replay.sinceLocked(hello.LastSeq)
+		session.enqueueLocked(packets)
+		session.replay.mu.Unlock()
+
+		notice.Replayed, notice.Missed = len(packets), !complete
+	} else {
+		s.sessions.Replace(old, session)
+	}
+
+	logrus.Info("Session ", session.id.String(), " resumed, replayed ", notice.Replayed, " events")
+	s.issueResumeToken(session, notice)
+	return session, nil
+}
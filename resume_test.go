@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readSessionNotice reads up to the next SESSION event.
+func readSessionNotice(t *testing.T, decoder *PacketDecoder) (*Packet, SessionNotice) {
+	t.Helper()
+
+	var notice SessionNotice
+	packet, err := readEvent(decoder, SessionEvent)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.NoError(t, json.Unmarshal(packet.EventBody, &notice))
+	return packet, notice
+}
+
+func dialResume(t *testing.T, addr, token string, lastSeq uint64) (net.Conn, *PacketDecoder) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to the server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	conn.Write([]byte(fmt.Sprintf("%s %s %d", ResumeCommand, token, lastSeq)))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	return conn, NewPacketDecoder(conn, LengthPrefixed, DefaultMaxFrameSize)
+}
+
+// dialResumable logs in as accountID with a HELLO asking to resume sessions.
+func dialResumable(t *testing.T, addr, accountID string) (net.Conn, *PacketDecoder) {
+	t.Helper()
+
+	return dialHello(t, addr, HelloRequest{
+		ProtocolVersion: ProtocolVersion,
+		Features:        []string{FeatureResume},
+		Token:           testToken(t, accountID),
+	})
+}
+
+func TestReplayBuffer(t *testing.T) {
+	buffer := newReplayBuffer(3)
+	for i := 0; i < 5; i++ {
+		buffer.recordLocked(&Packet{EventName: ChatEvent})
+	}
+
+	packets, complete := buffer.sinceLocked(0)
+	assert.False(t, complete, "packets 1 and 2 were dropped")
+	if assert.Len(t, packets, 3) {
+		assert.Equal(t, uint64(3), packets[0].Seq)
+	}
+
+	packets, complete = buffer.sinceLocked(3)
+	assert.True(t, complete)
+	assert.Len(t, packets, 2)
+
+	packets, complete = buffer.sinceLocked(5)
+	assert.True(t, complete)
+	assert.Empty(t, packets)
+}
+
+func TestParseResumeRequest(t *testing.T) {
+	token, seq, ok := parseResumeRequest("RESUME abc 42")
+	assert.True(t, ok)
+	assert.Equal(t, "abc", token)
+	assert.Equal(t, uint64(42), seq)
+
+	_, seq, ok = parseResumeRequest("RESUME abc")
+	assert.True(t, ok)
+	assert.Zero(t, seq)
+
+	for _, message := range []string{"eyJhbGciOiJIUzI1NiJ9.e30.sig", "RESUME", "RESUME abc -1", "RESUME a b c"} {
+		_, _, ok := parseResumeRequest(message)
+		assert.False(t, ok, message)
+	}
+}
+
+func TestSessionResume(t *testing.T) {
+	srv, addr := startTestServer(t)
+
+	aliceConn, aliceDecoder := dialResumable(t, addr, "alice")
+	sessionPacket, notice := readSessionNotice(t, aliceDecoder)
+	assert.NotEmpty(t, notice.ResumeToken)
+	assert.False(t, notice.Resumed)
+
+	_, bobDecoder := joinTestClient(t, srv, addr, "bob")
+
+	alice, _ := srv.GetSessions().GetByAccount("alice")
+	player := alice.GetPlayer()
+
+	// The connection drops; the player stays in the world
+	aliceConn.Close()
+	<-alice.Done()
+	assert.Eventually(t, func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return len(srv.parked) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.True(t, srv.world.StartMap().HasPlayer(player))
+	assert.Equal(t, 2, srv.GetSessions().Count())
+
+	// Alice misses a chat while away
+	bob, _ := srv.GetSessions().GetByAccount("bob")
+	srv.handleChat(bob, &ChatBody{Message: "where did you go?"})
+	_, err := readEvent(bobDecoder, ChatEvent)
+	assert.NoError(t, err)
+
+	_, decoder := dialResume(t, addr, notice.ResumeToken, sessionPacket.Seq)
+	packet, err := readEvent(decoder, ChatEvent)
+	if assert.NoError(t, err) {
+		assert.JSONEq(t, `{"from":"bob","message":"where did you go?"}`, string(packet.EventBody))
+	}
+
+	_, resumed := readSessionNotice(t, decoder)
+	assert.True(t, resumed.Resumed)
+	assert.False(t, resumed.Missed)
+	assert.Equal(t, notice.SessionID, resumed.SessionID)
+	assert.NotEqual(t, notice.ResumeToken, resumed.ResumeToken, "resume tokens are single use")
+	assert.GreaterOrEqual(t, resumed.Replayed, 1)
+
+	current, ok := srv.GetSessions().GetByAccount("alice")
+	if assert.True(t, ok) {
+		assert.True(t, alice != current, "a new session takes over")
+		assert.Same(t, player, current.GetPlayer())
+	}
+	assert.Equal(t, 2, srv.GetSessions().Count())
+
+	// The old token is spent
+	_, decoder = dialResume(t, addr, notice.ResumeToken, 0)
+	packet, err = readEvent(decoder, ErrorEvent)
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(packet.EventBody), string(ErrCodeUnauthorized))
+	}
+}
+
+func TestSessionResumeExpires(t *testing.T) {
+	srv, addr := startTestServer(t, func(config *Config) {
+		config.ResumeGracePeriod = Duration(50 * time.Millisecond)
+	})
+
+	conn, decoder := dialResumable(t, addr, "alice")
+	_, notice := readSessionNotice(t, decoder)
+	alice, _ := srv.GetSessions().GetByAccount("alice")
+	player := alice.GetPlayer()
+
+	conn.Close()
+	assert.Eventually(t, func() bool { return srv.GetSessions().Count() == 0 }, time.Second, 10*time.Millisecond)
+	assert.False(t, srv.world.StartMap().HasPlayer(player))
+
+	_, decoder = dialResume(t, addr, notice.ResumeToken, 0)
+	_, err := readEvent(decoder, ErrorEvent)
+	assert.NoError(t, err)
+}
+
+func TestLoginReplacesParkedSession(t *testing.T) {
+	srv, addr := startTestServer(t)
+
+	conn, decoder := dialResumable(t, addr, "alice")
+	readSessionNotice(t, decoder)
+	conn.Close()
+	assert.Eventually(t, func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return len(srv.parked) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// Logging in again, rather than resuming, is not refused as a second login
+	joinTestClient(t, srv, addr, "alice")
+	assert.Equal(t, 1, srv.GetSessions().Count())
+}
+
+func TestLegacyClientIsNotHeld(t *testing.T) {
+	srv, addr := startTestServer(t)
+
+	// A client that sent a bare token never asked to resume, so its player
+	// leaves the world as soon as it disconnects
+	conn, _ := joinTestClient(t, srv, addr, "alice")
+	alice, _ := srv.GetSessions().GetByAccount("alice")
+	player := alice.GetPlayer()
+	assert.Empty(t, alice.getResumeToken())
+
+	conn.Close()
+	assert.Eventually(t, func() bool { return srv.GetSessions().Count() == 0 }, time.Second, 10*time.Millisecond)
+	assert.False(t, srv.world.StartMap().HasPlayer(player))
+	srv.mu.Lock()
+	assert.Empty(t, srv.parked)
+	srv.mu.Unlock()
+}
+
+func TestResumeHandlesRetryOfAbandonedRequest(t *testing.T) {
+	srv, addr := startTestServer(t)
+	handled := make(chan string, 4)
+	srv.RegisterEventHandler("testClose", func(session *Session, eventBody json.RawMessage) error {
+		session.Close()
+		return nil
+	})
+	srv.RegisterEventHandler("testRecord", func(session *Session, eventBody json.RawMessage) error {
+		handled <- string(eventBody)
+		return nil
+	})
+
+	conn, decoder := dialResumable(t, addr, "alice")
+	sessionPacket, notice := readSessionNotice(t, decoder)
+	alice, _ := srv.GetSessions().GetByAccount("alice")
+
+	// req-2 is queued behind the packet that closes the session, so it is
+	// never handled
+	var batch bytes.Buffer
+	encoder := NewPacketEncoder(&batch, LengthPrefixed, DefaultMaxFrameSize)
+	encoder.Encode(&Packet{ID: "req-1", EventName: "testClose", EventBody: json.RawMessage(`{}`)})
+	encoder.Encode(&Packet{ID: "req-2", EventName: "testRecord", EventBody: json.RawMessage(`"first"`)})
+	conn.Write(batch.Bytes())
+
+	<-alice.Done()
+	assert.Eventually(t, func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return len(srv.parked) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Empty(t, handled)
+
+	resumed, decoder := dialResume(t, addr, notice.ResumeToken, sessionPacket.Seq)
+	readSessionNotice(t, decoder)
+	sendPacket(resumed, &Packet{ID: "req-2", EventName: "testRecord", EventBody: json.RawMessage(`"retry"`)})
+
+	packet, err := readEvent(decoder, AckEvent)
+	if assert.NoError(t, err) {
+		assert.JSONEq(t, `"req-2"`, string(mustField(t, packet.EventBody, "id")))
+	}
+	select {
+	case body := <-handled:
+		assert.Equal(t, `"retry"`, body)
+	case <-time.After(time.Second):
+		t.Fatal("the retry was not handled")
+	}
+}
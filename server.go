@@ -0,0 +1,638 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Bioblaze/mud/Map"
+)
+
+const ServerShutdownEvent = "SERVER_SHUTDOWN"
+
+// ShutdownNotice is the body of the SERVER_SHUTDOWN event. CountdownMs is how
+// long the client has before the server closes the connection itself, zero
+// when there is no deadline.
+type ShutdownNotice struct {
+	Reason      string `json:"reason"`
+	CountdownMs int64  `json:"countdown_ms"`
+}
+
+// Server owns everything a running MUD server needs: its configuration, the
+// token verifier, the live sessions and the player store.
+type Server struct {
+	config            *Config
+	keys              *KeySet
+	certs             *CertificateStore // nil without TLS
+	verifier          *TokenVerifier
+	connectionLimiter *IPConnectionLimiter
+	sessions          *SessionManager
+	players           PlayerStore
+	events            *EventRegistry
+	eventMetrics      *EventMetrics
+	metrics           *ServerMetrics
+	compression       *CompressionMetrics
+	world             *World
+	commands          *CommandSet
+	aliases           *AliasStore
+
+	mu              sync.Mutex
+	listener        net.Listener
+	wsServer        *http.Server // nil unless the WebSocket gateway runs
+	wsListener      net.Listener
+	telnetListener  net.Listener // nil unless the telnet gateway runs
+	metricsServer   *http.Server // nil unless the metrics endpoint runs
+	metricsListener net.Listener
+	conns           map[net.Conn]struct{}
+	parked          map[string]*parkedSession // by resume token
+	shuttingDown    bool
+	wg              sync.WaitGroup
+}
+
+// NewServer builds a Server from a validated Config.
+func NewServer(config *Config) (*Server, error) {
+	secret := []byte(config.JWT.Secret)
+
+	keys := NewKeySet(secret)
+	if config.JWT.KeyFile != "" {
+		var err error
+		keys, err = LoadKeySet(config.JWT.KeyFile, secret)
+		if err != nil {
+			return nil, err
+		}
+		logrus.Info("Loaded ", keys.Len(), " token verification keys from ", config.JWT.KeyFile)
+	}
+
+	var certs *CertificateStore
+	if config.TLS.Enabled() {
+		var err error
+		certs, err = LoadCertificateStore(config.TLS.CertFile, config.TLS.KeyFile, config.TLS.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		logrus.Info("Loaded TLS certificate from ", config.TLS.CertFile)
+	}
+
+	if config.JWT.Secret == DefaultJWTSecret {
+		logrus.Warn("Using the default JWT secret, set JWT_SECRET in production")
+	}
+
+	// Every event is logged, measured and timed. Recovery sits inside those
+	// so a panic still shows up in the logs and metrics as a failure.
+	metrics := NewEventMetrics()
+	events := NewEventRegistry()
+	events.Use(LoggingMiddleware(), MetricsMiddleware(metrics), TimingMiddleware(SlowHandlerThreshold), RecoverMiddleware())
+
+	s := &Server{
+		config:            config,
+		keys:              keys,
+		certs:             certs,
+		verifier:          NewTokenVerifier(keys, config.JWT.Algorithms, config.JWT.Issuer, config.JWT.Audience),
+		connectionLimiter: NewIPConnectionLimiter(config.RateLimit.ConnectionsPerSec, config.RateLimit.ConnectionsPerIP),
+		sessions:          NewSessionManager(),
+		players:           NewMemoryPlayerStore(),
+		events:            events,
+		eventMetrics:      metrics,
+		metrics:           NewServerMetrics(),
+		compression:       NewCompressionMetrics(),
+		world:             NewWorld(Map.NewMap(StartMapName, DefaultMapWidth, DefaultMapHeight)),
+		commands:          NewCommandSet(),
+		aliases:           NewAliasStore(),
+		conns:             make(map[net.Conn]struct{}),
+		parked:            make(map[string]*parkedSession),
+	}
+
+	if err := s.registerGameHandlers(); err != nil {
+		return nil, err
+	}
+	if err := s.registerAdminHandlers(); err != nil {
+		return nil, err
+	}
+	if err := s.registerCommands(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Server) GetConfig() *Config {
+	return s.config
+}
+
+func (s *Server) GetSessions() *SessionManager {
+	return s.sessions
+}
+
+func (s *Server) GetEventMetrics() *EventMetrics {
+	return s.eventMetrics
+}
+
+func (s *Server) GetMetrics() *ServerMetrics {
+	return s.metrics
+}
+
+func (s *Server) GetCompressionMetrics() *CompressionMetrics {
+	return s.compression
+}
+
+// ReloadKeys re-reads the token key file, keeping the old keys on error.
+func (s *Server) ReloadKeys() error {
+	if err := s.keys.Reload(); err != nil {
+		return err
+	}
+	logrus.Info("Reloaded ", s.keys.Len(), " token verification keys")
+	return nil
+}
+
+// Addr returns the address the server is listening on, or nil before it
+// has started.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Start listens on the configured address and accepts connections in the
+// background until Shutdown or Close is called.
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", s.config.ServerAddress)
+	if err != nil {
+		return err
+	}
+	ln = s.wrapListener(ln)
+	s.setListener(ln)
+
+	if err := s.startWebSocket(); err != nil {
+		ln.Close()
+		return err
+	}
+	if err := s.startTelnet(); err != nil {
+		s.Close()
+		return err
+	}
+	if err := s.startMetrics(); err != nil {
+		s.Close()
+		return err
+	}
+
+	go s.serve(ln)
+	return nil
+}
+
+func (s *Server) ListenAndServe() error {
+	ln, err := net.Listen("tcp", s.config.ServerAddress)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on ln until Close is called. It returns nil
+// once every connection handler has finished after a Close.
+func (s *Server) Serve(ln net.Listener) error {
+	ln = s.wrapListener(ln)
+	s.setListener(ln)
+	return s.serve(ln)
+}
+
+func (s *Server) setListener(ln net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.listener = ln
+}
+
+func (s *Server) serve(ln net.Listener) error {
+	logrus.Info("Server listening on ", ln.Addr().String())
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.watchCertificates(stop)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				logrus.Info("Server stopped accepting new connections")
+				s.wg.Wait()
+				return nil
+			}
+			logrus.Error("Error accepting connection: ", err)
+			continue
+		}
+
+		done, ok := s.admit(conn)
+		if !ok {
+			continue
+		}
+		go func() {
+			defer done()
+			s.HandleConnection(conn, &s.wg)
+		}()
+	}
+}
+
+// admit applies the connection limits to a new connection of any transport
+// and registers it, closing it when refused. done must be called once the
+// connection has been handled.
+func (s *Server) admit(conn net.Conn) (done func(), ok bool) {
+	ip := remoteIP(conn.RemoteAddr())
+	if err := s.connectionLimiter.Acquire(ip); err != nil {
+		logrus.Warn("Connection rejected: ", err)
+		s.metrics.connectionRejected("limit")
+		conn.Close()
+		return nil, false
+	}
+
+	if !s.trackConn(conn) {
+		s.metrics.connectionRejected("shutdown")
+		s.connectionLimiter.Release(ip)
+		conn.Close()
+		return nil, false
+	}
+	s.metrics.connectionAccepted()
+
+	return func() {
+		s.untrackConn(conn)
+		s.connectionLimiter.Release(ip)
+	}, true
+}
+
+// trackConn registers a connection so Shutdown can wait for it and close it
+// by force. It refuses connections once Shutdown has begun.
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.shuttingDown {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
+}
+
+// Close stops accepting new connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.wsServer != nil {
+		s.wsServer.Close()
+	}
+	if s.telnetListener != nil {
+		s.telnetListener.Close()
+	}
+	if s.metricsServer != nil {
+		s.metricsServer.Close()
+	}
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// Shutdown stops accepting connections, sends SERVER_SHUTDOWN to every
+// session and persists their players. It then waits for the clients to
+// disconnect; once ctx is done the remaining sessions are closed, flushing
+// what is already queued, and the connections are closed by force.
+// Shutdown returns ctx.Err() when it had to force connections closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shuttingDown = true
+	s.mu.Unlock()
+
+	if err := s.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		logrus.Error("Error closing listener: ", err)
+	}
+
+	notice := ShutdownNotice{Reason: s.config.ShutdownMessage}
+	if deadline, ok := ctx.Deadline(); ok {
+		notice.CountdownMs = time.Until(deadline).Milliseconds()
+	}
+	s.sessions.Broadcast(ServerShutdownEvent, notice)
+
+	s.releaseParked("")
+	s.persistPlayers()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	logrus.Warn("Shutdown deadline reached, closing ", s.sessions.Count(), " remaining sessions")
+	s.sessions.ForEach(func(session *Session) bool {
+		session.Close()
+		return true
+	})
+
+	select {
+	case <-done:
+		return ctx.Err()
+	case <-time.After(FlushTimeout):
+	}
+
+	// Whatever is left is stuck in a write or has not authenticated yet
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	<-done
+	return ctx.Err()
+}
+
+func (s *Server) persistPlayers() {
+	s.sessions.ForEach(func(session *Session) bool {
+		if err := s.savePlayer(session); err != nil {
+			logrus.Error("Error saving player of session ", session.id.String(), ": ", err)
+		}
+		return true
+	})
+}
+
+func (s *Server) HandleConnection(conn net.Conn, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer recoverConnection(conn)
+
+	// The HELLO and the packets after it are read through one decoder, so
+	// nothing the client sent along with its HELLO is lost
+	decoder := NewPacketDecoder(conn, s.config.FrameMode, s.config.MaxFrameSize)
+	credentials, err := s.readCredentials(conn, decoder)
+	if err != nil {
+		logrus.Error("Authentication error: ", err)
+		conn.Close()
+		return
+	}
+
+	hello, err := parseHello(credentials)
+	if err != nil {
+		logrus.Warn("Handshake error: ", err)
+		s.metrics.authFailed("handshake")
+		var protocolErr ProtocolError
+		if !errors.As(err, &protocolErr) {
+			protocolErr = &PacketValidationError{msg: "Invalid " + HelloEvent + ": " + err.Error()}
+		}
+		rejectConnection(conn, s.config, protocolErr)
+		return
+	}
+
+	var session *Session
+	if hello.ResumeToken != "" {
+		session, err = s.resume(conn, hello)
+		if err != nil {
+			logrus.Warn("Resume error: ", err)
+			s.metrics.authFailed("resume")
+			rejectConnection(conn, s.config, &UnauthorizedError{msg: "Cannot resume: " + err.Error()})
+			return
+		}
+	} else {
+		claims, err := s.verifier.Parse(hello.Token)
+		if err != nil {
+			logrus.Error("Authentication error: ", err)
+			s.metrics.authFailed("token")
+			rejectConnection(conn, s.config, &UnauthorizedError{msg: "Invalid token: " + err.Error()})
+			return
+		}
+		if session, err = s.startSession(conn, claims, hello); err != nil {
+			return
+		}
+	}
+
+	// A dropped session is held for the client to resume, if it may be
+	defer func() {
+		if !s.park(session) {
+			s.release(session)
+		}
+	}()
+
+	s.processPackets(session, decoder)
+}
+
+// startSession logs in a newly authenticated connection and puts its player
+// in the world. The client is only greeted once the login went through, and
+// the session's writer only starts after the greeting.
+func (s *Server) startSession(conn net.Conn, claims *JwtClaims, hello *HelloRequest) (*Session, error) {
+	session := buildSession(conn, claims, s.config)
+	session.metrics = s.metrics
+	s.sessions.Add(session)
+
+	if err := s.login(session); err != nil {
+		logrus.Error("Login error: ", err)
+		s.metrics.authFailed("login")
+		rejectConnection(conn, s.config, &UnauthorizedError{msg: "Cannot log in: " + err.Error()})
+		session.Close()
+		s.release(session)
+		return nil, err
+	}
+
+	s.greet(session, hello)
+	session.start()
+	s.issueResumeToken(session, SessionNotice{})
+
+	if err := s.enterWorld(session); err != nil {
+		logrus.Error("Error entering world: ", err)
+		session.Close()
+		s.release(session)
+		return nil, err
+	}
+	return session, nil
+}
+
+// rejectConnection reports err to a client that has no session and closes
+// the connection.
+func rejectConnection(conn net.Conn, config *Config, err ProtocolError) {
+	conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	body, _ := json.Marshal(newErrorNotice(err, nil))
+	NewPacketEncoder(conn, config.FrameMode, config.MaxFrameSize).Encode(&Packet{EventName: ErrorEvent, EventBody: body})
+	conn.Close()
+}
+
+// readCredentials reads the first message of a connection through decoder:
+// a HELLO, or from older clients a token or a RESUME command.
+func (s *Server) readCredentials(conn net.Conn, decoder *PacketDecoder) (string, error) {
+	conn.SetDeadline(time.Now().Add(time.Duration(s.config.ConnTimeout)))
+
+	message, err := decoder.ReadHandshake()
+	if err != nil {
+		return "", err
+	}
+	return string(message), nil
+}
+
+// processPackets reads the session's packets through decoder and hands them
+// to the handlers until the connection closes.
+func (s *Server) processPackets(session *Session, decoder *PacketDecoder) {
+	defer session.Close() // Ensure the connection is closed
+
+	// Packets still queued when the reader stops are handled before the
+	// session is closed, unless the session is closed first
+	dispatched := make(chan struct{})
+	go func() {
+		defer close(dispatched)
+		s.dispatch(session)
+	}()
+	defer func() {
+		close(session.inbound)
+		<-dispatched
+
+		// Packets left behind by a closed session may be retried once the
+		// client resumes it
+		for packet := range session.inbound {
+			session.dedup.abandon(packet.requestKey())
+		}
+	}()
+
+	conn := session.conn
+
+	conn.SetDeadline(time.Time{})
+	idleTimeout := time.Duration(s.config.IdleTimeout)
+	if _, ok := conn.(*telnetConn); ok {
+		idleTimeout = time.Duration(s.config.Telnet.IdleTimeout)
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(time.Duration(s.config.KeepAlivePeriod))
+	}
+
+	go s.keepAlive(session)
+
+	decoder.SetCodec(session.Codec())
+	if session.HasFeature(FeatureCompression) {
+		decoder.EnableCompression(s.config.MaxDecompressedSize, s.compression)
+	}
+	for {
+		if idleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		}
+
+		packet, err := decoder.Decode()
+		if err != nil {
+			if err == io.EOF {
+				logrus.Info("Client disconnected")
+				return
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				logrus.Info("Disconnecting session ", session.id.String(), " after ", idleTimeout, " without a packet")
+				session.Send(KickedEvent, map[string]string{"reason": "idle timeout"})
+				return
+			}
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || errors.Is(err, ErrMalformedBinary) {
+				logrus.Error("Error parsing packet: ", err)
+				session.SendError(&PacketValidationError{msg: "Malformed packet: " + err.Error()}, nil)
+				return
+			}
+			logrus.Error("Error reading packet: ", err)
+			return
+		}
+
+		if _, ok := s.events.Lookup(packet.EventName); ok {
+			s.metrics.packetReceived(packet.EventName)
+		} else {
+			s.metrics.packetReceived(otherEvent)
+		}
+
+		limit := session.limiter.Check(decoder.LastFrameSize())
+		if limit.Action == RateLimitDrop || limit.Action == RateLimitDisconnect {
+			s.metrics.rateLimitDropped(limit.Reason)
+		}
+		if !applyRateLimit(session, limit) {
+			return
+		}
+		if limit.Action == RateLimitDrop {
+			session.acknowledge(&packet, &RateLimitedError{msg: "Packet dropped by rate limit"})
+			continue
+		}
+
+		err = s.validatePacket(&packet)
+		if err != nil {
+			logrus.Warn("Invalid packet: ", err)
+			session.SendError(err, &packet)
+			session.acknowledge(&packet, err)
+			continue
+		}
+
+		if session.checkDuplicate(&packet) {
+			continue
+		}
+
+		if !s.enqueue(session, packet) {
+			return
+		}
+	}
+}
+
+// enqueue hands a packet to the session's dispatcher. When the inbound queue
+// is full the reader blocks here and stops reading the socket, which pushes
+// back on the client through TCP flow control. It returns false if the
+// session closes while waiting.
+func (s *Server) enqueue(session *Session, packet Packet) bool {
+	select {
+	case session.inbound <- packet:
+		return true
+	default:
+	}
+
+	logrus.Warn("Inbound queue full for session ", session.id.String(), ", applying backpressure")
+	select {
+	case session.inbound <- packet:
+		return true
+	case <-session.Done():
+		session.dedup.abandon(packet.requestKey())
+		return false
+	}
+}
+
+// dispatch runs the session's handlers one packet at a time, in the order
+// the packets arrived, until the inbound queue is closed and drained or the
+// session is closed.
+func (s *Server) dispatch(session *Session) {
+	for {
+		select {
+		case packet, ok := <-session.inbound:
+			if !ok {
+				return
+			}
+			if s.handleSafely(session, packet) != nil && s.countPanic(session) {
+				session.Close()
+				return
+			}
+			// A closed session handles nothing more, even if it is still queued
+			select {
+			case <-session.Done():
+				return
+			default:
+			}
+		case <-session.Done():
+			return
+		}
+	}
+}
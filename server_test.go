@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Bioblaze/mud/Player"
+)
+
+var testJWTSecret = []byte(DefaultJWTSecret)
+
+// newTestServer returns a Server built from the default config, adjusted by
+// any configure functions.
+func newTestServer(t *testing.T, configure ...func(*Config)) *Server {
+	t.Helper()
+
+	config := DefaultConfig()
+	for _, fn := range configure {
+		fn(config)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Invalid test config: %v", err)
+	}
+
+	srv, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	return srv
+}
+
+func TestNewServerMissingKeyFile(t *testing.T) {
+	config := DefaultConfig()
+	config.JWT.KeyFile = "does-not-exist.pem"
+
+	_, err := NewServer(config)
+	assert.Error(t, err)
+}
+
+func TestServerServeAndClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+
+	srv := newTestServer(t)
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.NoError(t, err)
+	conn.Close()
+
+	assert.NoError(t, srv.Close())
+	select {
+	case err := <-served:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve did not return after Close")
+	}
+}
+
+// startTestServer starts a server on a loopback port and returns it with the
+// address to dial.
+func startTestServer(t *testing.T, configure ...func(*Config)) (*Server, string) {
+	t.Helper()
+
+	configure = append([]func(*Config){func(config *Config) {
+		config.ServerAddress = "127.0.0.1:0"
+	}}, configure...)
+	srv := newTestServer(t, configure...)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	return srv, srv.Addr().String()
+}
+
+// testToken returns a token for accountID signed with testJWTSecret.
+func testToken(t *testing.T, accountID string, roles ...string) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &JwtClaims{AccountID: accountID, Roles: roles})
+	signedToken, err := token.SignedString(testJWTSecret)
+	if err != nil {
+		t.Fatalf("Failed to sign test token: %v", err)
+	}
+	return signedToken
+}
+
+// dialTestClient connects to addr and logs in as accountID with roles.
+func dialTestClient(t *testing.T, addr, accountID string, roles ...string) net.Conn {
+	t.Helper()
+
+	signedToken := testToken(t, accountID, roles...)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to the server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	conn.Write([]byte(signedToken))
+	return conn
+}
+
+// readEvent decodes packets until one named eventName arrives, skipping the
+// others, such as the SPAWN_PLAYER events sent on login.
+func readEvent(decoder *PacketDecoder, eventName string) (*Packet, error) {
+	for {
+		packet, err := decoder.Decode()
+		if err != nil {
+			return nil, err
+		}
+		if packet.EventName == eventName {
+			return &packet, nil
+		}
+	}
+}
+
+func TestServerShutdownNotifiesClients(t *testing.T) {
+	srv, addr := startTestServer(t, func(config *Config) {
+		config.ShutdownMessage = "maintenance"
+	})
+	conn := dialTestClient(t, addr, "account-shutdown")
+	assert.Eventually(t, func() bool { return srv.GetSessions().Count() == 1 }, time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() { result <- srv.Shutdown(ctx) }()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	packet, err := readEvent(NewPacketDecoder(conn, LengthPrefixed, DefaultMaxFrameSize), ServerShutdownEvent)
+	if assert.NoError(t, err) {
+		var notice ShutdownNotice
+		assert.NoError(t, json.Unmarshal(packet.EventBody, &notice))
+		assert.Equal(t, "maintenance", notice.Reason)
+		assert.True(t, notice.CountdownMs > 0 && notice.CountdownMs <= 2000, "countdown %d", notice.CountdownMs)
+	}
+
+	// A well-behaved client disconnects before the deadline
+	conn.Close()
+	assert.NoError(t, <-result)
+	assert.Equal(t, 0, srv.GetSessions().Count())
+
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err, "the listener should be closed")
+}
+
+func TestServerShutdownForceClosesAfterDeadline(t *testing.T) {
+	srv, addr := startTestServer(t)
+	conn := dialTestClient(t, addr, "account-stubborn")
+	assert.Eventually(t, func() bool { return srv.GetSessions().Count() == 1 }, time.Second, 10*time.Millisecond)
+
+	// This one never authenticates
+	idle, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer idle.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	assert.Equal(t, context.DeadlineExceeded, srv.Shutdown(ctx))
+	assert.Less(t, int64(time.Since(start)), int64(FlushTimeout+time.Second))
+
+	// The notice was flushed before the connection was closed
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	decoder := NewPacketDecoder(conn, LengthPrefixed, DefaultMaxFrameSize)
+	_, err = readEvent(decoder, ServerShutdownEvent)
+	assert.NoError(t, err)
+	_, err = decoder.Decode()
+	assert.Equal(t, io.EOF, err)
+
+	idle.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = idle.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestServerShutdownPersistsPlayers(t *testing.T) {
+	store := &recordingPlayerStore{MemoryPlayerStore: NewMemoryPlayerStore()}
+	srv, addr := startTestServer(t)
+	srv.players = store
+
+	dialTestClient(t, addr, "account-persist")
+	assert.Eventually(t, func() bool { return srv.GetSessions().Count() == 1 }, time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	srv.Shutdown(ctx)
+
+	assert.Contains(t, store.saved(), "account-persist")
+}
+
+type recordingPlayerStore struct {
+	*MemoryPlayerStore
+
+	mu       sync.Mutex
+	accounts []string
+}
+
+func (s *recordingPlayerStore) Save(accountID string, player *Player.Player) error {
+	s.mu.Lock()
+	s.accounts = append(s.accounts, accountID)
+	s.mu.Unlock()
+	return s.MemoryPlayerStore.Save(accountID, player)
+}
+
+func (s *recordingPlayerStore) saved() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.accounts...)
+}
+
+// pipeTestClient logs in as accountID over an in-memory connection served by
+// HandleConnection. Unlike TCP, its writes block until the server reads
+// them.
+func pipeTestClient(t *testing.T, srv *Server, accountID string) (net.Conn, *PacketDecoder) {
+	t.Helper()
+
+	client, server := net.Pipe()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go srv.HandleConnection(server, &wg)
+	t.Cleanup(func() {
+		client.Close()
+		wg.Wait()
+	})
+
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	client.Write([]byte(testToken(t, accountID)))
+	decoder := NewPacketDecoder(client, LengthPrefixed, DefaultMaxFrameSize)
+	if _, err := readEvent(decoder, SpawnPlayerEvent); err != nil {
+		t.Fatalf("Failed to log in: %v", err)
+	}
+	client.SetDeadline(time.Time{})
+	return client, decoder
+}
+
+func TestHandleConnectionDispatchesInOrder(t *testing.T) {
+	const count = 20
+
+	srv, addr := startTestServer(t)
+	received := make(chan int, count)
+	srv.RegisterEventHandler("testOrdered", func(session *Session, eventBody json.RawMessage) error {
+		var n int
+		json.Unmarshal(eventBody, &n)
+		if n == 0 {
+			// A slow first handler must not let later packets overtake it
+			time.Sleep(50 * time.Millisecond)
+		}
+		received <- n
+		return nil
+	})
+
+	client, _ := joinTestClient(t, srv, addr, "alice")
+
+	for i := 0; i < count; i++ {
+		body, _ := json.Marshal(i)
+		sendPacket(client, &Packet{EventName: "testOrdered", EventBody: body})
+	}
+
+	for i := 0; i < count; i++ {
+		select {
+		case n := <-received:
+			assert.Equal(t, i, n)
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for packet %d", i)
+		}
+	}
+}
+
+func TestHandleConnectionBackpressure(t *testing.T) {
+	const queueSize = 2
+
+	srv := newTestServer(t, func(config *Config) {
+		config.InboundQueueSize = queueSize
+	})
+	release := make(chan struct{})
+	handled := make(chan struct{}, 16)
+	srv.RegisterEventHandler("testBlocked", func(session *Session, eventBody json.RawMessage) error {
+		<-release
+		handled <- struct{}{}
+		return nil
+	})
+
+	client, _ := pipeTestClient(t, srv, "alice")
+
+	var mu sync.Mutex
+	sent := 0
+	go func() {
+		for i := 0; i < 10; i++ {
+			sendPacket(client, &Packet{EventName: "testBlocked", EventBody: json.RawMessage(`{}`)})
+			mu.Lock()
+			sent++
+			mu.Unlock()
+		}
+	}()
+
+	// One packet in the handler, a full queue and one held by the reader;
+	// the client's next write then blocks
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	blocked := sent
+	mu.Unlock()
+	assert.Less(t, blocked, 10)
+	assert.LessOrEqual(t, blocked, queueSize+2)
+
+	close(release)
+	for i := 0; i < 10; i++ {
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for packet %d", i)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Bioblaze/mud/Player"
+)
+
+const (
+	SendQueueSize = 64
+	WriteTimeout  = 10 * time.Second
+	FlushTimeout  = time.Second
+
+	// DefaultInboundQueueSize bounds how many decoded packets may wait for
+	// the session's dispatcher before the reader stops reading the socket
+	DefaultInboundQueueSize = 32
+)
+
+var (
+	ErrSessionClosed = errors.New("session is closed")
+	ErrSendQueueFull = errors.New("session send queue is full")
+)
+
+// Session wraps an authenticated connection. Reads happen on the connection
+// goroutine, which queues packets on inbound for the session's dispatcher so
+// that handlers run one at a time in arrival order. All writes go through the
+// outbound queue so that handlers never block on a slow client and frames
+// from different goroutines never interleave.
+type Session struct {
+	id        uuid.UUID
+	conn      net.Conn
+	claims    *JwtClaims
+	encoder   *PacketEncoder
+	limiter   *SessionLimiter
+	dedup     *dedupWindow
+	replay    *replayBuffer // nil unless sessions can be resumed
+	hello     *HelloRequest // what the client said it is; set before the session is shared
+	features  map[string]bool
+	codec     Codec // negotiated in the HELLO; the encoder switches to it after the reply
+	inbound   chan Packet
+	panics    int // handler panics, only touched by the dispatcher
+	outbound  chan *Packet
+	metrics   *ServerMetrics // nil outside a server
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu           sync.RWMutex
+	player       *Player.Player
+	legacyBodies bool
+	resumeToken  string
+	pingNonce    uint64    // nonce of the last PING sent to the client
+	pingSent     time.Time // zero once its PONG arrived
+	rtt          time.Duration
+}
+
+// LegacyEvent is implemented by outgoing event bodies that also have the
+// comma-separated string form the UE client parses.
+type LegacyEvent interface {
+	LegacyString() string
+}
+
+func NewSession(conn net.Conn, claims *JwtClaims, config *Config) *Session {
+	s := buildSession(conn, claims, config)
+	s.start()
+	return s
+}
+
+// buildSession makes a session without starting its writer, so that fields
+// can still be set before another goroutine sees them. start must be called
+// before the session is used.
+func buildSession(conn net.Conn, claims *JwtClaims, config *Config) *Session {
+	s := &Session{
+		id:       uuid.New(),
+		conn:     conn,
+		claims:   claims,
+		encoder:  NewPacketEncoder(conn, config.FrameMode, config.MaxFrameSize),
+		limiter:  NewSessionLimiter(config.RateLimit),
+		dedup:    newDedupWindow(config.DedupWindow),
+		inbound:  make(chan Packet, config.InboundQueueSize),
+		outbound: make(chan *Packet, SendQueueSize),
+		done:     make(chan struct{}),
+		hello:    &HelloRequest{ProtocolVersion: 1, legacy: true},
+		codec:    JSONCodec{},
+
+		// Until the client sends a body, assume it is the UE client
+		legacyBodies: true,
+	}
+
+	// The telnet gateway renders JSON bodies as text
+	if _, ok := conn.(*telnetConn); ok {
+		s.legacyBodies = false
+	}
+	if config.ResumeGracePeriod > 0 && config.ReplayBufferSize > 0 {
+		s.replay = newReplayBuffer(config.ReplayBufferSize)
+	}
+	return s
+}
+
+func (s *Session) start() {
+	go s.writeLoop()
+}
+
+func (s *Session) GetID() uuid.UUID {
+	return s.id
+}
+
+func (s *Session) GetClaims() *JwtClaims {
+	return s.claims
+}
+
+// GetPlayer returns the Player bound to the session, or nil before login.
+func (s *Session) GetPlayer() *Player.Player {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.player
+}
+
+// setPlayer is only called by SessionManager.BindPlayer so the indexes stay
+// in sync with the session.
+func (s *Session) setPlayer(player *Player.Player) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.player = player
+}
+
+// ProtocolVersion returns the protocol version agreed in the HELLO, or 1 for
+// clients that sent none.
+func (s *Session) ProtocolVersion() int {
+	return s.hello.ProtocolVersion
+}
+
+// ClientBuild returns the build the client named in its HELLO.
+func (s *Session) ClientBuild() string {
+	return s.hello.ClientBuild
+}
+
+// HasFeature reports whether feature was negotiated for the connection.
+func (s *Session) HasFeature(feature string) bool {
+	return s.features[feature]
+}
+
+// Features returns the negotiated features, sorted.
+func (s *Session) Features() []string {
+	features := make([]string, 0, len(s.features))
+	for feature := range s.features {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+	return features
+}
+
+// Codec returns the codec the connection uses once the HELLO is answered.
+func (s *Session) Codec() Codec {
+	return s.codec
+}
+
+// setHello records the client's HELLO and the features agreed for it.
+func (s *Session) setHello(hello *HelloRequest, features []string) {
+	s.hello = hello
+	s.features = make(map[string]bool, len(features))
+	for _, feature := range features {
+		s.features[feature] = true
+	}
+	s.codec = codecFor(s.features)
+
+	// A client that sends a HELLO is not the UE client of old
+	if !hello.legacy {
+		s.setLegacyBodies(false)
+	}
+}
+
+// LegacyBodies reports whether the client last sent a comma-separated body
+// rather than a JSON object, and so expects SendEvent to reply in kind.
+func (s *Session) LegacyBodies() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.legacyBodies
+}
+
+func (s *Session) setLegacyBodies(legacy bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.legacyBodies = legacy
+}
+
+// RTT returns the round trip time measured by the last answered server
+// PING, or zero before the first one.
+func (s *Session) RTT() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.rtt
+}
+
+// startPing records a new PING and returns its body.
+func (s *Session) startPing() PingBody {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pingNonce++
+	s.pingSent = time.Now()
+	return PingBody{Nonce: s.pingNonce, Timestamp: s.pingSent.UnixNano() / int64(time.Millisecond)}
+}
+
+// recordPong updates the RTT if nonce answers the outstanding PING.
+func (s *Session) recordPong(nonce uint64) (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if nonce == 0 || nonce != s.pingNonce || s.pingSent.IsZero() {
+		return 0, false
+	}
+	s.rtt = time.Since(s.pingSent)
+	s.pingSent = time.Time{}
+	return s.rtt, true
+}
+
+func (s *Session) getResumeToken() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.resumeToken
+}
+
+func (s *Session) setResumeToken(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.resumeToken = token
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// Send marshals body to JSON and queues it. Strings are sent as JSON strings,
+// which is what the UE client expects for its comma-separated bodies.
+func (s *Session) Send(eventName string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return s.SendRaw(eventName, data)
+}
+
+// SendEvent sends body as a JSON object, or as its comma-separated string to
+// clients that speak the legacy form.
+func (s *Session) SendEvent(eventName string, body LegacyEvent) error {
+	if s.LegacyBodies() {
+		return s.Send(eventName, body.LegacyString())
+	}
+	return s.Send(eventName, body)
+}
+
+func (s *Session) SendRaw(eventName string, body json.RawMessage) error {
+	return s.SendPacket(&Packet{EventName: eventName, EventBody: body})
+}
+
+// SendPacket queues a packet without blocking. A full queue means the client
+// is not keeping up; the packet is dropped and ErrSendQueueFull returned.
+//
+// When the session can be resumed the packet is numbered with Seq and kept
+// for replay first, even if the session is already closed.
+func (s *Session) SendPacket(packet *Packet) error {
+	if s.replay != nil {
+		s.replay.mu.Lock()
+		defer s.replay.mu.Unlock()
+
+		packet = s.replay.recordLocked(packet)
+	}
+
+	select {
+	case <-s.done:
+		return ErrSessionClosed
+	default:
+	}
+
+	select {
+	case s.outbound <- packet:
+		s.metrics.packetSent(packet.EventName, len(s.outbound))
+		return nil
+	case <-s.done:
+		return ErrSessionClosed
+	default:
+		logrus.Warn("Send queue full for session ", s.id.String(), ", dropping ", packet.EventName)
+		return ErrSendQueueFull
+	}
+}
+
+// writeFirst writes the HELLO reply straight to the connection, outside the
+// replay buffer and before the encoder switches to what was negotiated. It
+// must be called before anything is queued, while the writer is idle.
+func (s *Session) writeFirst(packet *Packet) error {
+	return s.write(packet, time.Now().Add(WriteTimeout))
+}
+
+// enqueueLocked queues replayed packets, waiting for room in the queue.
+// The caller holds the replay buffer's lock.
+func (s *Session) enqueueLocked(packets []*Packet) {
+	for _, packet := range packets {
+		select {
+		case s.outbound <- packet:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Done is closed once the session has been closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close stops the session. Packets already queued are flushed, bounded by
+// FlushTimeout, before the connection is closed.
+func (s *Session) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+func (s *Session) writeLoop() {
+	defer s.conn.Close()
+
+	for {
+		select {
+		case packet := <-s.outbound:
+			if err := s.write(packet, time.Now().Add(WriteTimeout)); err != nil {
+				logrus.Error("Error writing packet to session ", s.id.String(), ": ", err)
+				s.Close()
+				return
+			}
+		case <-s.done:
+			s.flush()
+			return
+		}
+	}
+}
+
+func (s *Session) flush() {
+	deadline := time.Now().Add(FlushTimeout)
+	for {
+		select {
+		case packet := <-s.outbound:
+			if err := s.write(packet, deadline); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (s *Session) write(packet *Packet, deadline time.Time) error {
+	s.conn.SetWriteDeadline(deadline)
+	return s.encoder.Encode(packet)
+}
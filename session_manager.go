@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+
+	"github.com/Bioblaze/mud/Map"
+	"github.com/Bioblaze/mud/Player"
+)
+
+// SessionManager is the registry of live sessions. Sessions are indexed by
+// session ID as soon as they are added, and by account ID, player UUID and
+// case-insensitive player name once a Player is bound to them.
+type SessionManager struct {
+	mu        sync.RWMutex
+	sessions  map[uuid.UUID]*Session
+	byAccount map[string]*Session
+	byPlayer  map[uuid.UUID]*Session
+	byName    map[string]*Session
+}
+
+func NewSessionManager() *SessionManager {
+	return &SessionManager{
+		sessions:  make(map[uuid.UUID]*Session),
+		byAccount: make(map[string]*Session),
+		byPlayer:  make(map[uuid.UUID]*Session),
+		byName:    make(map[string]*Session),
+	}
+}
+
+func accountKey(session *Session) string {
+	if session.claims == nil {
+		return ""
+	}
+	return session.claims.GetAccountID()
+}
+
+func nameKey(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+func (sm *SessionManager) Add(session *Session) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.sessions[session.id] = session
+	if player := session.GetPlayer(); player != nil {
+		sm.byPlayer[player.GetID()] = session
+		sm.byName[nameKey(player.GetName())] = session
+	}
+}
+
+// Remove drops the session from every index. Indexes that have since been
+// claimed by another session are left alone.
+func (sm *SessionManager) Remove(session *Session) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.unindexLocked(session)
+	if sm.sessions[session.id] == session {
+		delete(sm.sessions, session.id)
+	}
+}
+
+func (sm *SessionManager) unindexLocked(session *Session) {
+	if account := accountKey(session); account != "" && sm.byAccount[account] == session {
+		delete(sm.byAccount, account)
+	}
+
+	if player := session.GetPlayer(); player != nil {
+		if sm.byPlayer[player.GetID()] == session {
+			delete(sm.byPlayer, player.GetID())
+		}
+		key := nameKey(player.GetName())
+		if sm.byName[key] == session {
+			delete(sm.byName, key)
+		}
+	}
+}
+
+// BindPlayer attaches player to session and indexes it. It fails if another
+// live session already uses the player's ID or name.
+func (sm *SessionManager) BindPlayer(session *Session, player *Player.Player) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	return sm.bindLocked(session, player)
+}
+
+// Login binds player to session on behalf of its account. When the account
+// already has a live session, policy decides whether the login fails with
+// ErrAlreadyLoggedIn or the older session is unindexed and returned so the
+// caller can notify and close it.
+func (sm *SessionManager) Login(session *Session, player *Player.Player, policy LoginPolicy) (*Session, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	account := accountKey(session)
+
+	var kicked *Session
+	if existing, ok := sm.byAccount[account]; ok && existing != session {
+		if policy != LoginKickOld {
+			return nil, ErrAlreadyLoggedIn
+		}
+		kicked = existing
+		sm.unindexLocked(kicked)
+		delete(sm.sessions, kicked.id)
+	}
+
+	if err := sm.bindLocked(session, player); err != nil {
+		return nil, err
+	}
+
+	if account != "" {
+		sm.byAccount[account] = session
+	}
+	return kicked, nil
+}
+
+func (sm *SessionManager) bindLocked(session *Session, player *Player.Player) error {
+	if other, ok := sm.byPlayer[player.GetID()]; ok && other != session {
+		return fmt.Errorf("player %s is already bound to session %s", player.GetID().String(), other.id.String())
+	}
+
+	key := nameKey(player.GetName())
+	if other, ok := sm.byName[key]; ok && other != session {
+		return fmt.Errorf("player name %s is already in use", player.GetName())
+	}
+
+	if previous := session.GetPlayer(); previous != nil {
+		delete(sm.byPlayer, previous.GetID())
+		delete(sm.byName, nameKey(previous.GetName()))
+	}
+
+	session.setPlayer(player)
+	sm.byPlayer[player.GetID()] = session
+	sm.byName[key] = session
+
+	return nil
+}
+
+// Replace hands every index of old, and its player, to session, which takes
+// over a resumed session.
+func (sm *SessionManager) Replace(old, session *Session) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.unindexLocked(old)
+	if sm.sessions[old.id] == old {
+		delete(sm.sessions, old.id)
+	}
+
+	sm.sessions[session.id] = session
+	if account := accountKey(session); account != "" {
+		sm.byAccount[account] = session
+	}
+	if player := old.GetPlayer(); player != nil {
+		session.setPlayer(player)
+		sm.byPlayer[player.GetID()] = session
+		sm.byName[nameKey(player.GetName())] = session
+	}
+}
+
+func (sm *SessionManager) Get(id uuid.UUID) (*Session, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	session, ok := sm.sessions[id]
+	return session, ok
+}
+
+func (sm *SessionManager) GetByAccount(accountID string) (*Session, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	session, ok := sm.byAccount[accountID]
+	return session, ok
+}
+
+func (sm *SessionManager) GetByPlayer(playerId uuid.UUID) (*Session, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	session, ok := sm.byPlayer[playerId]
+	return session, ok
+}
+
+func (sm *SessionManager) GetByName(name string) (*Session, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	session, ok := sm.byName[nameKey(name)]
+	return session, ok
+}
+
+func (sm *SessionManager) Count() int {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	return len(sm.sessions)
+}
+
+// All returns a snapshot of the live sessions.
+func (sm *SessionManager) All() []*Session {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	sessions := make([]*Session, 0, len(sm.sessions))
+	for _, session := range sm.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// ForEach calls fn for every live session until fn returns false. It works
+// on a snapshot, so fn may add or remove sessions.
+func (sm *SessionManager) ForEach(fn func(session *Session) bool) {
+	for _, session := range sm.All() {
+		if !fn(session) {
+			return
+		}
+	}
+}
+
+// Broadcast sends an event to every live session except the ones listed in
+// exclude. The body is marshalled once for all recipients.
+func (sm *SessionManager) Broadcast(eventName string, body interface{}, exclude ...*Session) error {
+	return sm.Multicast(func(session *Session) bool {
+		for _, excluded := range exclude {
+			if session == excluded {
+				return false
+			}
+		}
+		return true
+	}, eventName, body)
+}
+
+// Multicast sends an event to every live session accepted by filter.
+func (sm *SessionManager) Multicast(filter func(session *Session) bool, eventName string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	sm.ForEach(func(session *Session) bool {
+		if filter(session) {
+			session.SendRaw(eventName, data)
+		}
+		return true
+	})
+	return nil
+}
+
+// SendTo sends an event to the session of the named player.
+func (sm *SessionManager) SendTo(name string, eventName string, body interface{}) error {
+	session, ok := sm.GetByName(name)
+	if !ok {
+		return fmt.Errorf("player %s is not online", name)
+	}
+	return session.Send(eventName, body)
+}
+
+// SendToMap sends an event to every session whose Player is on m.
+func (sm *SessionManager) SendToMap(m *Map.Map, eventName string, body interface{}) error {
+	mapId := m.GetID()
+	return sm.Multicast(func(session *Session) bool {
+		player := session.GetPlayer()
+		if player == nil {
+			return false
+		}
+		_, _, playerMapId := player.GetLocation()
+		return playerMapId == mapId
+	}, eventName, body)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Bioblaze/mud/Map"
+	"github.com/Bioblaze/mud/Player"
+)
+
+// newTestSession returns a session whose outbound packets can be read from
+// the returned client end.
+func newTestSession(t *testing.T) (*Session, *PacketDecoder) {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+
+	session := NewSession(server, nil, DefaultConfig())
+	t.Cleanup(session.Close)
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	return session, NewPacketDecoder(client, LengthPrefixed, DefaultMaxFrameSize)
+}
+
+func TestSessionManagerLookup(t *testing.T) {
+	sm := NewSessionManager()
+	session, _ := newTestSession(t)
+	player := Player.NewPlayer("Alice", 20, 2, 10, 5)
+
+	sm.Add(session)
+	assert.NoError(t, sm.BindPlayer(session, player))
+
+	found, ok := sm.Get(session.GetID())
+	assert.True(t, ok)
+	assert.Equal(t, session, found)
+
+	found, ok = sm.GetByPlayer(player.GetID())
+	assert.True(t, ok)
+	assert.Equal(t, session, found)
+
+	found, ok = sm.GetByName("alice")
+	assert.True(t, ok)
+	assert.Equal(t, session, found)
+	assert.Equal(t, player, found.GetPlayer())
+
+	sm.Remove(session)
+	assert.Equal(t, 0, sm.Count())
+	_, ok = sm.GetByName("Alice")
+	assert.False(t, ok)
+}
+
+func TestSessionManagerBindPlayerConflict(t *testing.T) {
+	sm := NewSessionManager()
+	first, _ := newTestSession(t)
+	second, _ := newTestSession(t)
+	sm.Add(first)
+	sm.Add(second)
+
+	assert.NoError(t, sm.BindPlayer(first, Player.NewPlayer("Alice", 20, 2, 10, 5)))
+	assert.Error(t, sm.BindPlayer(second, Player.NewPlayer("ALICE", 20, 2, 10, 5)))
+}
+
+func TestSessionManagerBroadcast(t *testing.T) {
+	sm := NewSessionManager()
+	alice, aliceIn := newTestSession(t)
+	bob, bobIn := newTestSession(t)
+	sm.Add(alice)
+	sm.Add(bob)
+
+	assert.NoError(t, sm.Broadcast("CHAT", "Server,hello", bob))
+
+	packet, err := aliceIn.Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, "CHAT", packet.EventName)
+	assert.Equal(t, `"Server,hello"`, string(packet.EventBody))
+
+	assert.NoError(t, sm.Broadcast("CHAT", "Server,everyone"))
+	packet, err = bobIn.Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, `"Server,everyone"`, string(packet.EventBody))
+}
+
+func TestSessionManagerSendTo(t *testing.T) {
+	sm := NewSessionManager()
+	session, in := newTestSession(t)
+	sm.Add(session)
+	sm.BindPlayer(session, Player.NewPlayer("Bob", 20, 2, 10, 5))
+
+	assert.NoError(t, sm.SendTo("bob", "PRIVATE_CHAT", "Alice,psst"))
+	packet, err := in.Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, "PRIVATE_CHAT", packet.EventName)
+
+	assert.Error(t, sm.SendTo("nobody", "PRIVATE_CHAT", "Alice,psst"))
+}
+
+func TestSessionManagerSendToMap(t *testing.T) {
+	sm := NewSessionManager()
+	town := Map.NewMap("Town", 10, 10)
+	forest := Map.NewMap("Forest", 10, 10)
+
+	inTown, townIn := newTestSession(t)
+	inForest, _ := newTestSession(t)
+	sm.Add(inTown)
+	sm.Add(inForest)
+
+	alice := Player.NewPlayer("Alice", 20, 2, 10, 5)
+	alice.SetLocation(1, 1, town.GetID())
+	bob := Player.NewPlayer("Bob", 20, 2, 10, 5)
+	bob.SetLocation(1, 1, forest.GetID())
+	sm.BindPlayer(inTown, alice)
+	sm.BindPlayer(inForest, bob)
+
+	assert.NoError(t, sm.SendToMap(town, "SPAWN_OBJECT", "1,2.0,3.0"))
+	assert.NoError(t, inTown.Send("CHAT", "marker"))
+
+	packet, err := townIn.Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, "SPAWN_OBJECT", packet.EventName)
+
+	packet, err = townIn.Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, "CHAT", packet.EventName)
+}
+
+func TestHandleConnectionRemovesSession(t *testing.T) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &JwtClaims{AccountID: "account-remove"})
+	signedToken, err := token.SignedString(testJWTSecret)
+	assert.NoError(t, err)
+
+	srv := newTestServer(t, func(config *Config) {
+		config.ResumeGracePeriod = 0
+	})
+	client, server := createMockConnection()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go srv.HandleConnection(server, &wg)
+
+	client.Write([]byte(signedToken))
+	assert.Eventually(t, func() bool { return srv.GetSessions().Count() == 1 }, time.Second, 10*time.Millisecond)
+
+	client.Close()
+	wg.Wait()
+	assert.Equal(t, 0, srv.GetSessions().Count())
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionSend(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	session := NewSession(server, nil, DefaultConfig())
+	defer session.Close()
+
+	assert.NoError(t, session.Send("CHAT", "Alice,hello"))
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	packet, err := readPacket(client)
+	assert.NoError(t, err)
+	assert.Equal(t, "CHAT", packet.EventName)
+	assert.Equal(t, `"Alice,hello"`, string(packet.EventBody))
+}
+
+func TestSessionSendAfterClose(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	session := NewSession(server, nil, DefaultConfig())
+	session.Close()
+
+	assert.Equal(t, ErrSessionClosed, session.Send("CHAT", "hello"))
+}
+
+func TestSessionSendQueueFull(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	session := NewSession(server, nil, DefaultConfig())
+	defer session.Close()
+
+	// Nobody reads from the client, so the writer blocks on the first packet
+	// and the queue fills up behind it
+	var err error
+	for i := 0; i < SendQueueSize+2 && err == nil; i++ {
+		err = session.Send("CHAT", "spam")
+	}
+	assert.Equal(t, ErrSendQueueFull, err)
+}
+
+func TestHandlerReplyThroughSession(t *testing.T) {
+	eventName := "testEcho"
+	srv, addr := startTestServer(t)
+	srv.RegisterEventHandler(eventName, func(session *Session, eventBody json.RawMessage) error {
+		session.SendRaw(eventName, eventBody)
+		return nil
+	})
+
+	client, decoder := joinTestClient(t, srv, addr, "alice")
+
+	sendPacket(client, &Packet{EventName: eventName, EventBody: json.RawMessage(`{"n":1}`)})
+
+	reply, err := decoder.Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, eventName, reply.EventName)
+	assert.Equal(t, `{"n":1}`, string(reply.EventBody))
+}
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Telnet gateway
+//
+// Players without the game client can connect to TelnetAddress with any
+// telnet or MUD client. The gateway asks for a login name and a password,
+// which is the player's login token, then hands the connection to
+// HandleConnection as if the client had sent a HELLO with that token. From
+// there every line the player types is sent as a COMMAND, and every packet
+// the server sends is rendered as text, so telnet players go through the
+// same commands, handlers, rate limits and world as everyone else.
+
+const (
+	DefaultTelnetIdleTimeout = 30 * time.Minute
+	DefaultTelnetWidth       = 80
+
+	// TelnetLoginTimeout is how long a telnet client has to log in, and
+	// TelnetLoginAttempts how many passwords it may try
+	TelnetLoginTimeout  = time.Minute
+	TelnetLoginAttempts = 3
+
+	// TelnetClientBuild is the client build telnet sessions report
+	TelnetClientBuild = "telnet"
+
+	telnetIAC  = 255
+	telnetDONT = 254
+	telnetDO   = 253
+	telnetWONT = 252
+	telnetWILL = 251
+	telnetSB   = 250
+	telnetSE   = 240
+
+	telnetOptEcho = 1
+	telnetOptNAWS = 31
+
+	telnetMaxSubnegotiation = 64
+)
+
+const (
+	ansiReset   = "\x1b[0m"
+	ansiBold    = "\x1b[1m"
+	ansiRed     = "\x1b[31m"
+	ansiGreen   = "\x1b[32m"
+	ansiYellow  = "\x1b[33m"
+	ansiMagenta = "\x1b[35m"
+	ansiCyan    = "\x1b[36m"
+)
+
+// telnetConn is a telnet connection in line mode. ReadMessage turns the lines
+// the player types into JSON packets and WriteMessage renders the packets the
+// server sends as text; Read returns the same packets as a stream.
+type telnetConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	writeMu sync.Mutex
+
+	mu     sync.Mutex
+	width  int    // columns, as reported through NAWS
+	color  bool   // whether to use ANSI colors
+	name   string // of the player, once logged in
+	looked bool   // a LOOK was rendered, which lists who was already here
+
+	// Only touched by the reading goroutine
+	hiding  bool     // ECHO is on offer, so the client does not echo
+	skipLF  bool     // the last line ended with CR, which may be followed by LF or NUL
+	pending [][]byte // packets to return before reading another line
+	partial []byte   // rest of the message being read through Read
+}
+
+func newTelnetConn(conn net.Conn) *telnetConn {
+	return &telnetConn{
+		Conn:  conn,
+		r:     bufio.NewReader(conn),
+		width: DefaultTelnetWidth,
+		color: true,
+	}
+}
+
+func (c *telnetConn) Read(p []byte) (int, error) {
+	if len(c.partial) == 0 {
+		message, err := c.ReadMessage(DefaultMaxFrameSize)
+		if err != nil {
+			return 0, err
+		}
+		c.partial = message
+	}
+	n := copy(p, c.partial)
+	c.partial = c.partial[n:]
+	return n, nil
+}
+
+// Write sends p to the client as text.
+func (c *telnetConn) Write(p []byte) (int, error) {
+	if err := c.writeText(string(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ReadMessage returns the next packet for the session: one queued by an
+// earlier line, or what the next line typed stands for. Lines that need no
+// packet, such as color, are answered here.
+func (c *telnetConn) ReadMessage(maxSize int) ([]byte, error) {
+	for len(c.pending) == 0 {
+		line, err := c.readLine(maxSize)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.interpret(line); err != nil {
+			return nil, err
+		}
+	}
+
+	message := c.pending[0]
+	c.pending = c.pending[1:]
+	return message, nil
+}
+
+// WriteMessage renders a packet from the server as text. Packets that mean
+// nothing to a player, such as PING, are dropped.
+func (c *telnetConn) WriteMessage(data []byte, binary bool) error {
+	var packet Packet
+	if err := (JSONCodec{}).Unmarshal(data, &packet); err != nil {
+		return err
+	}
+	text := c.render(&packet)
+	if text == "" {
+		return nil
+	}
+	return c.writeText(text)
+}
+
+// queue adds a packet for ReadMessage to return.
+func (c *telnetConn) queue(eventName string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	message, err := JSONCodec{}.Marshal(&Packet{EventName: eventName, EventBody: data})
+	if err != nil {
+		return err
+	}
+	c.pending = append(c.pending, message)
+	return nil
+}
+
+// interpret queues the COMMAND a typed line stands for, or answers the
+// commands that only concern the terminal. It returns io.EOF when the player
+// quits.
+func (c *telnetConn) interpret(line string) error {
+	verb, _ := splitWord(line)
+
+	switch strings.ToLower(verb) {
+	case "":
+		return nil
+	case "color", "colour":
+		c.mu.Lock()
+		c.color = !c.color
+		color := c.color
+		c.mu.Unlock()
+		if color {
+			return c.writeText(c.paint(ansiGreen, "Colors on.") + "\n")
+		}
+		return c.writeText("Colors off.\n")
+	case "quit":
+		c.writeText("Goodbye.\n")
+		return io.EOF
+	default:
+		return c.queue(CommandEvent, CommandBody{Line: line})
+	}
+}
+
+// render turns a packet into the text shown to the player, or "" for
+// packets that are not shown.
+func (c *telnetConn) render(packet *Packet) string {
+	decode := func(body interface{}) bool {
+		return json.Unmarshal(packet.EventBody, body) == nil
+	}
+
+	c.mu.Lock()
+	self := c.name
+	c.mu.Unlock()
+	isSelf := func(name string) bool {
+		return strings.EqualFold(name, self)
+	}
+
+	switch packet.EventName {
+	case LookEvent:
+		var body Surroundings
+		if !decode(&body) {
+			return ""
+		}
+		c.mu.Lock()
+		c.looked = true
+		c.mu.Unlock()
+
+		text := c.paint(ansiBold, fmt.Sprintf("%s (%d, %d)", plainText(body.Map), body.X, body.Y)) + "\n" +
+			c.wrap("You are in "+body.Terrain+".") + "\n"
+		if len(body.Exits) > 0 {
+			text += c.paint(ansiGreen, c.wrap("Exits: "+strings.ToLower(strings.Join(body.Exits, " ")))) + "\n"
+		} else {
+			text += c.paint(ansiGreen, "There is no way out.") + "\n"
+		}
+		if len(body.Players) > 0 {
+			text += c.wrap("Also here: "+plainText(strings.Join(body.Players, ", "))+".") + "\n"
+		}
+		return text
+	case SpawnPlayerEvent:
+		var body PlayerPosition
+		if !decode(&body) {
+			return ""
+		}
+		c.mu.Lock()
+		looked := c.looked
+		c.mu.Unlock()
+		// Those already here at login are listed by the first LOOK
+		if isSelf(body.Name) || !looked {
+			return ""
+		}
+		return c.wrap(plainText(body.Name)+" is here.") + "\n"
+	case MoveEvent:
+		var body PlayerPosition
+		if !decode(&body) || isSelf(body.Name) {
+			return ""
+		}
+		return c.wrap(fmt.Sprintf("%s moves to (%d, %d).", plainText(body.Name), body.X, body.Y)) + "\n"
+	case SpawnObjectEvent:
+		var body ObjectPosition
+		if !decode(&body) {
+			return ""
+		}
+		return fmt.Sprintf("Something appears at (%d, %d).\n", body.X, body.Y)
+	case ChatEvent:
+		var body ChatMessage
+		if !decode(&body) {
+			return ""
+		}
+		if isSelf(body.From) {
+			return c.paint(ansiCyan, c.wrap("You say: "+plainText(body.Message))) + "\n"
+		}
+		return c.paint(ansiCyan, c.wrap(plainText(body.From)+" says: "+plainText(body.Message))) + "\n"
+	case PrivateChatEvent:
+		var body ChatMessage
+		if !decode(&body) {
+			return ""
+		}
+		return c.paint(ansiMagenta, c.wrap(plainText(body.From)+" tells you: "+plainText(body.Message))) + "\n"
+	case WhoEvent:
+		var body WhoList
+		if !decode(&body) {
+			return ""
+		}
+		text := c.paint(ansiBold, fmt.Sprintf("%d player(s) online:", len(body.Players))) + "\n"
+		for _, entry := range body.Players {
+			text += "  " + plainText(entry.Name)
+			if entry.Map != "" {
+				text += " (" + plainText(entry.Map) + ")"
+			}
+			text += "\n"
+		}
+		return text
+	case ScoreEvent:
+		var body Score
+		if !decode(&body) {
+			return ""
+		}
+		return c.paint(ansiBold, fmt.Sprintf("%s, level %d", plainText(body.Name), body.Level)) + "\n" +
+			fmt.Sprintf("HP %d/%d  Exp %d  Armor %.1f\n", body.HP, body.MaxHP, body.Exp, body.ArmorRating)
+	case TextEvent:
+		var body TextMessage
+		if !decode(&body) {
+			return ""
+		}
+		// Command output is laid out already, so it is not wrapped
+		lines := strings.Split(strings.TrimRight(body.Text, "\n"), "\n")
+		for i, line := range lines {
+			lines[i] = plainText(line)
+		}
+		return strings.Join(lines, "\n") + "\n"
+	case AnnounceEvent:
+		var body Announcement
+		if !decode(&body) {
+			return ""
+		}
+		return c.paint(ansiYellow, c.wrap(plainText(body.From)+" announces: "+plainText(body.Message))) + "\n"
+	case ErrorEvent:
+		var body ErrorNotice
+		if !decode(&body) {
+			return ""
+		}
+		return c.paint(ansiRed, c.wrap(plainText(body.Message))) + "\n"
+	case KickedEvent:
+		var body map[string]string
+		if !decode(&body) {
+			return ""
+		}
+		return c.paint(ansiYellow, c.wrap("You have been disconnected: "+plainText(body["reason"]))) + "\n"
+	case ServerShutdownEvent:
+		var body ShutdownNotice
+		if !decode(&body) {
+			return ""
+		}
+		return c.paint(ansiYellow, c.wrap(plainText(body.Reason))) + "\n"
+	default:
+		return ""
+	}
+}
+
+// paint colors text when the player has colors on.
+func (c *telnetConn) paint(color, text string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.color {
+		return text
+	}
+	return color + text + ansiReset
+}
+
+// wrap breaks text into lines that fit the client's width.
+func (c *telnetConn) wrap(text string) string {
+	c.mu.Lock()
+	width := c.width
+	c.mu.Unlock()
+
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		if line != "" && len(line)+1+len(word) > width {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	return strings.Join(append(lines, line), "\n")
+}
+
+// plainText strips control characters, so text from other players cannot
+// send escape sequences to the terminal.
+func plainText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// writeText sends text to the client, with line breaks as CR LF and IAC
+// bytes escaped.
+func (c *telnetConn) writeText(text string) error {
+	text = strings.ReplaceAll(text, "\n", "\r\n")
+	text = strings.ReplaceAll(text, "\xff", "\xff\xff")
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	_, err := c.Conn.Write([]byte(text))
+	return err
+}
+
+func (c *telnetConn) sendCommand(command, option byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	_, err := c.Conn.Write([]byte{telnetIAC, command, option})
+	return err
+}
+
+// hideInput offers to echo what the client types, so that it stops echoing
+// itself while a password is typed, or withdraws the offer.
+func (c *telnetConn) hideInput(hide bool) error {
+	c.hiding = hide
+	if hide {
+		return c.sendCommand(telnetWILL, telnetOptEcho)
+	}
+	return c.sendCommand(telnetWONT, telnetOptEcho)
+}
+
+// readLine returns the next line typed, handling telnet commands on the way.
+// Lines end with CR LF, CR NUL or a bare LF; backspaces from clients that
+// send each key are applied.
+func (c *telnetConn) readLine(maxSize int) (string, error) {
+	var line []byte
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+
+		skipLF := c.skipLF
+		c.skipLF = false
+		switch {
+		case b == telnetIAC:
+			escaped, err := c.readCommand()
+			if err != nil {
+				return "", err
+			}
+			if !escaped {
+				continue
+			}
+		case b == '\r':
+			c.skipLF = true
+			return string(line), nil
+		case b == '\n' || b == 0:
+			if skipLF {
+				continue
+			}
+			if b == '\n' {
+				return string(line), nil
+			}
+			continue
+		case b == '\b' || b == 0x7f:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+			}
+			continue
+		case b < 0x20:
+			continue
+		}
+
+		if len(line) >= maxSize {
+			return "", ErrFrameTooLarge
+		}
+		line = append(line, b)
+	}
+}
+
+// readCommand handles the telnet command following an IAC. It reports
+// whether the command was an escaped 0xff data byte.
+func (c *telnetConn) readCommand() (bool, error) {
+	command, err := c.r.ReadByte()
+	if err != nil {
+		return false, err
+	}
+
+	switch command {
+	case telnetIAC:
+		return true, nil
+	case telnetDO, telnetDONT, telnetWILL, telnetWONT:
+		option, err := c.r.ReadByte()
+		if err != nil {
+			return false, err
+		}
+		return false, c.negotiate(command, option)
+	case telnetSB:
+		return false, c.readSubnegotiation()
+	default:
+		// NOP, GA, AYT and the like need no answer in line mode
+		return false, nil
+	}
+}
+
+// negotiate answers an option request. The server only asks for NAWS and
+// offers ECHO while a password is typed; anything else is refused.
+func (c *telnetConn) negotiate(command, option byte) error {
+	switch command {
+	case telnetWILL:
+		if option != telnetOptNAWS {
+			return c.sendCommand(telnetDONT, option)
+		}
+	case telnetDO:
+		if option != telnetOptEcho || !c.hiding {
+			return c.sendCommand(telnetWONT, option)
+		}
+	}
+	return nil
+}
+
+// readSubnegotiation reads up to IAC SE, taking the window size from NAWS.
+func (c *telnetConn) readSubnegotiation() error {
+	var data []byte
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b == telnetIAC {
+			if b, err = c.r.ReadByte(); err != nil {
+				return err
+			}
+			if b == telnetSE {
+				break
+			}
+		}
+		if len(data) < telnetMaxSubnegotiation {
+			data = append(data, b)
+		}
+	}
+
+	if len(data) == 5 && data[0] == telnetOptNAWS {
+		if width := int(binary.BigEndian.Uint16(data[1:3])); width > 0 {
+			c.mu.Lock()
+			c.width = width
+			c.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+// startTelnet listens for telnet clients when TelnetAddress is set, behind
+// TLS when the TCP listener is.
+func (s *Server) startTelnet() error {
+	if s.config.Telnet.Address == "" {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", s.config.Telnet.Address)
+	if err != nil {
+		return err
+	}
+	ln = s.wrapListener(ln)
+
+	s.mu.Lock()
+	s.telnetListener = ln
+	s.mu.Unlock()
+
+	logrus.Info("Telnet gateway listening on ", ln.Addr().String())
+	go s.serveTelnet(ln)
+	return nil
+}
+
+func (s *Server) serveTelnet(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logrus.Error("Error accepting telnet connection: ", err)
+			continue
+		}
+
+		done, ok := s.admit(conn)
+		if !ok {
+			continue
+		}
+		go func() {
+			defer done()
+			s.handleTelnet(conn)
+		}()
+	}
+}
+
+// handleTelnet logs a telnet client in and hands the connection to
+// HandleConnection.
+func (s *Server) handleTelnet(conn net.Conn) {
+	tc := newTelnetConn(conn)
+	if err := s.telnetLogin(tc); err != nil {
+		logrus.Warn("Telnet login from ", conn.RemoteAddr().String(), " failed: ", err)
+		conn.Close()
+		s.wg.Done()
+		return
+	}
+	s.HandleConnection(tc, &s.wg)
+}
+
+// telnetLogin prompts for a login name and password until the password is a
+// token for that name. It then queues the HELLO HandleConnection expects,
+// followed by a LOOK so the player sees where they are.
+func (s *Server) telnetLogin(tc *telnetConn) error {
+	tc.SetDeadline(time.Now().Add(TelnetLoginTimeout))
+	if err := tc.sendCommand(telnetDO, telnetOptNAWS); err != nil {
+		return err
+	}
+
+	for attempt := 0; attempt < TelnetLoginAttempts; attempt++ {
+		tc.writeText("Login: ")
+		name, err := tc.readLine(s.config.MaxFrameSize)
+		if err != nil {
+			return err
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		tc.hideInput(true)
+		tc.writeText("Password: ")
+		password, err := tc.readLine(s.config.MaxFrameSize)
+		tc.hideInput(false)
+		tc.writeText("\n")
+		if err != nil {
+			return err
+		}
+
+		token := strings.TrimSpace(password)
+		claims, err := s.verifier.Parse(token)
+		if err == nil && !strings.EqualFold(name, claims.GetAccountID()) && !strings.EqualFold(name, claims.GetCharacterName()) {
+			err = fmt.Errorf("token is not for %s", name)
+		}
+		if err != nil {
+			logrus.Warn("Telnet login as ", name, " failed: ", err)
+			s.metrics.authFailed("telnet")
+			tc.writeText("Login incorrect.\n\n")
+			continue
+		}
+
+		tc.mu.Lock()
+		tc.name = claims.GetCharacterName()
+		tc.mu.Unlock()
+
+		hello, err := json.Marshal(HelloRequest{ProtocolVersion: ProtocolVersion, ClientBuild: TelnetClientBuild, Token: token})
+		if err != nil {
+			return err
+		}
+		tc.pending = [][]byte{hello}
+		tc.writeText("Welcome, " + plainText(tc.name) + ". Type help for a list of commands, color to turn colors on or off and quit to leave.\n")
+		return tc.queue(LookEvent, QueryBody{})
+	}
+
+	tc.writeText("Too many failed attempts.\n")
+	return errors.New("too many failed attempts")
+}
+
+// TelnetAddr returns the address of the telnet gateway, or nil when it is
+// not running.
+func (s *Server) TelnetAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.telnetListener == nil {
+		return nil
+	}
+	return s.telnetListener.Addr()
+}
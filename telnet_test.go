@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startTelnetTestServer(t *testing.T, configure ...func(*Config)) (*Server, string) {
+	t.Helper()
+
+	configure = append([]func(*Config){func(config *Config) {
+		config.Telnet.Address = "127.0.0.1:0"
+	}}, configure...)
+	srv, _ := startTestServer(t, configure...)
+	return srv, srv.TelnetAddr().String()
+}
+
+// telnetClient is the test side of a telnet connection, reading raw bytes so
+// tests can see option negotiation as well as text.
+type telnetClient struct {
+	t    *testing.T
+	conn net.Conn
+	seen bytes.Buffer
+}
+
+func dialTelnet(t *testing.T, addr string) *telnetClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to the telnet gateway: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &telnetClient{t: t, conn: conn}
+}
+
+func (c *telnetClient) send(data string) {
+	c.conn.Write([]byte(data))
+}
+
+// expect reads until want has arrived and returns everything read up to and
+// including it.
+func (c *telnetClient) expect(want string) string {
+	c.t.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1024)
+	for {
+		if i := strings.Index(c.seen.String(), want); i >= 0 {
+			read := c.seen.String()[:i+len(want)]
+			c.seen.Next(i + len(want))
+			return read
+		}
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			c.t.Fatalf("Waiting for %q, got %q: %v", want, c.seen.String(), err)
+		}
+		c.seen.Write(buf[:n])
+	}
+}
+
+// login answers the prompts with accountID and a valid token.
+func (c *telnetClient) login(accountID string) {
+	c.t.Helper()
+
+	c.expect("Login: ")
+	c.send(accountID + "\r\n")
+	c.expect("Password: ")
+	c.send(testToken(c.t, accountID) + "\r\n")
+	c.expect("Welcome, " + accountID)
+}
+
+func TestTelnetLogin(t *testing.T) {
+	srv, addr := startTelnetTestServer(t)
+	client := dialTelnet(t, addr)
+
+	// The gateway asks for the window size and hides the password
+	assert.Contains(t, client.expect("Login: "), string([]byte{telnetIAC, telnetDO, telnetOptNAWS}))
+	client.send("alice\r\n")
+	assert.Contains(t, client.expect("Password: "), string([]byte{telnetIAC, telnetWILL, telnetOptEcho}))
+	client.send(testToken(t, "alice") + "\r\n")
+	assert.Contains(t, client.expect("Welcome, alice"), string([]byte{telnetIAC, telnetWONT, telnetOptEcho}))
+
+	// and shows where the player is
+	client.expect(StartMapName + " (")
+	client.expect("You are in ")
+	assert.Equal(t, 1, srv.GetSessions().Count())
+	session, _ := srv.GetSessions().GetByAccount("alice")
+	assert.Equal(t, TelnetClientBuild, session.ClientBuild())
+}
+
+func TestTelnetLoginRefused(t *testing.T) {
+	srv, addr := startTelnetTestServer(t)
+	client := dialTelnet(t, addr)
+
+	// A valid token for somebody else is no good
+	client.expect("Login: ")
+	client.send("alice\r\n")
+	client.expect("Password: ")
+	client.send(testToken(t, "bob") + "\r\n")
+	client.expect("Login incorrect.")
+
+	for i := 1; i < TelnetLoginAttempts; i++ {
+		client.expect("Login: ")
+		client.send("alice\r\n")
+		client.expect("Password: ")
+		client.send("hunter2\r\n")
+	}
+	client.expect("Too many failed attempts.")
+
+	_, err := io.ReadAll(client.conn)
+	assert.NoError(t, err, "the connection is closed")
+	assert.Zero(t, srv.GetSessions().Count())
+}
+
+func TestTelnetCommands(t *testing.T) {
+	srv, addr := startTelnetTestServer(t)
+	client := dialTelnet(t, addr)
+	client.login("alice")
+	client.expect("You are in ")
+
+	bobConn, bob := joinTestClient(t, srv, srv.Addr().String(), "bob")
+	client.expect("bob is here.")
+
+	client.send("say hello there\r\n")
+	client.expect(ansiCyan + "You say: hello there" + ansiReset)
+	packet, err := readEvent(bob, ChatEvent)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `"alice,hello there"`, string(packet.EventBody))
+	}
+
+	sendPacket(bobConn, &Packet{EventName: ChatEvent, EventBody: json.RawMessage(`{"message":"hi \u001b[2Jalice"}`)})
+	client.expect("bob says: hi [2Jalice")
+
+	client.send("tell bob psst\r\n")
+	packet, err = readEvent(bob, PrivateChatEvent)
+	if assert.NoError(t, err) {
+		assert.JSONEq(t, `{"from":"alice","message":"psst"}`, string(packet.EventBody))
+	}
+	client.send("tell carol psst\r\n")
+	client.expect(ansiRed + "Player carol is not online" + ansiReset)
+
+	client.send("who\r\n")
+	assert.Contains(t, client.expect("bob (Start)"), "alice (Start)")
+
+	client.send("score\r\n")
+	client.expect("alice, level 1")
+	client.expect("HP 10/10")
+
+	client.send("color\r\n")
+	client.expect("Colors off.")
+	client.send("look\r\n")
+	client.expect("Also here: bob.")
+
+	client.send("dance\r\n")
+	client.expect("Unknown command dance.")
+
+	// Commands are shared with every client, abbreviations included
+	client.send("he tell\r\n")
+	client.expect("Usage: tell <player> <message...>")
+
+	client.send("QUIT\r\n")
+	client.expect("Goodbye.")
+	assert.Eventually(t, func() bool {
+		return srv.GetSessions().Count() == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestTelnetMove(t *testing.T) {
+	srv, addr := startTelnetTestServer(t)
+	client := dialTelnet(t, addr)
+	client.login("alice")
+	client.expect("You are in ")
+	client.expect("\n")
+	exits := client.expect("\n")
+
+	session, _ := srv.GetSessions().GetByAccount("alice")
+	player := session.GetPlayer()
+	x, y, _ := player.GetLocation()
+
+	if !strings.Contains(exits, "Exits: ") {
+		t.Skip("the spawn tile has no way out")
+	}
+	direction := strings.Fields(strings.TrimPrefix(exits, ansiGreen+"Exits: "))[0]
+	direction = strings.TrimSuffix(direction, ansiReset)
+	client.send(direction + "\r\n")
+	client.expect("You are in ")
+
+	move := MoveBody{Direction: strings.ToUpper(direction[:1]) + direction[1:]}
+	dx, dy, _ := move.delta(x, y)
+	px, py, _ := player.GetLocation()
+	assert.Equal(t, []int{x + dx, y + dy}, []int{px, py})
+}
+
+func TestTelnetReadLine(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	tc := newTelnetConn(server)
+
+	replies := make(chan []byte, 1)
+	go func() {
+		client.Write([]byte("ab\x08c\r\x00"))
+		// An escaped 0xff, the window size and an option the server refuses
+		client.Write([]byte{'x', telnetIAC, telnetIAC, telnetIAC, telnetSB, telnetOptNAWS, 0, 120, 0, 40, telnetIAC, telnetSE})
+		client.Write([]byte{telnetIAC, telnetDO, 24, 'y', '\r', '\n', 'z', '\n'})
+		reply := make([]byte, 3)
+		io.ReadFull(client, reply)
+		replies <- reply
+	}()
+
+	line, err := tc.readLine(100)
+	assert.NoError(t, err)
+	assert.Equal(t, "ac", line)
+	line, err = tc.readLine(100)
+	assert.NoError(t, err)
+	assert.Equal(t, "x\xffy", line)
+	assert.Equal(t, []byte{telnetIAC, telnetWONT, 24}, <-replies)
+	line, err = tc.readLine(100)
+	assert.NoError(t, err)
+	assert.Equal(t, "z", line)
+	assert.Equal(t, 120, tc.width)
+
+	go client.Write([]byte(strings.Repeat("x", 101) + "\n"))
+	_, err = tc.readLine(100)
+	assert.Equal(t, ErrFrameTooLarge, err)
+}
+
+func TestTelnetWrap(t *testing.T) {
+	tc := newTelnetConn(nil)
+	tc.width = 12
+	assert.Equal(t, "the quick\nbrown fox\njumps", tc.wrap("the quick brown fox jumps"))
+	assert.Equal(t, "supercalifragilistic\nword", tc.wrap("supercalifragilistic word"))
+	assert.Equal(t, "bell", plainText("be\x07ll"))
+
+	// Text going out doubles IAC and ends lines with CR LF
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	tc = newTelnetConn(server)
+	go tc.writeText("\xff\n")
+	out, _ := bufio.NewReader(client).Peek(4)
+	assert.Equal(t, []byte{telnetIAC, telnetIAC, '\r', '\n'}, out)
+}
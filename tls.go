@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const DefaultTLSReloadInterval = 30 * time.Second
+
+// TLSVersion is the oldest TLS version the server accepts.
+type TLSVersion uint16
+
+func (v TLSVersion) String() string {
+	switch uint16(v) {
+	case tls.VersionTLS10:
+		return "1.0"
+	case tls.VersionTLS11:
+		return "1.1"
+	case tls.VersionTLS12:
+		return "1.2"
+	case tls.VersionTLS13:
+		return "1.3"
+	default:
+		return "unknown"
+	}
+}
+
+func (v TLSVersion) MarshalText() ([]byte, error) {
+	return []byte(v.String()), nil
+}
+
+func (v *TLSVersion) UnmarshalText(text []byte) error {
+	version, err := ParseTLSVersion(string(text))
+	if err != nil {
+		return err
+	}
+	*v = version
+	return nil
+}
+
+func ParseTLSVersion(value string) (TLSVersion, error) {
+	switch strings.TrimPrefix(strings.ToLower(strings.TrimSpace(value)), "tls") {
+	case "1.0", "10":
+		return TLSVersion(tls.VersionTLS10), nil
+	case "1.1", "11":
+		return TLSVersion(tls.VersionTLS11), nil
+	case "", "1.2", "12":
+		return TLSVersion(tls.VersionTLS12), nil
+	case "1.3", "13":
+		return TLSVersion(tls.VersionTLS13), nil
+	default:
+		return TLSVersion(tls.VersionTLS12), fmt.Errorf("unknown TLS version: %s", value)
+	}
+}
+
+// ClientAuthPolicy decides whether clients must present a certificate signed
+// by one of the client CAs.
+type ClientAuthPolicy int
+
+const (
+	// ClientAuthNone asks for no client certificate
+	ClientAuthNone ClientAuthPolicy = iota
+	// ClientAuthOptional verifies a client certificate if one is presented
+	ClientAuthOptional
+	// ClientAuthRequire refuses clients without a valid certificate
+	ClientAuthRequire
+)
+
+func (p ClientAuthPolicy) String() string {
+	switch p {
+	case ClientAuthNone:
+		return "none"
+	case ClientAuthOptional:
+		return "optional"
+	case ClientAuthRequire:
+		return "require"
+	default:
+		return "unknown"
+	}
+}
+
+func (p ClientAuthPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *ClientAuthPolicy) UnmarshalText(text []byte) error {
+	policy, err := ParseClientAuthPolicy(string(text))
+	if err != nil {
+		return err
+	}
+	*p = policy
+	return nil
+}
+
+func ParseClientAuthPolicy(value string) (ClientAuthPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "none":
+		return ClientAuthNone, nil
+	case "optional", "verify-if-given":
+		return ClientAuthOptional, nil
+	case "require", "required":
+		return ClientAuthRequire, nil
+	default:
+		return ClientAuthNone, fmt.Errorf("unknown client auth policy: %s", value)
+	}
+}
+
+func (p ClientAuthPolicy) tlsClientAuth() tls.ClientAuthType {
+	switch p {
+	case ClientAuthOptional:
+		return tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		return tls.RequireAndVerifyClientCert
+	default:
+		return tls.NoClientCert
+	}
+}
+
+// CertificateStore holds the server certificate and client CAs loaded from
+// disk. Handshakes always use the latest successfully loaded files, so they
+// can be replaced without a restart; a failed reload keeps the old ones.
+type CertificateStore struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  []time.Time // of certFile, keyFile and caFile when last loaded
+}
+
+func LoadCertificateStore(certFile, keyFile, caFile string) (*CertificateStore, error) {
+	cs := &CertificateStore{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := cs.Reload(); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+func (cs *CertificateStore) files() []string {
+	files := []string{cs.certFile, cs.keyFile}
+	if cs.caFile != "" {
+		files = append(files, cs.caFile)
+	}
+	return files
+}
+
+func (cs *CertificateStore) statFiles() ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, path := range cs.files() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	return modTimes, nil
+}
+
+// Reload re-reads the certificate, key and client CA files.
+func (cs *CertificateStore) Reload() error {
+	modTimes, err := cs.statFiles()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(cs.certFile, cs.keyFile)
+	if err != nil {
+		return err
+	}
+
+	var clientCAs *x509.CertPool
+	if cs.caFile != "" {
+		data, err := os.ReadFile(cs.caFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			return fmt.Errorf("%s: no certificates found", cs.caFile)
+		}
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.cert = &cert
+	cs.clientCAs = clientCAs
+	cs.modTimes = modTimes
+	return nil
+}
+
+// ReloadIfChanged reloads the files when any of them was modified since
+// they were last loaded, and reports whether it did.
+func (cs *CertificateStore) ReloadIfChanged() (bool, error) {
+	modTimes, err := cs.statFiles()
+	if err != nil {
+		return false, err
+	}
+
+	cs.mu.RLock()
+	changed := len(modTimes) != len(cs.modTimes)
+	for i := 0; !changed && i < len(modTimes); i++ {
+		changed = !modTimes[i].Equal(cs.modTimes[i])
+	}
+	cs.mu.RUnlock()
+
+	if !changed {
+		return false, nil
+	}
+	return true, cs.Reload()
+}
+
+// Certificate returns the certificate handshakes currently use.
+func (cs *CertificateStore) Certificate() *tls.Certificate {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	return cs.cert
+}
+
+// TLSConfig returns a tls.Config that picks up reloaded files on every
+// handshake.
+func (cs *CertificateStore) TLSConfig(minVersion TLSVersion, clientAuth ClientAuthPolicy) *tls.Config {
+	return &tls.Config{
+		MinVersion: uint16(minVersion),
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cs.mu.RLock()
+			defer cs.mu.RUnlock()
+
+			return &tls.Config{
+				MinVersion:   uint16(minVersion),
+				Certificates: []tls.Certificate{*cs.cert},
+				ClientAuth:   clientAuth.tlsClientAuth(),
+				ClientCAs:    cs.clientCAs,
+			}, nil
+		},
+	}
+}
+
+// watchCertificates reloads the TLS files every ReloadInterval when they
+// change, until stop is closed.
+func (s *Server) watchCertificates(stop <-chan struct{}) {
+	interval := time.Duration(s.config.TLS.ReloadInterval)
+	if s.certs == nil || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			reloaded, err := s.certs.ReloadIfChanged()
+			if err != nil {
+				logrus.Error("Error reloading TLS certificates: ", err)
+			} else if reloaded {
+				logrus.Info("Reloaded TLS certificates")
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// ReloadCertificates re-reads the TLS files, keeping the old ones on error.
+func (s *Server) ReloadCertificates() error {
+	if s.certs == nil {
+		return nil
+	}
+	if err := s.certs.Reload(); err != nil {
+		return err
+	}
+	logrus.Info("Reloaded TLS certificates")
+	return nil
+}
+
+// wrapListener puts ln behind TLS when it is configured.
+func (s *Server) wrapListener(ln net.Listener) net.Listener {
+	if s.certs == nil {
+		return ln
+	}
+	// Keep-alive is set before the connection is hidden behind TLS
+	if tcpListener, ok := ln.(*net.TCPListener); ok {
+		ln = &keepAliveListener{tcpListener, time.Duration(s.config.KeepAlivePeriod)}
+	}
+	return tls.NewListener(ln, s.certs.TLSConfig(s.config.TLS.MinVersion, s.config.TLS.ClientAuth))
+}
+
+type keepAliveListener struct {
+	*net.TCPListener
+	period time.Duration
+}
+
+func (ln *keepAliveListener) Accept() (net.Conn, error) {
+	conn, err := ln.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetKeepAlive(true)
+	conn.SetKeepAlivePeriod(ln.period)
+	return conn, nil
+}
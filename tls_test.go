@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCA is a self-signed certificate authority issuing test certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// issue returns a PEM certificate and key for commonName, valid for
+// 127.0.0.1 as a server and usable as a client certificate.
+func (ca *testCA) issue(t *testing.T, commonName string) (certPEM, keyPEM []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeKeyPair writes a certificate for commonName into dir, replacing any
+// there before.
+func (ca *testCA) writeKeyPair(t *testing.T, dir, commonName string) (certFile, keyFile string) {
+	t.Helper()
+
+	certPEM, keyPEM := ca.issue(t, commonName)
+	certFile, keyFile = filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func startTLSTestServer(t *testing.T, ca *testCA, dir string, configure ...func(*Config)) (*Server, string) {
+	t.Helper()
+
+	certFile, keyFile := ca.writeKeyPair(t, dir, "first")
+	configure = append([]func(*Config){func(config *Config) {
+		config.TLS.CertFile = certFile
+		config.TLS.KeyFile = keyFile
+	}}, configure...)
+	return startTestServer(t, configure...)
+}
+
+// tlsServerName dials addr and returns the common name of the server's
+// certificate.
+func tlsServerName(t *testing.T, addr string, config *tls.Config) string {
+	t.Helper()
+
+	conn, err := tls.Dial("tcp", addr, config)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	for value, want := range map[string]uint16{
+		"":       tls.VersionTLS12,
+		"1.2":    tls.VersionTLS12,
+		"TLS1.3": tls.VersionTLS13,
+		"13":     tls.VersionTLS13,
+	} {
+		version, err := ParseTLSVersion(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, TLSVersion(want), version, value)
+	}
+	_, err := ParseTLSVersion("2.0")
+	assert.Error(t, err)
+
+	policy, err := ParseClientAuthPolicy("verify-if-given")
+	assert.NoError(t, err)
+	assert.Equal(t, ClientAuthOptional, policy)
+	_, err = ParseClientAuthPolicy("sometimes")
+	assert.Error(t, err)
+}
+
+func TestTLSLogin(t *testing.T) {
+	ca := newTestCA(t)
+	srv, addr := startTLSTestServer(t, ca, t.TempDir())
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: ca.pool()})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	conn.Write([]byte(testToken(t, "alice")))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = readEvent(NewPacketDecoder(conn, LengthPrefixed, DefaultMaxFrameSize), SpawnPlayerEvent)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, srv.GetSessions().Count())
+
+	// Plain TCP clients do not get in
+	plain, err := net.Dial("tcp", addr)
+	if assert.NoError(t, err) {
+		defer plain.Close()
+		plain.Write([]byte(testToken(t, "bob")))
+		plain.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = NewPacketDecoder(plain, LengthPrefixed, DefaultMaxFrameSize).Decode()
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 1, srv.GetSessions().Count())
+}
+
+func TestTLSCertificateReload(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	srv, addr := startTLSTestServer(t, ca, dir, func(config *Config) {
+		config.TLS.ReloadInterval = 0
+	})
+	client := &tls.Config{RootCAs: ca.pool()}
+	assert.Equal(t, "first", tlsServerName(t, addr, client))
+
+	ca.writeKeyPair(t, dir, "second")
+	assert.NoError(t, srv.ReloadCertificates())
+	assert.Equal(t, "second", tlsServerName(t, addr, client))
+
+	// A broken file is refused and the last good certificate kept
+	os.WriteFile(filepath.Join(dir, "server.crt"), []byte("not a certificate"), 0600)
+	assert.Error(t, srv.ReloadCertificates())
+	assert.Equal(t, "second", tlsServerName(t, addr, client))
+}
+
+func TestTLSCertificateWatch(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	_, addr := startTLSTestServer(t, ca, dir, func(config *Config) {
+		config.TLS.ReloadInterval = Duration(20 * time.Millisecond)
+	})
+	client := &tls.Config{RootCAs: ca.pool()}
+	assert.Equal(t, "first", tlsServerName(t, addr, client))
+
+	certFile, keyFile := ca.writeKeyPair(t, dir, "rotated")
+	// Make sure the change shows even on filesystems with coarse timestamps
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+
+	assert.Eventually(t, func() bool {
+		return tlsServerName(t, addr, client) == "rotated"
+	}, 2*time.Second, 20*time.Millisecond)
+}
+
+func TestTLSClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "clients.crt")
+	os.WriteFile(caFile, ca.pem, 0600)
+	srv, addr := startTLSTestServer(t, ca, dir, func(config *Config) {
+		config.TLS.ClientCAFile = caFile
+		config.TLS.ClientAuth = ClientAuthRequire
+	})
+
+	// Without a certificate the handshake fails, at the latest on first read
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: ca.pool()})
+	if err == nil {
+		conn.Write([]byte(testToken(t, "alice")))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = NewPacketDecoder(conn, LengthPrefixed, DefaultMaxFrameSize).Decode()
+		conn.Close()
+	}
+	assert.Error(t, err)
+	assert.Zero(t, srv.GetSessions().Count())
+
+	certPEM, keyPEM := ca.issue(t, "alice-client")
+	clientCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn, err = tls.Dial("tcp", addr, &tls.Config{RootCAs: ca.pool(), Certificates: []tls.Certificate{clientCert}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(testToken(t, "alice")))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = readEvent(NewPacketDecoder(conn, LengthPrefixed, DefaultMaxFrameSize), SpawnPlayerEvent)
+	assert.NoError(t, err)
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	ca := newTestCA(t)
+	_, addr := startTLSTestServer(t, ca, t.TempDir(), func(config *Config) {
+		config.TLS.MinVersion = TLSVersion(tls.VersionTLS13)
+	})
+
+	_, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: ca.pool(), MaxVersion: tls.VersionTLS12})
+	assert.Error(t, err)
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: ca.pool()})
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint16(tls.VersionTLS13), conn.ConnectionState().Version)
+		conn.Close()
+	}
+}
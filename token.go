@@ -0,0 +1,409 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// SigningMethodEd25519 implements EdDSA over Ed25519, which jwt-go does not
+// ship with.
+type SigningMethodEd25519 struct{}
+
+var SigningMethodEdDSA = &SigningMethodEd25519{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+func (m *SigningMethodEd25519) Alg() string {
+	return "EdDSA"
+}
+
+func (m *SigningMethodEd25519) Verify(signingString, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return errors.New("ed25519: verification error")
+	}
+	return nil
+}
+
+func (m *SigningMethodEd25519) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
+
+type verificationKey struct {
+	// alg is set when the JWKS entry pins its key to one algorithm
+	alg string
+	key interface{}
+}
+
+// KeySet holds the keys used to verify login tokens: an optional HMAC secret
+// plus public keys loaded from a PEM or JWKS file, indexed by key ID. Keys
+// without an ID are stored under "" and used for tokens that carry no kid.
+type KeySet struct {
+	mu     sync.RWMutex
+	path   string
+	secret []byte
+	keys   map[string]verificationKey
+}
+
+func NewKeySet(secret []byte) *KeySet {
+	return &KeySet{
+		secret: secret,
+		keys:   make(map[string]verificationKey),
+	}
+}
+
+// LoadKeySet reads public keys from path, which holds either a JWKS document
+// or one or more PEM blocks. A PEM block may carry a "kid" header.
+func LoadKeySet(path string, secret []byte) (*KeySet, error) {
+	ks := NewKeySet(secret)
+	ks.path = path
+	if err := ks.Reload(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// Reload re-reads the key file. On error the previous keys stay in use.
+func (ks *KeySet) Reload() error {
+	if ks.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(ks.path)
+	if err != nil {
+		return err
+	}
+
+	var keys map[string]verificationKey
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "{") {
+		keys, err = parseJWKS(data)
+	} else {
+		keys, err = parsePEMKeys(data)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", ks.path, err)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("%s: no keys found", ks.path)
+	}
+
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.mu.Unlock()
+
+	return nil
+}
+
+func (ks *KeySet) Len() int {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	return len(ks.keys)
+}
+
+// Lookup returns the key for kid, refusing keys whose type or pinned
+// algorithm does not match alg.
+func (ks *KeySet) Lookup(kid, alg string) (interface{}, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	entry, ok := ks.keys[kid]
+	if !ok {
+		if kid != "" {
+			return nil, fmt.Errorf("unknown key id: %s", kid)
+		}
+		if !strings.HasPrefix(alg, "HS") || ks.secret == nil {
+			return nil, fmt.Errorf("no key for algorithm %s", alg)
+		}
+		entry = verificationKey{key: ks.secret}
+	}
+
+	if entry.alg != "" && entry.alg != alg {
+		return nil, fmt.Errorf("key %s is pinned to %s, token uses %s", kid, entry.alg, alg)
+	}
+	if !keyMatchesAlg(entry.key, alg) {
+		return nil, fmt.Errorf("key %s cannot verify %s", kid, alg)
+	}
+	return entry.key, nil
+}
+
+func keyMatchesAlg(key interface{}, alg string) bool {
+	switch {
+	case strings.HasPrefix(alg, "HS"):
+		_, ok := key.([]byte)
+		return ok
+	case strings.HasPrefix(alg, "RS"), strings.HasPrefix(alg, "PS"):
+		_, ok := key.(*rsa.PublicKey)
+		return ok
+	case strings.HasPrefix(alg, "ES"):
+		_, ok := key.(*ecdsa.PublicKey)
+		return ok
+	case alg == "EdDSA":
+		_, ok := key.(ed25519.PublicKey)
+		return ok
+	default:
+		return false
+	}
+}
+
+func parsePEMKeys(data []byte) (map[string]verificationKey, error) {
+	keys := make(map[string]verificationKey)
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		key, err := parsePEMBlock(block)
+		if err != nil {
+			return nil, err
+		}
+
+		kid := block.Headers["kid"]
+		if _, exists := keys[kid]; exists {
+			return nil, fmt.Errorf("duplicate key id: %q", kid)
+		}
+		keys[kid] = verificationKey{key: key}
+	}
+	return keys, nil
+}
+
+func parsePEMBlock(block *pem.Block) (interface{}, error) {
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block: %s", block.Type)
+	}
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+func parseJWKS(data []byte) (map[string]verificationKey, error) {
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]verificationKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", jwk.Kid, err)
+		}
+
+		if _, exists := keys[jwk.Kid]; exists {
+			return nil, fmt.Errorf("duplicate key id: %q", jwk.Kid)
+		}
+		keys[jwk.Kid] = verificationKey{alg: jwk.Alg, key: key}
+	}
+	return keys, nil
+}
+
+func (jwk *jsonWebKey) publicKey() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve: %s", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(jwk.K)
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", jwk.Kty)
+	}
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// TokenVerifier parses login tokens, accepting only the pinned algorithms and,
+// when configured, the expected issuer and audience.
+type TokenVerifier struct {
+	keys       *KeySet
+	algorithms []string
+	issuer     string
+	audience   string
+}
+
+func NewTokenVerifier(keys *KeySet, algorithms []string, issuer, audience string) *TokenVerifier {
+	return &TokenVerifier{
+		keys:       keys,
+		algorithms: algorithms,
+		issuer:     issuer,
+		audience:   audience,
+	}
+}
+
+func (v *TokenVerifier) GetKeySet() *KeySet {
+	return v.keys
+}
+
+func (v *TokenVerifier) allows(alg string) bool {
+	for _, allowed := range v.algorithms {
+		if allowed == alg {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *TokenVerifier) keyFunc(token *jwt.Token) (interface{}, error) {
+	alg := token.Method.Alg()
+	if !v.allows(alg) {
+		return nil, fmt.Errorf("unexpected signing algorithm: %s", alg)
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	return v.keys.Lookup(kid, alg)
+}
+
+func (v *TokenVerifier) Parse(tokenString string) (*JwtClaims, error) {
+	claims := &JwtClaims{}
+	parser := &jwt.Parser{ValidMethods: v.algorithms}
+
+	token, err := parser.ParseWithClaims(tokenString, claims, v.keyFunc)
+	if err != nil {
+		return nil, err
+	}
+
+	if !token.Valid {
+		return nil, fmt.Errorf("invalid JWT")
+	}
+
+	if v.issuer != "" && !claims.VerifyIssuer(v.issuer, true) {
+		return nil, fmt.Errorf("unexpected token issuer: %s", claims.Issuer)
+	}
+
+	if v.audience != "" && !claims.VerifyAudience(v.audience, true) {
+		return nil, fmt.Errorf("unexpected token audience: %s", claims.Audience)
+	}
+
+	return claims, nil
+}
+
+// ParseAlgorithms splits a comma-separated algorithm list, refusing "none".
+func ParseAlgorithms(value string) ([]string, error) {
+	var algorithms []string
+	for _, alg := range strings.Split(value, ",") {
+		alg = strings.TrimSpace(alg)
+		if alg == "" {
+			continue
+		}
+		if strings.EqualFold(alg, "none") {
+			return nil, errors.New("the none algorithm cannot be accepted")
+		}
+		if jwt.GetSigningMethod(alg) == nil {
+			return nil, fmt.Errorf("unknown signing algorithm: %s", alg)
+		}
+		algorithms = append(algorithms, alg)
+	}
+
+	if len(algorithms) == 0 {
+		return nil, errors.New("no signing algorithms configured")
+	}
+	return algorithms, nil
+}
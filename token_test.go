@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func signTestToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims *JwtClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("Failed to sign test token: %v", err)
+	}
+	return signed
+}
+
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+func publicKeyPEM(t *testing.T, key interface{}, kid string) []byte {
+	t.Helper()
+
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal public key: %v", err)
+	}
+	block := &pem.Block{Type: "PUBLIC KEY", Bytes: der}
+	if kid != "" {
+		block.Headers = map[string]string{"kid": kid}
+	}
+	return pem.EncodeToMemory(block)
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func TestTokenVerifierPEM(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	path := writeTestFile(t, "key.pem", publicKeyPEM(t, &rsaKey.PublicKey, ""))
+
+	keys, err := LoadKeySet(path, nil)
+	assert.NoError(t, err)
+	verifier := NewTokenVerifier(keys, []string{"RS256"}, "", "")
+
+	claims, err := verifier.Parse(signTestToken(t, jwt.SigningMethodRS256, rsaKey, "", newTestClaims("acc", "Alice")))
+	assert.NoError(t, err)
+	assert.Equal(t, "acc", claims.GetAccountID())
+
+	// An HMAC token signed with the public key bytes must not pass
+	publicBytes, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	_, err = verifier.Parse(signTestToken(t, jwt.SigningMethodHS256, publicBytes, "", newTestClaims("acc", "Alice")))
+	assert.Error(t, err)
+}
+
+func TestTokenVerifierJWKS(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPublic, edPrivate, _ := ed25519.GenerateKey(rand.Reader)
+
+	jwks := map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa-1", "alg": "RS256", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec-1", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+			{"kty": "OKP", "kid": "ed-1", "crv": "Ed25519", "x": b64(edPublic)},
+		},
+	}
+	data, _ := json.Marshal(jwks)
+	keys, err := LoadKeySet(writeTestFile(t, "jwks.json", data), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, keys.Len())
+
+	verifier := NewTokenVerifier(keys, []string{"RS256", "ES256", "EdDSA"}, "", "")
+	claims := newTestClaims("acc", "Alice")
+
+	_, err = verifier.Parse(signTestToken(t, jwt.SigningMethodRS256, rsaKey, "rsa-1", claims))
+	assert.NoError(t, err)
+	_, err = verifier.Parse(signTestToken(t, jwt.SigningMethodES256, ecKey, "ec-1", claims))
+	assert.NoError(t, err)
+	_, err = verifier.Parse(signTestToken(t, SigningMethodEdDSA, edPrivate, "ed-1", claims))
+	assert.NoError(t, err)
+
+	// Wrong kid for the key type, unknown kid and missing kid are rejected
+	_, err = verifier.Parse(signTestToken(t, jwt.SigningMethodES256, ecKey, "rsa-1", claims))
+	assert.Error(t, err)
+	_, err = verifier.Parse(signTestToken(t, jwt.SigningMethodRS256, rsaKey, "rsa-2", claims))
+	assert.Error(t, err)
+	_, err = verifier.Parse(signTestToken(t, jwt.SigningMethodRS256, rsaKey, "", claims))
+	assert.Error(t, err)
+}
+
+func TestTokenVerifierAlgorithmPinning(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keys, err := LoadKeySet(writeTestFile(t, "key.pem", publicKeyPEM(t, &rsaKey.PublicKey, "")), []byte("secret"))
+	assert.NoError(t, err)
+
+	verifier := NewTokenVerifier(keys, []string{"RS256"}, "", "")
+	claims := newTestClaims("acc", "Alice")
+
+	_, err = verifier.Parse(signTestToken(t, jwt.SigningMethodHS256, []byte("secret"), "", claims))
+	assert.Error(t, err)
+
+	_, err = verifier.Parse(signTestToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "", claims))
+	assert.Error(t, err)
+
+	_, err = ParseAlgorithms("RS256,none")
+	assert.Error(t, err)
+
+	algorithms, err := ParseAlgorithms("RS256, EdDSA")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"RS256", "EdDSA"}, algorithms)
+}
+
+func TestTokenVerifierIssuerAudience(t *testing.T) {
+	secret := []byte("secret")
+	verifier := NewTokenVerifier(NewKeySet(secret), []string{"HS256"}, "auth.example", "mud")
+
+	claims := newTestClaims("acc", "Alice")
+	claims.Issuer = "auth.example"
+	claims.Audience = "mud"
+	claims.ExpiresAt = time.Now().Add(time.Hour).Unix()
+	_, err := verifier.Parse(signTestToken(t, jwt.SigningMethodHS256, secret, "", claims))
+	assert.NoError(t, err)
+
+	claims.Issuer = "evil.example"
+	_, err = verifier.Parse(signTestToken(t, jwt.SigningMethodHS256, secret, "", claims))
+	assert.Error(t, err)
+
+	claims.Issuer = "auth.example"
+	claims.Audience = "other"
+	_, err = verifier.Parse(signTestToken(t, jwt.SigningMethodHS256, secret, "", claims))
+	assert.Error(t, err)
+}
+
+func TestKeySetReload(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	path := writeTestFile(t, "keys.pem", publicKeyPEM(t, &oldKey.PublicKey, "v1"))
+	keys, err := LoadKeySet(path, nil)
+	assert.NoError(t, err)
+
+	verifier := NewTokenVerifier(keys, []string{"ES256"}, "", "")
+	claims := newTestClaims("acc", "Alice")
+
+	_, err = verifier.Parse(signTestToken(t, jwt.SigningMethodES256, newKey, "v2", claims))
+	assert.Error(t, err)
+
+	rotated := append(publicKeyPEM(t, &oldKey.PublicKey, "v1"), publicKeyPEM(t, &newKey.PublicKey, "v2")...)
+	assert.NoError(t, os.WriteFile(path, rotated, 0600))
+	assert.NoError(t, keys.Reload())
+
+	_, err = verifier.Parse(signTestToken(t, jwt.SigningMethodES256, newKey, "v2", claims))
+	assert.NoError(t, err)
+
+	// A broken file keeps the previous keys
+	assert.NoError(t, os.WriteFile(path, []byte("garbage"), 0600))
+	assert.Error(t, keys.Reload())
+	assert.Equal(t, 2, keys.Len())
+}
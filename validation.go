@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+
+// EventSchema describes the body an event accepts. Raw events take any body
+// and validate it themselves. Legacy events also accept the comma-separated
+// string form of their body; see LegacyBody.
+type EventSchema struct {
+	Event  string        `json:"event"`
+	Raw    bool          `json:"raw,omitempty"`
+	Legacy bool          `json:"legacy,omitempty"`
+	Fields []FieldSchema `json:"fields,omitempty"`
+}
+
+type FieldSchema struct {
+	Name     string        `json:"name"`
+	Type     string        `json:"type"`
+	Required bool          `json:"required,omitempty"`
+	Min      *float64      `json:"min,omitempty"`
+	Max      *float64      `json:"max,omitempty"`
+	MinLen   *int          `json:"min_len,omitempty"`
+	MaxLen   *int          `json:"max_len,omitempty"`
+	Fields   []FieldSchema `json:"fields,omitempty"`
+}
+
+// fieldRule is the compiled form of one field's `validate` tag.
+type fieldRule struct {
+	index    int
+	name     string
+	typ      reflect.Type
+	required bool
+	min, max *float64
+	minLen   *int
+	maxLen   *int
+	fields   []fieldRule // for struct and pointer to struct fields
+}
+
+// compileRules reads the `validate` tags of a struct type. The tag is a comma
+// separated list of:
+//
+//	required      the field must not be its zero value (use a pointer to
+//	              require a field whose zero value is meaningful)
+//	min=N, max=N  numeric range, inclusive
+//	minlen=N,
+//	maxlen=N      length of a string (in characters), slice or map
+//
+// Nested structs are checked with their own tags. Fields are named after
+// their json tag.
+func compileRules(t reflect.Type) ([]fieldRule, error) {
+	return compileStruct(t, map[reflect.Type]bool{})
+}
+
+func compileStruct(t reflect.Type, compiling map[reflect.Type]bool) ([]fieldRule, error) {
+	if compiling[t] {
+		return nil, fmt.Errorf("%s refers to itself", t)
+	}
+	compiling[t] = true
+	defer delete(compiling, t)
+
+	var rules []fieldRule
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue // unexported
+		}
+
+		name := field.Name
+		if tag := field.Tag.Get("json"); tag != "" {
+			jsonName := strings.Split(tag, ",")[0]
+			if jsonName == "-" {
+				continue
+			}
+			if jsonName != "" {
+				name = jsonName
+			}
+		}
+
+		rule := fieldRule{index: i, name: name, typ: field.Type}
+		if err := rule.parseTag(field.Tag.Get("validate")); err != nil {
+			return nil, fmt.Errorf("field %s: %v", name, err)
+		}
+
+		if structType := structElem(field.Type); structType != nil {
+			nested, err := compileStruct(structType, compiling)
+			if err != nil {
+				return nil, fmt.Errorf("field %s: %v", name, err)
+			}
+			rule.fields = nested
+		}
+
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (r *fieldRule) parseTag(tag string) error {
+	if tag == "" {
+		return nil
+	}
+
+	kind := indirect(r.typ).Kind()
+	for _, option := range strings.Split(tag, ",") {
+		key, value := option, ""
+		if i := strings.IndexByte(option, '='); i >= 0 {
+			key, value = option[:i], option[i+1:]
+		}
+
+		switch key {
+		case "required":
+			r.required = true
+		case "min", "max":
+			if !isNumeric(kind) {
+				return fmt.Errorf("%s needs a numeric field", key)
+			}
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("%s: %q is not a number", key, value)
+			}
+			if key == "min" {
+				r.min = &n
+			} else {
+				r.max = &n
+			}
+		case "minlen", "maxlen":
+			if kind != reflect.String && kind != reflect.Slice && kind != reflect.Map {
+				return fmt.Errorf("%s needs a string, slice or map field", key)
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("%s: %q is not a length", key, value)
+			}
+			if key == "minlen" {
+				r.minLen = &n
+			} else {
+				r.maxLen = &n
+			}
+		default:
+			return fmt.Errorf("unknown validation rule %q", option)
+		}
+	}
+	return nil
+}
+
+// validateRules checks v against rules and reports every failure at once.
+func validateRules(v reflect.Value, rules []fieldRule) error {
+	var problems []string
+	checkRules(v, rules, "", &problems)
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func checkRules(v reflect.Value, rules []fieldRule, prefix string, problems *[]string) {
+	for _, rule := range rules {
+		name := prefix + rule.name
+		value := v.Field(rule.index)
+
+		if rule.required && value.IsZero() {
+			*problems = append(*problems, name+" is required")
+			continue
+		}
+
+		// Absent optional fields are not checked further
+		if value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				continue
+			}
+			value = value.Elem()
+		}
+
+		switch {
+		case isNumeric(value.Kind()):
+			n := numericValue(value)
+			if rule.min != nil && n < *rule.min {
+				*problems = append(*problems, fmt.Sprintf("%s must be at least %v", name, *rule.min))
+			}
+			if rule.max != nil && n > *rule.max {
+				*problems = append(*problems, fmt.Sprintf("%s must be at most %v", name, *rule.max))
+			}
+		case value.Kind() == reflect.String || value.Kind() == reflect.Slice || value.Kind() == reflect.Map:
+			length := value.Len()
+			if value.Kind() == reflect.String {
+				length = utf8.RuneCountInString(value.String())
+			}
+			if rule.minLen != nil && length < *rule.minLen {
+				*problems = append(*problems, fmt.Sprintf("%s must be at least %d long", name, *rule.minLen))
+			}
+			if rule.maxLen != nil && length > *rule.maxLen {
+				*problems = append(*problems, fmt.Sprintf("%s must be at most %d long", name, *rule.maxLen))
+			}
+		case value.Kind() == reflect.Struct:
+			checkRules(value, rule.fields, name+".", problems)
+		}
+	}
+}
+
+// describeRules turns compiled rules into their schema.
+func describeRules(rules []fieldRule) []FieldSchema {
+	fields := make([]FieldSchema, 0, len(rules))
+	for _, rule := range rules {
+		fields = append(fields, FieldSchema{
+			Name:     rule.name,
+			Type:     schemaType(rule.typ),
+			Required: rule.required,
+			Min:      rule.min,
+			Max:      rule.max,
+			MinLen:   rule.minLen,
+			MaxLen:   rule.maxLen,
+			Fields:   describeRules(rule.fields),
+		})
+	}
+	return fields
+}
+
+func schemaType(t reflect.Type) string {
+	if t == rawMessageType {
+		return "any"
+	}
+
+	t = indirect(t)
+	switch kind := t.Kind(); {
+	case kind == reflect.String:
+		return "string"
+	case kind == reflect.Bool:
+		return "boolean"
+	case kind == reflect.Float32 || kind == reflect.Float64:
+		return "number"
+	case isNumeric(kind):
+		return "integer"
+	case kind == reflect.Slice || kind == reflect.Array:
+		return "array"
+	case kind == reflect.Struct || kind == reflect.Map:
+		return "object"
+	default:
+		return "any"
+	}
+}
+
+func indirect(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+func structElem(t reflect.Type) reflect.Type {
+	if t = indirect(t); t.Kind() == reflect.Struct {
+		return t
+	}
+	return nil
+}
+
+func isNumeric(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func numericValue(v reflect.Value) float64 {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint())
+	default:
+		return v.Float()
+	}
+}
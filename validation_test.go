@@ -0,0 +1,124 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testPosition struct {
+	X int `json:"x" validate:"min=0,max=100"`
+	Y int `json:"y" validate:"min=0,max=100"`
+}
+
+type testValidated struct {
+	Name     string        `json:"name" validate:"required,minlen=2,maxlen=5"`
+	Level    *int          `json:"level" validate:"required,min=1"`
+	Speed    float64       `json:"speed" validate:"max=1.5"`
+	Tags     []string      `json:"tags" validate:"maxlen=2"`
+	Position testPosition  `json:"position"`
+	Target   *testPosition `json:"target"`
+	internal int
+}
+
+func validateTest(t *testing.T, body testValidated) error {
+	t.Helper()
+
+	rules, err := compileRules(reflect.TypeOf(body))
+	if err != nil {
+		t.Fatalf("Failed to compile rules: %v", err)
+	}
+	return validateRules(reflect.ValueOf(body), rules)
+}
+
+func TestValidateRulesAccepts(t *testing.T) {
+	level := 3
+	body := testValidated{
+		Name:     "Ana",
+		Level:    &level,
+		Speed:    1.5,
+		Tags:     []string{"a", "b"},
+		Position: testPosition{X: 0, Y: 100},
+	}
+	assert.NoError(t, validateTest(t, body))
+}
+
+func TestValidateRulesRejects(t *testing.T) {
+	level := 0
+	body := testValidated{
+		Name:     "Añ-ña-ña",
+		Level:    &level,
+		Speed:    2,
+		Tags:     []string{"a", "b", "c"},
+		Position: testPosition{X: -1},
+		Target:   &testPosition{Y: 101},
+	}
+
+	err := validateTest(t, body)
+	if assert.Error(t, err) {
+		assert.Equal(t, "name must be at most 5 long; "+
+			"level must be at least 1; "+
+			"speed must be at most 1.5; "+
+			"tags must be at most 2 long; "+
+			"position.x must be at least 0; "+
+			"target.y must be at most 100", err.Error())
+	}
+
+	err = validateTest(t, testValidated{})
+	if assert.Error(t, err) {
+		assert.Equal(t, "name is required; level is required", err.Error())
+	}
+}
+
+func TestCompileRulesErrors(t *testing.T) {
+	for _, body := range []interface{}{
+		struct {
+			Name string `validate:"min=1"`
+		}{},
+		struct {
+			Count int `validate:"maxlen=1"`
+		}{},
+		struct {
+			Count int `validate:"max=lots"`
+		}{},
+		struct {
+			Count int `validate:"positive"`
+		}{},
+	} {
+		_, err := compileRules(reflect.TypeOf(body))
+		assert.Error(t, err, "%T", body)
+	}
+}
+
+type testRecursive struct {
+	Next *testRecursive `json:"next"`
+}
+
+func TestCompileRulesRecursive(t *testing.T) {
+	_, err := compileRules(reflect.TypeOf(testRecursive{}))
+	assert.Error(t, err)
+}
+
+func TestDescribeRules(t *testing.T) {
+	rules, err := compileRules(reflect.TypeOf(testValidated{}))
+	assert.NoError(t, err)
+
+	fields := describeRules(rules)
+	assert.Len(t, fields, 6)
+
+	assert.Equal(t, "name", fields[0].Name)
+	assert.Equal(t, "string", fields[0].Type)
+	assert.True(t, fields[0].Required)
+	assert.Equal(t, 2, *fields[0].MinLen)
+	assert.Equal(t, 5, *fields[0].MaxLen)
+
+	assert.Equal(t, "integer", fields[1].Type)
+	assert.Equal(t, 1.0, *fields[1].Min)
+	assert.Equal(t, "number", fields[2].Type)
+	assert.Equal(t, "array", fields[3].Type)
+
+	assert.Equal(t, "object", fields[4].Type)
+	assert.Len(t, fields[4].Fields, 2)
+	assert.Equal(t, 100.0, *fields[4].Fields[0].Max)
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// WebSocket gateway
+//
+// Browsers cannot open raw TCP, so the server can also accept WebSocket
+// connections (RFC 6455) on WebSocketAddress. After the HTTP upgrade the
+// connection is handled exactly like a TCP one: the first message is the
+// token, HELLO or RESUME, and each later message carries one packet, so no
+// length prefix or newline framing is used. JSON packets travel as text
+// messages and BinaryCodec packets as binary messages.
+
+const (
+	DefaultWebSocketPath = "/ws"
+
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+
+	wsCloseNormal      = 1000
+	wsCloseProtocol    = 1002
+	wsCloseTooBig      = 1009
+	wsMaxControlLength = 125
+)
+
+var ErrWebSocketProtocol = errors.New("websocket protocol error")
+
+// messageConn is implemented by transports that carry whole messages. Each
+// message is one frame: FrameReader and FrameWriter use them directly instead
+// of the configured frame mode.
+type messageConn interface {
+	ReadMessage(maxSize int) ([]byte, error)
+	WriteMessage(data []byte, binary bool) error
+}
+
+// wsConn is a WebSocket connection after the opening handshake. Read returns
+// the payload of the messages as a stream, but the server reads and writes
+// whole messages.
+type wsConn struct {
+	net.Conn
+	r      *bufio.Reader
+	client bool // masks what it sends, as the client side must
+
+	writeMu sync.Mutex
+	closed  bool
+
+	pending []byte // rest of the message being read through Read
+}
+
+func newWebSocketConn(conn net.Conn, r *bufio.Reader, client bool) *wsConn {
+	return &wsConn{Conn: conn, r: r, client: client}
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		message, err := c.ReadMessage(DefaultMaxFrameSize)
+		if err != nil {
+			return 0, err
+		}
+		c.pending = message
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write sends p as one text message.
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.WriteMessage(p, false); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ReadMessage returns the next data message, reassembling fragments and
+// answering control frames on the way. A close frame is answered and ends
+// the stream with io.EOF.
+func (c *wsConn) ReadMessage(maxSize int) ([]byte, error) {
+	var message []byte
+	started := false
+
+	for {
+		fin, opcode, payload, err := c.readFrame(maxSize)
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			c.closeWith(wsCloseNormal)
+			return nil, io.EOF
+		case wsOpText, wsOpBinary:
+			if started {
+				return nil, c.fail(wsCloseProtocol, "new message inside a fragmented one")
+			}
+			started = true
+		case wsOpContinuation:
+			if !started {
+				return nil, c.fail(wsCloseProtocol, "continuation without a message")
+			}
+		default:
+			return nil, c.fail(wsCloseProtocol, fmt.Sprintf("unknown opcode %d", opcode))
+		}
+
+		if len(message)+len(payload) > maxSize {
+			c.closeWith(wsCloseTooBig)
+			return nil, ErrFrameTooLarge
+		}
+		message = append(message, payload...)
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+func (c *wsConn) readFrame(maxSize int) (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.r, header[:]); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+
+	if header[0]&0x70 != 0 {
+		err = c.fail(wsCloseProtocol, "reserved bits set")
+		return
+	}
+	// Clients must mask their frames and servers must not
+	if masked == c.client {
+		err = c.fail(wsCloseProtocol, "wrong masking")
+		return
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if opcode >= wsOpClose && (!fin || length > wsMaxControlLength) {
+		err = c.fail(wsCloseProtocol, "bad control frame")
+		return
+	}
+	if length > uint64(maxSize) {
+		c.closeWith(wsCloseTooBig)
+		err = ErrFrameTooLarge
+		return
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.r, mask[:]); err != nil {
+			return
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+// WriteMessage sends data as one text or binary message.
+func (c *wsConn) WriteMessage(data []byte, binary bool) error {
+	opcode := byte(wsOpText)
+	if binary {
+		opcode = wsOpBinary
+	}
+	return c.writeFrame(opcode, data)
+}
+
+// writeFrame writes a single final frame with one Write call.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closed {
+		return net.ErrClosed
+	}
+
+	buf := make([]byte, 0, 14+len(payload))
+	buf = append(buf, 0x80|opcode)
+
+	maskBit := byte(0)
+	if c.client {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		buf = append(buf, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		buf = append(buf, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(buf[2:], uint16(len(payload)))
+	default:
+		buf = append(buf, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(buf[2:], uint64(len(payload)))
+	}
+
+	if c.client {
+		var mask [4]byte
+		rand.Read(mask[:])
+		buf = append(buf, mask[:]...)
+		start := len(buf)
+		buf = append(buf, payload...)
+		for i := range buf[start:] {
+			buf[start+i] ^= mask[i%4]
+		}
+	} else {
+		buf = append(buf, payload...)
+	}
+
+	if opcode == wsOpClose {
+		c.closed = true
+	}
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+// closeWith sends a close frame with code, once.
+func (c *wsConn) closeWith(code uint16) {
+	var payload [2]byte
+	binary.BigEndian.PutUint16(payload[:], code)
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.writeFrame(wsOpClose, payload[:])
+}
+
+func (c *wsConn) fail(code uint16, reason string) error {
+	c.closeWith(code)
+	return fmt.Errorf("%w: %s", ErrWebSocketProtocol, reason)
+}
+
+// Close says goodbye with a close frame before closing the connection.
+func (c *wsConn) Close() error {
+	c.closeWith(wsCloseNormal)
+	return c.Conn.Close()
+}
+
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeWebSocket performs the server side of the opening handshake and
+// takes over the connection.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request, allowedOrigins []string) (*wsConn, error) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, fmt.Errorf("%w: method %s", ErrWebSocketProtocol, r.Method)
+	}
+	if !headerContainsToken(r.Header, "Connection", "upgrade") || !headerContainsToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket upgrade required", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("%w: not an upgrade request", ErrWebSocketProtocol)
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusBadRequest)
+		return nil, fmt.Errorf("%w: version %q", ErrWebSocketProtocol, r.Header.Get("Sec-WebSocket-Version"))
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(w, "bad Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, fmt.Errorf("%w: bad key", ErrWebSocketProtocol)
+	}
+	if !originAllowed(r.Header.Get("Origin"), allowedOrigins) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return nil, fmt.Errorf("%w: origin %q not allowed", ErrWebSocketProtocol, r.Header.Get("Origin"))
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("response does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n"
+	conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetWriteDeadline(time.Time{})
+
+	return newWebSocketConn(conn, rw.Reader, false), nil
+}
+
+// originAllowed reports whether a browser page from origin may connect. An
+// empty allow list accepts any origin: authentication is by token, never by
+// cookie, so a foreign page gains nothing the token does not already grant.
+func originAllowed(origin string, allowed []string) bool {
+	if len(allowed) == 0 || origin == "" {
+		return true
+	}
+	for _, candidate := range allowed {
+		if candidate == "*" || strings.EqualFold(candidate, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// startWebSocket listens for WebSocket connections when WebSocketAddress is
+// set, behind TLS when the TCP listener is.
+func (s *Server) startWebSocket() error {
+	if s.config.WebSocket.Address == "" {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", s.config.WebSocket.Address)
+	if err != nil {
+		return err
+	}
+	ln = s.wrapListener(ln)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(s.config.WebSocket.Path, s.handleWebSocket)
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: time.Duration(s.config.ConnTimeout),
+	}
+
+	s.mu.Lock()
+	s.wsServer = server
+	s.wsListener = ln
+	s.mu.Unlock()
+
+	logrus.Info("WebSocket gateway listening on ", ln.Addr().String(), s.config.WebSocket.Path)
+	go server.Serve(ln)
+	return nil
+}
+
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWebSocket(w, r, s.config.WebSocket.AllowedOrigins)
+	if err != nil {
+		logrus.Warn("WebSocket upgrade from ", r.RemoteAddr, " refused: ", err)
+		return
+	}
+
+	done, ok := s.admit(conn)
+	if !ok {
+		return
+	}
+	defer done()
+	s.HandleConnection(conn, &s.wg)
+}
+
+// WebSocketAddr returns the address of the WebSocket gateway, or nil when it
+// is not running.
+func (s *Server) WebSocketAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.wsListener == nil {
+		return nil
+	}
+	return s.wsListener.Addr()
+}
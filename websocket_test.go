@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startWebSocketTestServer(t *testing.T, configure ...func(*Config)) (*Server, string) {
+	t.Helper()
+
+	configure = append([]func(*Config){func(config *Config) {
+		config.WebSocket.Address = "127.0.0.1:0"
+	}}, configure...)
+	srv, _ := startTestServer(t, configure...)
+	return srv, srv.WebSocketAddr().String()
+}
+
+// upgradeRequest sends a WebSocket opening handshake for path to addr and
+// returns the connection with the server's response.
+func upgradeRequest(t *testing.T, addr, path string, header http.Header) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to the gateway: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	request, _ := http.NewRequest(http.MethodGet, "http://"+addr+path, nil)
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	request.Write(conn)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		t.Fatalf("Failed to read the handshake response: %v", err)
+	}
+	return conn, reader, response
+}
+
+func websocketHeader() http.Header {
+	return http.Header{
+		"Connection":            {"keep-alive, Upgrade"},
+		"Upgrade":               {"websocket"},
+		"Sec-Websocket-Version": {"13"},
+		"Sec-Websocket-Key":     {base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))},
+	}
+}
+
+// dialWebSocket opens a client WebSocket to the gateway at addr.
+func dialWebSocket(t *testing.T, addr string) *wsConn {
+	t.Helper()
+
+	header := websocketHeader()
+	conn, reader, response := upgradeRequest(t, addr, DefaultWebSocketPath, header)
+	if !assert.Equal(t, http.StatusSwitchingProtocols, response.StatusCode) {
+		t.FailNow()
+	}
+	assert.Equal(t, websocketAccept(header.Get("Sec-Websocket-Key")), response.Header.Get("Sec-Websocket-Accept"))
+	return newWebSocketConn(conn, reader, true)
+}
+
+func TestWebSocketAccept(t *testing.T) {
+	// The example from RFC 6455 section 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestWebSocketMessages(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	serverConn := newWebSocketConn(server, bufio.NewReader(server), false)
+	clientConn := newWebSocketConn(client, bufio.NewReader(client), true)
+
+	// A message in two fragments with a ping between them
+	go func() {
+		clientConn.writeRaw(false, wsOpText, []byte(`{"event_name":`))
+		clientConn.writeRaw(true, wsOpPing, []byte("hi"))
+		clientConn.writeRaw(true, wsOpContinuation, []byte(`"PING"}`))
+	}()
+	received := make(chan []byte, 1)
+	go func() {
+		message, _ := serverConn.ReadMessage(DefaultMaxFrameSize)
+		received <- message
+	}()
+
+	_, opcode, payload, err := clientConn.readFrame(DefaultMaxFrameSize)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(wsOpPong), opcode)
+	assert.Equal(t, "hi", string(payload))
+	assert.Equal(t, `{"event_name":"PING"}`, string(<-received))
+
+	// Binary messages keep their opcode
+	go serverConn.WriteMessage([]byte{0x01, 0xff}, true)
+	fin, opcode, payload, err := clientConn.readFrame(DefaultMaxFrameSize)
+	assert.NoError(t, err)
+	assert.True(t, fin)
+	assert.Equal(t, byte(wsOpBinary), opcode)
+	assert.Equal(t, []byte{0x01, 0xff}, payload)
+}
+
+func TestWebSocketProtocolErrors(t *testing.T) {
+	for name, send := range map[string]func(c *wsConn){
+		// A client that does not mask is refused
+		"unmasked": func(c *wsConn) {
+			c.client = false
+			c.writeRaw(true, wsOpText, []byte("x"))
+		},
+		"continuation first": func(c *wsConn) { c.writeRaw(true, wsOpContinuation, []byte("x")) },
+		"fragmented ping":    func(c *wsConn) { c.writeRaw(false, wsOpPing, nil) },
+		"too large":          func(c *wsConn) { c.writeRaw(true, wsOpBinary, make([]byte, 120)) },
+	} {
+		server, client := net.Pipe()
+		serverConn := newWebSocketConn(server, bufio.NewReader(server), false)
+		clientConn := newWebSocketConn(client, bufio.NewReader(client), true)
+		go func() {
+			send(clientConn)
+			io.Copy(io.Discard, client)
+		}()
+
+		_, err := serverConn.ReadMessage(100)
+		assert.Error(t, err, name)
+		server.Close()
+		client.Close()
+	}
+}
+
+// writeRaw sends a single frame as a client would, fragments included.
+func (c *wsConn) writeRaw(fin bool, opcode byte, payload []byte) error {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	buf := []byte{first, byte(len(payload))}
+	if c.client {
+		buf[1] |= 0x80
+		buf = append(buf, 1, 2, 3, 4)
+		for i, b := range payload {
+			buf = append(buf, b^[]byte{1, 2, 3, 4}[i%4])
+		}
+	} else {
+		buf = append(buf, payload...)
+	}
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+func TestWebSocketLogin(t *testing.T) {
+	srv, wsAddr := startWebSocketTestServer(t)
+	_, tcpDecoder := joinTestClient(t, srv, srv.Addr().String(), "bob")
+
+	ws := dialWebSocket(t, wsAddr)
+	ws.Write([]byte(testToken(t, "alice")))
+	decoder := NewPacketDecoder(ws, LengthPrefixed, DefaultMaxFrameSize)
+	_, err := readEvent(decoder, SpawnPlayerEvent)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, srv.GetSessions().Count())
+
+	// The same handlers serve both transports
+	encoder := NewPacketEncoder(ws, LengthPrefixed, DefaultMaxFrameSize)
+	encoder.Encode(&Packet{EventName: ChatEvent, EventBody: json.RawMessage(`"alice,hello from the browser"`)})
+	packet, err := readEvent(tcpDecoder, ChatEvent)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `"alice,hello from the browser"`, string(packet.EventBody))
+	}
+
+	encoder.Encode(&Packet{EventName: PingEvent, EventBody: json.RawMessage(`{"nonce":4}`)})
+	_, err = readEvent(decoder, PongEvent)
+	assert.NoError(t, err)
+
+	// A close from the browser ends the session like a dropped connection
+	ws.Close()
+	assert.Eventually(t, func() bool {
+		alice, ok := srv.GetSessions().GetByAccount("alice")
+		if !ok {
+			return true
+		}
+		select {
+		case <-alice.Done():
+			return true
+		default:
+			return false
+		}
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestWebSocketHello(t *testing.T) {
+	srv, wsAddr := startWebSocketTestServer(t)
+
+	ws := dialWebSocket(t, wsAddr)
+	hello, _ := json.Marshal(HelloRequest{
+		ProtocolVersion: ProtocolVersion,
+		Features:        []string{FeatureBinary, FeatureCompression},
+		Token:           testToken(t, "alice"),
+	})
+	ws.WriteMessage(hello, false)
+
+	// Messages have no length header to flag compression in
+	_, opcode, payload, err := ws.readFrame(DefaultMaxFrameSize)
+	if assert.NoError(t, err) {
+		assert.Equal(t, byte(wsOpText), opcode)
+		var packet Packet
+		assert.NoError(t, json.Unmarshal(payload, &packet))
+		assert.JSONEq(t, `["binary"]`, string(mustField(t, packet.EventBody, "features")))
+	}
+
+	_, opcode, payload, err = ws.readFrame(DefaultMaxFrameSize)
+	if assert.NoError(t, err) {
+		assert.Equal(t, byte(wsOpBinary), opcode)
+		var packet Packet
+		assert.NoError(t, BinaryCodec{}.Unmarshal(payload, &packet))
+	}
+
+	session, _ := srv.GetSessions().GetByAccount("alice")
+	assert.Equal(t, "binary", session.Codec().Name())
+}
+
+func TestWebSocketHandshakeRefused(t *testing.T) {
+	_, wsAddr := startWebSocketTestServer(t, func(config *Config) {
+		config.WebSocket.AllowedOrigins = []string{"https://tools.example.com"}
+	})
+
+	_, _, response := upgradeRequest(t, wsAddr, DefaultWebSocketPath, http.Header{})
+	assert.Equal(t, http.StatusUpgradeRequired, response.StatusCode)
+
+	header := websocketHeader()
+	header.Set("Sec-Websocket-Version", "8")
+	_, _, response = upgradeRequest(t, wsAddr, DefaultWebSocketPath, header)
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	header = websocketHeader()
+	header.Set("Origin", "https://evil.example.com")
+	_, _, response = upgradeRequest(t, wsAddr, DefaultWebSocketPath, header)
+	assert.Equal(t, http.StatusForbidden, response.StatusCode)
+
+	header.Set("Origin", "https://tools.example.com")
+	_, _, response = upgradeRequest(t, wsAddr, DefaultWebSocketPath, header)
+	assert.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
+
+	_, _, response = upgradeRequest(t, wsAddr, "/elsewhere", websocketHeader())
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+}
+
+func TestWebSocketFrameLengths(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 0xffff, 0x10000} {
+		server, client := net.Pipe()
+		serverConn := newWebSocketConn(server, bufio.NewReader(server), false)
+		clientConn := newWebSocketConn(client, bufio.NewReader(client), true)
+
+		message := make([]byte, size)
+		go clientConn.WriteMessage(message, true)
+		received, err := serverConn.ReadMessage(1 << 20)
+		assert.NoError(t, err, fmt.Sprint(size))
+		assert.Len(t, received, size)
+
+		server.Close()
+		client.Close()
+	}
+}
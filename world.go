@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/google/uuid"
+
+	"github.com/Bioblaze/mud/Map"
+	"github.com/Bioblaze/mud/Player"
+)
+
+const (
+	StartMapName     = "Start"
+	DefaultMapWidth  = 64
+	DefaultMapHeight = 64
+)
+
+var ErrNoSpawnTile = errors.New("map has no walkable tile to spawn on")
+
+// World holds the maps players can be on and the controller IDs the UE
+// client uses to tell their pawns apart. Controller IDs are handed out on
+// first use and stay with a player for the lifetime of the process.
+type World struct {
+	mu             sync.RWMutex
+	start          *Map.Map
+	maps           map[uuid.UUID]*Map.Map
+	controllers    map[uuid.UUID]int32 // by player ID
+	nextController int32
+}
+
+func NewWorld(start *Map.Map) *World {
+	return &World{
+		start:       start,
+		maps:        map[uuid.UUID]*Map.Map{start.GetID(): start},
+		controllers: make(map[uuid.UUID]int32),
+	}
+}
+
+func (w *World) StartMap() *Map.Map {
+	return w.start
+}
+
+func (w *World) AddMap(m *Map.Map) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.maps[m.GetID()] = m
+}
+
+func (w *World) GetMap(id uuid.UUID) (*Map.Map, bool) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	m, ok := w.maps[id]
+	return m, ok
+}
+
+// Maps returns every map of the world, sorted by name.
+func (w *World) Maps() []*Map.Map {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	maps := make([]*Map.Map, 0, len(w.maps))
+	for _, m := range w.maps {
+		maps = append(maps, m)
+	}
+	sort.Slice(maps, func(i, j int) bool {
+		return maps[i].GetName() < maps[j].GetName()
+	})
+	return maps
+}
+
+// MapOf returns the map player is currently on.
+func (w *World) MapOf(player *Player.Player) (*Map.Map, bool) {
+	_, _, mapId := player.GetLocation()
+	m, ok := w.GetMap(mapId)
+	if !ok || !m.HasPlayer(player) {
+		return nil, false
+	}
+	return m, true
+}
+
+// ControllerID returns the controller ID of player, assigning the next free
+// one on first use.
+func (w *World) ControllerID(player *Player.Player) int32 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	id, ok := w.controllers[player.GetID()]
+	if !ok {
+		w.nextController++
+		id = w.nextController
+		w.controllers[player.GetID()] = id
+	}
+	return id
+}
+
+// Enter puts player on a map: back where it left off if that map still
+// exists and the tile is walkable, otherwise on a random walkable tile of the
+// start map. A player that is already on a map stays where it is.
+func (w *World) Enter(player *Player.Player) (*Map.Map, error) {
+	if m, ok := w.MapOf(player); ok {
+		return m, nil
+	}
+
+	x, y, mapId := player.GetLocation()
+	if m, ok := w.GetMap(mapId); ok {
+		if tile, err := m.GetTile(x, y); err == nil && tile.IsWalkable() {
+			return m, m.SetPlayer(player, x, y)
+		}
+	}
+
+	tile, err := spawnTile(w.start)
+	if err != nil {
+		return nil, err
+	}
+	return w.start, w.start.SetPlayer(player, tile.GetX(), tile.GetY())
+}
+
+// Leave takes player off its map. The player keeps its location so it can
+// be put back there by Enter.
+func (w *World) Leave(player *Player.Player) {
+	if m, ok := w.MapOf(player); ok {
+		m.RemovePlayer(player)
+	}
+}
+
+func spawnTile(m *Map.Map) (Map.Tile, error) {
+	var walkable []Map.Tile
+	for x := 0; x < m.GetWidth(); x++ {
+		for y := 0; y < m.GetHeight(); y++ {
+			if tile, _ := m.GetTile(x, y); tile.IsWalkable() {
+				walkable = append(walkable, tile)
+			}
+		}
+	}
+
+	if len(walkable) == 0 {
+		return Map.Tile{}, ErrNoSpawnTile
+	}
+	return walkable[rand.Intn(len(walkable))], nil
+}